@@ -0,0 +1,106 @@
+package main
+
+import "sync"
+
+// adaptiveConcurrency (SKYFLOW_CONCURRENCY_MODE=adaptive) steers fan-out
+// concurrency AIMD-style instead of using the configured limit outright. A
+// fan-out starts low and, after every wave of calls (as many calls as the
+// current limit), adds one slot if the wave was clean and halves the limit if
+// any call failed or the wave's mean latency rose past
+// adaptiveLatencyTolerance times the baseline. The configured limit (after
+// the scheduler, saturation and error-ramp cuts) stays the ceiling. The
+// limit a fan-out ends at, and the latency baseline, carry over to the
+// entity's next fan-out, so a warm container doesn't relearn them on every
+// invocation.
+type adaptiveConcurrency struct {
+	start int // limit for the first fan-out
+
+	mu       sync.Mutex
+	last     int     // limit the previous fan-out ended at; 0 before the first
+	baseline float64 // smoothed mean call latency of waves without errors, ms
+}
+
+// adaptiveLatencyTolerance is how far a wave's mean latency may rise over the
+// baseline before it counts as congestion.
+const adaptiveLatencyTolerance = 1.5
+
+func newAdaptiveConcurrency(start int) *adaptiveConcurrency {
+	return &adaptiveConcurrency{start: max(start, 1)}
+}
+
+// begin returns the limiter for one fan-out capped at ceiling.
+func (a *adaptiveConcurrency) begin(ceiling int) *aimdLimiter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	limit := a.start
+	if a.last > 0 {
+		limit = a.last
+	}
+	limit = min(limit, ceiling)
+	return &aimdLimiter{ceiling: ceiling, limit: limit, peak: limit, baseline: a.baseline}
+}
+
+// finish keeps l's final limit and baseline for the next fan-out.
+func (a *adaptiveConcurrency) finish(l *aimdLimiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.last, a.baseline = l.limit, l.baseline
+}
+
+// aimdLimiter is the per-fan-out state of adaptiveConcurrency.
+type aimdLimiter struct {
+	ceiling int
+
+	mu         sync.Mutex
+	limit      int
+	peak       int
+	baseline   float64
+	waveMs     int64
+	waveCalls  int
+	waveFailed bool
+}
+
+// observe records a finished call and, at the end of a wave, returns how many
+// slots to add to (or, if negative, remove from) the fan-out's semaphore.
+func (l *aimdLimiter) observe(latencyMs int64, failed bool) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.waveMs += latencyMs
+	l.waveCalls++
+	l.waveFailed = l.waveFailed || failed
+	if l.waveCalls < l.limit {
+		return 0
+	}
+
+	mean := float64(l.waveMs) / float64(l.waveCalls)
+	var next int
+	if l.waveFailed || l.baseline > 0 && mean > l.baseline*adaptiveLatencyTolerance {
+		next = max(l.limit/2, 1)
+	} else {
+		next = min(l.limit+1, l.ceiling)
+	}
+	// Failed waves say nothing about latency. Slow ones still move the
+	// baseline, so a vault that got slower for good is eventually taken as
+	// the new normal rather than pinning the limit at 1.
+	switch {
+	case l.waveFailed:
+	case l.baseline == 0:
+		l.baseline = mean
+	default:
+		l.baseline = ewmaAlpha*mean + (1-ewmaAlpha)*l.baseline
+	}
+	l.waveMs, l.waveCalls, l.waveFailed = 0, 0, false
+	delta := next - l.limit
+	l.limit = next
+	l.peak = max(l.peak, next)
+	return delta
+}
+
+// current returns the limit and the highest limit reached so far.
+func (l *aimdLimiter) current() (limit, peak int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit, l.peak
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAIMDLimiterWaves(t *testing.T) {
+	a := newAdaptiveConcurrency(2)
+	l := a.begin(5)
+
+	wave := func(latencyMs int64, failed bool) int {
+		limit, _ := l.current()
+		delta := 0
+		for i := 0; i < limit; i++ {
+			delta += l.observe(latencyMs, failed)
+		}
+		return delta
+	}
+	steps := []struct {
+		latencyMs int64
+		failed    bool
+		want      int
+	}{
+		{10, false, 3}, // clean waves add one slot each...
+		{10, false, 4},
+		{10, false, 5},
+		{10, false, 5}, // ...up to the ceiling
+		{10, true, 2},  // a failure halves the limit
+		{12, false, 3}, // within tolerance of the 10ms baseline
+		{40, false, 1}, // a latency spike halves it too
+	}
+	for i, s := range steps {
+		before, _ := l.current()
+		delta := wave(s.latencyMs, s.failed)
+		if got, _ := l.current(); got != s.want || delta != got-before {
+			t.Fatalf("step %d: limit %d -> %d (delta %d), want %d", i, before, got, delta, s.want)
+		}
+	}
+	if _, peak := l.current(); peak != 5 {
+		t.Errorf("peak = %d, want 5", peak)
+	}
+
+	// The next fan-out resumes where this one ended, under its own ceiling.
+	a.finish(l)
+	if next, _ := a.begin(8).current(); next != 1 {
+		t.Errorf("next fan-out starts at %d, want 1", next)
+	}
+	a.last = 6
+	if next, _ := a.begin(4).current(); next != 4 {
+		t.Errorf("next fan-out starts at %d, want the ceiling 4", next)
+	}
+}
+
+func TestAdaptiveConcurrencyRampsFanOut(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		if failing.Load() {
+			http.Error(w, "degraded", http.StatusBadRequest)
+			return
+		}
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.MaxConcurrency = 6
+	client.adaptive = newAdaptiveConcurrency(1)
+	rows := make([][]interface{}, 60) // 30 calls at BatchSize 2
+	for i := range rows {
+		rows[i] = []interface{}{i, fmt.Sprintf("tok_%d", i)}
+	}
+
+	_, m, _ := client.Detokenize(context.Background(), rows)
+	if m.FinalConcurrency < 3 || m.Concurrency != 6 {
+		t.Errorf("healthy: final=%d concurrency=%d, want a ramp to at least 3 under the ceiling 6", m.FinalConcurrency, m.Concurrency)
+	}
+	if peak.Load() > 6 {
+		t.Errorf("peak in-flight %d exceeded the ceiling 6", peak.Load())
+	}
+
+	failing.Store(true)
+	_, m, _ = client.Detokenize(context.Background(), rows)
+	if m.FinalConcurrency != 1 {
+		t.Errorf("failing: final concurrency = %d, want 1", m.FinalConcurrency)
+	}
+
+	// Fixed mode leaves the metric at 0.
+	client.adaptive = nil
+	if _, m, _ = client.Detokenize(context.Background(), rows); m.FinalConcurrency != 0 {
+		t.Errorf("fixed: final concurrency = %d, want 0", m.FinalConcurrency)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// backoffPolicy picks the pause before each retry of a Skyflow request
+// (SKYFLOW_BACKOFF). Attempt is 1 before the first retry; prev is the pause
+// returned for the previous retry of the same request, 0 before the first.
+type backoffPolicy interface {
+	delay(attempt int, prev time.Duration) time.Duration
+}
+
+// backoffStrategies are the accepted SKYFLOW_BACKOFF values.
+var backoffStrategies = map[string]bool{"fixed": true, "exponential": true, "full-jitter": true, "decorrelated": true}
+
+// loadBackoff reads SKYFLOW_BACKOFF, falling back to fixed with a warning on
+// an unknown strategy.
+func loadBackoff() string {
+	v := strings.ToLower(envOrDefault("SKYFLOW_BACKOFF", "fixed"))
+	if !backoffStrategies[v] {
+		log.Printf("WARN: invalid SKYFLOW_BACKOFF %q, using fixed", v)
+		return "fixed"
+	}
+	return v
+}
+
+// newBackoffPolicy returns the strategy named by name, with base the
+// RetryBackoff and ceiling the RetryBackoffMax. rnd returns values uniform
+// in [0, 1) and must be safe for concurrent use; nil uses math/rand.
+func newBackoffPolicy(name string, base, ceiling time.Duration, rnd func() float64) backoffPolicy {
+	if rnd == nil {
+		rnd = rand.Float64
+	}
+	ceiling = max(ceiling, base)
+	switch name {
+	case "exponential":
+		return exponentialBackoff{base: base, ceiling: ceiling}
+	case "full-jitter":
+		return fullJitterBackoff{exponentialBackoff{base: base, ceiling: ceiling}, rnd}
+	case "decorrelated":
+		return decorrelatedBackoff{base: base, ceiling: ceiling, rnd: rnd}
+	}
+	return fixedBackoff(base)
+}
+
+// fixedBackoff always waits RetryBackoff.
+type fixedBackoff time.Duration
+
+func (b fixedBackoff) delay(int, time.Duration) time.Duration { return time.Duration(b) }
+
+// exponentialBackoff waits base·2^(attempt-1), capped at ceiling.
+type exponentialBackoff struct {
+	base, ceiling time.Duration
+}
+
+func (b exponentialBackoff) delay(attempt int, _ time.Duration) time.Duration {
+	d := b.base
+	for i := 1; i < attempt && d < b.ceiling; i++ {
+		d *= 2
+	}
+	return min(d, b.ceiling)
+}
+
+// fullJitterBackoff waits a uniform random time in [0, exponential delay),
+// so concurrent retries of one throttled burst spread out instead of
+// returning together.
+type fullJitterBackoff struct {
+	exp exponentialBackoff
+	rnd func() float64
+}
+
+func (b fullJitterBackoff) delay(attempt int, prev time.Duration) time.Duration {
+	return time.Duration(b.rnd() * float64(b.exp.delay(attempt, prev)))
+}
+
+// decorrelatedBackoff is AWS's "decorrelated jitter": a uniform random time
+// in [base, 3·prev), capped at ceiling. Each pause grows from the last one
+// actually taken rather than from the attempt number.
+type decorrelatedBackoff struct {
+	base, ceiling time.Duration
+	rnd           func() float64
+}
+
+func (b decorrelatedBackoff) delay(_ int, prev time.Duration) time.Duration {
+	prev = max(prev, b.base)
+	d := b.base + time.Duration(b.rnd()*float64(3*prev-b.base))
+	return min(d, b.ceiling)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelaysWithinBounds(t *testing.T) {
+	const base, ceiling = 100 * time.Millisecond, 2 * time.Second
+	rnd := rand.New(rand.NewSource(1)).Float64
+
+	fixed := newBackoffPolicy("fixed", base, ceiling, rnd)
+	exponential := newBackoffPolicy("exponential", base, ceiling, rnd)
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1600, 2000, 2000} {
+		if got := exponential.delay(attempt+1, 0); got != want*time.Millisecond {
+			t.Errorf("exponential attempt %d = %v, want %v", attempt+1, got, want*time.Millisecond)
+		}
+		if got := fixed.delay(attempt+1, 0); got != base {
+			t.Errorf("fixed attempt %d = %v, want %v", attempt+1, got, base)
+		}
+	}
+
+	fullJitter := newBackoffPolicy("full-jitter", base, ceiling, rnd)
+	decorrelated := newBackoffPolicy("decorrelated", base, ceiling, rnd)
+	for run := 0; run < 200; run++ {
+		var prev time.Duration
+		for attempt := 1; attempt <= 10; attempt++ {
+			if got, hi := fullJitter.delay(attempt, 0), exponential.delay(attempt, 0); got < 0 || got >= hi {
+				t.Fatalf("full-jitter attempt %d = %v, want in [0, %v)", attempt, got, hi)
+			}
+			got := decorrelated.delay(attempt, prev)
+			if hi := min(3*max(prev, base), ceiling); got < base || got > hi {
+				t.Fatalf("decorrelated after %v = %v, want in [%v, %v]", prev, got, base, hi)
+			}
+			prev = got
+		}
+	}
+
+	// An unknown name (or none, as in hand-built configs) is fixed.
+	if got := newBackoffPolicy("", base, ceiling, nil).delay(5, time.Second); got != base {
+		t.Errorf("default policy delay = %v, want %v", got, base)
+	}
+}
+
+func TestRetryUsesBackoffStrategy(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= 3 {
+			http.Error(w, "throttled", http.StatusTooManyRequests)
+			return
+		}
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+	client := newTestClient(srv)
+	client.cfg.RetryMaxAttempts = 4
+	client.cfg.RetryBackoff = 5 * time.Millisecond
+	client.cfg.RetryBackoffMax = 15 * time.Millisecond
+	client.cfg.Backoff = "exponential"
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	got, _, err := client.Detokenize(context.Background(), [][]interface{}{{0, "tok_a"}})
+	if err != nil || got[0][1] != "a" {
+		t.Fatalf("Detokenize = %v (%v), want a after three retries", got, err)
+	}
+	for _, pause := range []string{"after 5ms", "after 10ms", "after 15ms"} {
+		if !strings.Contains(buf.String(), pause) {
+			t.Errorf("retry log missing %q:\n%s", pause, buf.String())
+		}
+	}
+}
+
+// throttleSim runs clients that each need one accepted request against a
+// server admitting at most perWindow requests per window and throttling the
+// rest, retrying with policy. It returns the virtual time until the last
+// client finished and the total number of requests sent.
+func throttleSim(policy backoffPolicy, clients, perWindow int, window time.Duration) (time.Duration, int) {
+	q := &simQueue{}
+	for i := 0; i < clients; i++ {
+		heap.Push(q, &simClient{})
+	}
+	var finish time.Duration
+	requests := 0
+	admitted := map[time.Duration]int{}
+	for q.Len() > 0 {
+		c := heap.Pop(q).(*simClient)
+		requests++
+		if w := c.at / window; admitted[w] < perWindow {
+			admitted[w]++
+			finish = max(finish, c.at)
+			continue
+		}
+		c.attempt++
+		c.pause = policy.delay(c.attempt, c.pause)
+		c.at += c.pause
+		heap.Push(q, c)
+	}
+	return finish, requests
+}
+
+// simClient is one simulated caller: when it sends next, and its backoff state.
+type simClient struct {
+	at      time.Duration
+	attempt int
+	pause   time.Duration
+}
+
+// simQueue orders simulated clients by their next request time.
+type simQueue []*simClient
+
+func (q simQueue) Len() int           { return len(q) }
+func (q simQueue) Less(i, j int) bool { return q[i].at < q[j].at }
+func (q simQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x any)        { *q = append(*q, x.(*simClient)) }
+func (q *simQueue) Pop() any {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// BenchmarkBackoffUnderThrottling reports, for each SKYFLOW_BACKOFF strategy,
+// the simulated time for 200 concurrent calls to get through a vault that
+// admits 10 per 100ms, and the requests sent (throttled ones included):
+//
+//	go test -run '^$' -bench BackoffUnderThrottling ./...
+func BenchmarkBackoffUnderThrottling(b *testing.B) {
+	for _, name := range []string{"fixed", "exponential", "full-jitter", "decorrelated"} {
+		b.Run(name, func(b *testing.B) {
+			rnd := rand.New(rand.NewSource(1)).Float64
+			policy := newBackoffPolicy(name, 50*time.Millisecond, 5*time.Second, rnd)
+			var total time.Duration
+			var requests int
+			for i := 0; i < b.N; i++ {
+				d, n := throttleSim(policy, 200, 10, 100*time.Millisecond)
+				total += d
+				requests += n
+			}
+			b.ReportMetric(float64(total.Milliseconds())/float64(b.N), "sim_ms")
+			b.ReportMetric(float64(requests)/float64(b.N), "requests")
+		})
+	}
+}
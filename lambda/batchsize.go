@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// batchController steers the sub-batch size toward a p95 call-latency
+// objective (SKYFLOW_TARGET_P95_MS). After each fan-out it looks at the p95 of
+// the most recent calls: above the target it shrinks batches (more, smaller
+// calls in parallel); under half the target it grows them (fewer, larger
+// calls). Between the two it holds, so the size settles instead of
+// oscillating around the objective.
+type batchController struct {
+	target   time.Duration
+	min, max int
+
+	mu      sync.Mutex
+	size    int
+	history []int64 // ring of recent call latencies, ms
+	next    int
+}
+
+// batchHistory is how many recent call latencies the p95 is taken over.
+const batchHistory = 50
+
+func newBatchController(target time.Duration, initial, maxSize int) *batchController {
+	return &batchController{
+		target:  target,
+		min:     1,
+		max:     max(maxSize, initial),
+		size:    initial,
+		history: make([]int64, 0, batchHistory),
+	}
+}
+
+// current returns the sub-batch size to use for the next fan-out.
+func (c *batchController) current() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// observe records a fan-out's call latencies and adjusts the size.
+func (c *batchController) observe(latencies []int64) {
+	if len(latencies) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, l := range latencies {
+		if len(c.history) < batchHistory {
+			c.history = append(c.history, l)
+		} else {
+			c.history[c.next] = l
+		}
+		c.next = (c.next + 1) % batchHistory
+	}
+
+	sorted := append([]int64(nil), c.history...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p95 := time.Duration(percentile(sorted, 95)) * time.Millisecond
+	switch {
+	case p95 > c.target:
+		c.size = max(c.size*3/4, c.min)
+	case p95 < c.target/2:
+		c.size = min(c.size+max(c.size/4, 1), c.max)
+	}
+}
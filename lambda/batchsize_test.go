@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBatchControllerTracksTarget(t *testing.T) {
+	c := newBatchController(100*time.Millisecond, 40, 64)
+	slow := []int64{150, 160, 170, 180}
+	for i := 0; i < 3; i++ {
+		c.observe(slow)
+	}
+	if got := c.current(); got != 16 { // 40 → 30 → 22 → 16
+		t.Fatalf("after slow calls: size = %d, want 16", got)
+	}
+
+	// In the hold band (p95 between target/2 and target) only part of the
+	// window has turned over, so the slow history still shrinks it once.
+	c.observe([]int64{70, 70, 70, 70})
+	if got := c.current(); got != 12 {
+		t.Fatalf("with slow calls still in the window: size = %d, want 12", got)
+	}
+
+	// Once the window is all fast, the size grows back, capped at max.
+	for i := 0; i < 30; i++ {
+		c.observe([]int64{10, 10, 10, 10})
+	}
+	if got := c.current(); got != 64 {
+		t.Errorf("after fast calls: size = %d, want the 64 cap", got)
+	}
+}
+
+func TestAdaptiveBatchSizeUsedByFanOut(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	cfg := newTestClient(srv).cfg
+	cfg.BatchSize = 8
+	cfg.MaxBatchSize = 100
+	cfg.TargetP95 = 10 * time.Millisecond
+	client := NewSkyflowClient(cfg)
+
+	rows := make([][]interface{}, 16)
+	for i := range rows {
+		rows[i] = []interface{}{i, fmt.Sprintf("tok_%d", i)}
+	}
+	_, m1, _ := client.Detokenize(context.Background(), rows)
+	_, m2, _ := client.Detokenize(context.Background(), rows)
+	if m1.BatchSize != 8 || m1.SkyflowCalls != 2 {
+		t.Errorf("first call: batch=%d calls=%d, want 8, 2", m1.BatchSize, m1.SkyflowCalls)
+	}
+	if m2.BatchSize != 6 || m2.SkyflowCalls != 3 {
+		t.Errorf("over target: batch=%d calls=%d, want 6, 3", m2.BatchSize, m2.SkyflowCalls)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned instead of calling Skyflow while the breaker is
+// open, so a degraded vault fails sub-batches immediately rather than each
+// one waiting out its timeout.
+var errCircuitOpen = errors.New("skyflow circuit breaker open")
+
+// circuitBreaker stops calling Skyflow after threshold consecutive failed
+// calls (transport errors, 5xx and 429 after retries). Once cooldown has
+// passed it half-opens and lets a single probe through: success closes it,
+// failure opens it for another cooldown. One breaker is shared by all of an
+// entity's concurrent sub-batches.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    string // "closed", "open" or "half_open"
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown, now: time.Now, state: "closed"}
+}
+
+// breakerOutcome classifies a finished call for the breaker.
+type breakerOutcome int
+
+const (
+	callSucceeded breakerOutcome = iota // Skyflow answered, even with a 4xx
+	callFailed                          // Skyflow unreachable, 5xx, 429 or past CallTimeout
+	callAbandoned                       // the caller gave up first; says nothing about Skyflow
+)
+
+// outcomeOf classifies the result of doWithRetry.
+func outcomeOf(ctx context.Context, err error) breakerOutcome {
+	var te *transportError
+	var se *statusError
+	switch {
+	case err == nil:
+		return callSucceeded
+	case context.Cause(ctx) == errCallTimeout:
+		return callFailed // a slow vault, not the invocation ending
+	case ctx.Err() != nil:
+		return callAbandoned
+	case errors.As(err, &te):
+		return callFailed
+	case errors.As(err, &se):
+		if se.code >= 500 || se.code == 429 {
+			return callFailed
+		}
+		return callSucceeded
+	}
+	return callAbandoned
+}
+
+// allow reports whether a call may go out, moving an open breaker whose
+// cooldown has passed to half-open and admitting its one probe.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case "open":
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return errCircuitOpen
+		}
+		b.transition("half_open")
+	case "half_open":
+		if b.probing {
+			return errCircuitOpen
+		}
+	default:
+		return nil
+	}
+	b.probing = true
+	return nil
+}
+
+// record folds a call's outcome into the breaker.
+func (b *circuitBreaker) record(outcome breakerOutcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case "closed":
+		switch outcome {
+		case callSucceeded:
+			b.failures = 0
+		case callFailed:
+			if b.failures++; b.failures >= b.threshold {
+				b.openedAt = b.now()
+				b.transition("open")
+			}
+		}
+	case "half_open":
+		b.probing = false
+		switch outcome {
+		case callSucceeded:
+			b.failures = 0
+			b.transition("closed")
+		case callFailed:
+			b.openedAt = b.now()
+			b.transition("open")
+		}
+	}
+	// Calls that were already in flight when the breaker opened don't move it.
+}
+
+// transition logs and applies a state change; b.mu must be held.
+func (b *circuitBreaker) transition(to string) {
+	log.Printf("WARN: circuit breaker %s: %s -> %s (consecutive failures=%d)", b.name, b.state, to, b.failures)
+	b.state = to
+}
+
+// currentState returns the breaker state for METRIC, or "off" without one.
+func (b *circuitBreaker) currentState() string {
+	if b == nil {
+		return "off"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// breakerSeverity orders states for merging metrics across entities.
+var breakerSeverity = map[string]int{"": 0, "off": 0, "closed": 1, "half_open": 2, "open": 3}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker("NAME", 2, time.Second)
+	b.now = func() time.Time { return now }
+
+	b.record(callFailed)
+	b.record(callSucceeded) // a success resets the consecutive count
+	b.record(callFailed)
+	if b.currentState() != "closed" {
+		t.Fatalf("state after non-consecutive failures = %s, want closed", b.currentState())
+	}
+	b.record(callFailed)
+	if b.currentState() != "open" || b.allow() != errCircuitOpen {
+		t.Fatalf("state = %s, want open and rejecting calls", b.currentState())
+	}
+
+	// After the cooldown exactly one probe goes through.
+	now = now.Add(time.Second)
+	if err := b.allow(); err != nil || b.currentState() != "half_open" {
+		t.Fatalf("probe: err=%v state=%s, want nil, half_open", err, b.currentState())
+	}
+	if b.allow() != errCircuitOpen {
+		t.Error("second call admitted while the probe is in flight")
+	}
+	b.record(callFailed)
+	if b.currentState() != "open" || b.allow() != errCircuitOpen {
+		t.Fatalf("failed probe: state = %s, want open for another cooldown", b.currentState())
+	}
+
+	now = now.Add(time.Second)
+	b.allow()
+	b.record(callAbandoned) // the probe's caller gave up; the next call probes instead
+	if err := b.allow(); err != nil {
+		t.Fatalf("probe after an abandoned one rejected: %v", err)
+	}
+	b.record(callSucceeded)
+	if b.currentState() != "closed" || b.allow() != nil {
+		t.Errorf("successful probe: state = %s, want closed", b.currentState())
+	}
+
+	var off *circuitBreaker
+	if off.currentState() != "off" {
+		t.Errorf("nil breaker state = %s, want off", off.currentState())
+	}
+}
+
+func TestCircuitBreakerShortCircuitsSubBatches(t *testing.T) {
+	var calls atomic.Int32
+	var healthy atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	client := newTestClient(srv)
+	client.cfg.BatchSize, client.cfg.MaxConcurrency, client.cfg.RetryMaxAttempts = 1, 1, 1
+	client.breaker = newCircuitBreaker("NAME", 2, time.Minute)
+	client.breaker.now = func() time.Time { return now }
+	rows := [][]interface{}{{0, "tok_a"}, {1, "tok_b"}, {2, "tok_c"}, {3, "tok_d"}}
+
+	got, m, _ := client.Detokenize(context.Background(), rows)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Skyflow calls = %d, want 2 before the breaker opened", n)
+	}
+	if m.BreakerState != "open" || m.Errors != 4 {
+		t.Errorf("breaker_state=%s errors=%d, want open, 4", m.BreakerState, m.Errors)
+	}
+	if s, _ := got[3][1].(string); !strings.Contains(s, errCircuitOpen.Error()) {
+		t.Errorf("short-circuited row = %v, want the circuit-open error", got[3][1])
+	}
+
+	// Once Skyflow recovers, the first call after the cooldown closes it again.
+	healthy.Store(true)
+	now = now.Add(time.Minute)
+	got, m, _ = client.Detokenize(context.Background(), rows)
+	if got[0][1] != "a" || got[3][1] != "d" || m.BreakerState != "closed" {
+		t.Errorf("after cooldown: got %v (breaker_state=%s), want values and closed", got, m.BreakerState)
+	}
+}
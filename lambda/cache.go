@@ -0,0 +1,116 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// valueCache is a size-bounded LRU of detokenized values, kept across
+// invocations of a warm container. Benchmarks detokenize the same tokens
+// over and over; a hit skips the Skyflow call for that token entirely.
+// Entries older than ttl (0 = never) are treated as misses, so values
+// updated or deleted in the vault are eventually fetched again.
+type valueCache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List // front = most recently used
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key    string
+	value  interface{}
+	stored time.Time
+}
+
+func newValueCache(size int, ttl time.Duration) *valueCache {
+	return &valueCache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+// get returns the cached value for key. A nil cache always misses.
+func (c *valueCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if c.ttl > 0 && c.now().Sub(entry.stored) >= c.ttl {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+// has reports whether key is cached and unexpired.
+func (c *valueCache) has(key string) bool {
+	_, ok := c.get(key)
+	return ok
+}
+
+// len returns the number of cached entries, expired ones included.
+func (c *valueCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// put stores value under key, evicting the least recently used entry when
+// the cache is full. A nil cache ignores it.
+func (c *valueCache) put(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.value, entry.stored = value, c.now()
+		c.order.MoveToFront(el)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, value: value, stored: c.now()})
+}
+
+// removeIf deletes every entry whose key satisfies match, expired or not,
+// and returns how many it deleted. A nil cache deletes nothing.
+func (c *valueCache) removeIf(match func(key string) bool) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, el := range c.entries {
+		if match(key) {
+			c.order.Remove(el)
+			delete(c.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
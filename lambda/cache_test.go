@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValueCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newValueCache(2, 0)
+	c.put("a", "A")
+	c.put("b", "B")
+	c.get("a") // b is now the least recently used
+	c.put("c", "C")
+	if _, ok := c.get("b"); ok {
+		t.Error("b survived eviction")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("%s evicted, want b evicted", key)
+		}
+	}
+
+	var disabled *valueCache
+	disabled.put("a", "A")
+	if _, ok := disabled.get("a"); ok {
+		t.Error("nil cache returned a hit")
+	}
+}
+
+func TestValueCacheTTL(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newValueCache(10, time.Second)
+	c.now = func() time.Time { return now }
+	c.put("a", "A")
+	now = now.Add(999 * time.Millisecond)
+	if v, ok := c.get("a"); !ok || v != "A" {
+		t.Errorf("before ttl: get = %v, %v, want A, true", v, ok)
+	}
+	now = now.Add(time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Error("entry served after its ttl")
+	}
+}
+
+func TestDetokenizeCache(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cache = newValueCache(100, 0)
+	rows := [][]interface{}{{0, "tok_a"}, {1, "tok_b"}, {2, "tok_a"}}
+	want := [][]interface{}{{0, "a"}, {1, "b"}, {2, "a"}}
+
+	got, m, _ := client.Detokenize(context.Background(), rows)
+	if !reflect.DeepEqual(got, want) || m.CacheHits != 0 || m.SkyflowCalls != 1 {
+		t.Errorf("cold: got %v (hits=%d calls=%d), want %v (0, 1)", got, m.CacheHits, m.SkyflowCalls, want)
+	}
+
+	// A warm invocation answers known tokens without calling Skyflow.
+	before := calls.Load()
+	got, m, _ = client.Detokenize(context.Background(), append(rows, []interface{}{3, "tok_c"}))
+	want = append(want, []interface{}{3, "c"})
+	if !reflect.DeepEqual(got, want) || m.CacheHits != 2 || m.SkyflowCalls != 1 || m.UniqueTokens != 3 {
+		t.Errorf("warm: got %v (hits=%d calls=%d unique=%d), want %v (2, 1, 3)",
+			got, m.CacheHits, m.SkyflowCalls, m.UniqueTokens, want)
+	}
+	got, m, _ = client.Detokenize(context.Background(), [][]interface{}{{7, "tok_c"}})
+	if got[0][1] != "c" || m.CacheHits != 1 || calls.Load()-before != 1 {
+		t.Errorf("single row: got %v (hits=%d calls=%d), want c from the cache", got, m.CacheHits, calls.Load()-before)
+	}
+
+	// Other redaction levels and tenant keys never see cached values.
+	before = calls.Load()
+	client.withRedaction("MASKED").Detokenize(context.Background(), rows)
+	client.withAPIKey("tenant-key").Detokenize(context.Background(), rows)
+	if n := calls.Load() - before; n != 2 {
+		t.Errorf("redaction and tenant requests made %d calls, want 2", n)
+	}
+}
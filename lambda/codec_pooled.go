@@ -0,0 +1,7 @@
+//go:build jsonpooled
+
+package main
+
+func init() {
+	codec = pooledCodec{}
+}
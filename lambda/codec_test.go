@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var codecs = map[string]jsonCodec{"std": stdCodec{}, "pooled": pooledCodec{}}
+
+// codecShapes are representative Snowflake and Skyflow payloads, including
+// characters encoding/json escapes specially.
+func codecShapes() []interface{} {
+	return []interface{}{
+		sfRequest{Data: [][]interface{}{{float64(0), "tok_a"}, {float64(1), "<b>&\"quoted\"</b>"}, {float64(2), nil}}},
+		sfResponse{Data: [][]interface{}{{float64(0), "Alice"}}, Errors: []rowError{{Row: float64(1), Error: "ERROR: x"}}},
+		tokenizeRequest{VaultID: "v", TableName: "table1", Records: []tokenizeRecordReq{{Data: map[string]string{"name": "Zoë\n"}}}},
+		tokenizeResponse{Records: []tokenizeRecordResp{{Tokens: map[string][]tokenEntry{"name": {{Token: "t1"}}}}}},
+		detokenizeRequest{VaultID: "v", Tokens: []string{"t1", "t2"}},
+		detokenizeResponse{Response: []detokenizeEntry{{Token: "t1", Value: jsonString(" line sep")}}},
+	}
+}
+
+func TestCodecsRoundTripEquivalent(t *testing.T) {
+	for _, shape := range codecShapes() {
+		want, err := stdCodec{}.Marshal(shape)
+		if err != nil {
+			t.Fatalf("std Marshal(%T): %v", shape, err)
+		}
+		for name, c := range codecs {
+			got, err := c.Marshal(shape)
+			if err != nil {
+				t.Fatalf("%s Marshal(%T): %v", name, shape, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s Marshal(%T) = %s, want %s", name, shape, got, want)
+			}
+
+			decoded := reflect.New(reflect.TypeOf(shape))
+			if err := c.Unmarshal(got, decoded.Interface()); err != nil {
+				t.Fatalf("%s Unmarshal(%T): %v", name, shape, err)
+			}
+			if !reflect.DeepEqual(decoded.Elem().Interface(), shape) {
+				t.Errorf("%s round trip of %T = %+v, want %+v", name, shape, decoded.Elem().Interface(), shape)
+			}
+		}
+	}
+}
+
+func TestPooledCodecDoesNotAliasBuffers(t *testing.T) {
+	c := pooledCodec{}
+	first, _ := c.Marshal(detokenizeRequest{VaultID: "first", Tokens: []string{"a"}})
+	want := string(first)
+	c.Marshal(detokenizeRequest{VaultID: "second", Tokens: []string{"b"}})
+	if string(first) != want {
+		t.Errorf("first result changed after reuse: %s", first)
+	}
+}
+
+func benchmarkCodecMarshal(b *testing.B, c jsonCodec) {
+	req := detokenizeRequest{VaultID: "vault", Tokens: benchTokens(1000)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Marshal(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCodecMarshalStd(b *testing.B)    { benchmarkCodecMarshal(b, stdCodec{}) }
+func BenchmarkCodecMarshalPooled(b *testing.B) { benchmarkCodecMarshal(b, pooledCodec{}) }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceAccount is a Skyflow service-account credentials file
+// (SKYFLOW_CREDENTIALS_FILE), as downloaded from Skyflow Studio. It signs the
+// JWT assertions exchanged for short-lived bearer tokens, so long benchmark
+// runs don't depend on a static SKYFLOW_API_KEY that expires partway through.
+type serviceAccount struct {
+	ClientID   string `json:"clientID"`
+	KeyID      string `json:"keyID"`
+	TokenURI   string `json:"tokenURI"`
+	PrivateKey string `json:"privateKey"`
+
+	key *rsa.PrivateKey
+}
+
+// loadServiceAccount reads and validates the credentials file at path.
+func loadServiceAccount(path string) (*serviceAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sa serviceAccount
+	if err := json.Unmarshal(data, &sa); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if sa.ClientID == "" || sa.KeyID == "" || sa.TokenURI == "" {
+		return nil, fmt.Errorf("%s: clientID, keyID and tokenURI are required", path)
+	}
+	if sa.key, err = parseRSAKey(sa.PrivateKey); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &sa, nil
+}
+
+// parseRSAKey decodes a PEM RSA private key in PKCS#8 or PKCS#1 form.
+func parseRSAKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("privateKey is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse privateKey: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("privateKey is not an RSA key")
+	}
+	return key, nil
+}
+
+// assertionLifetime is how long a signed JWT assertion is valid; it only has
+// to survive the token exchange.
+const assertionLifetime = time.Hour
+
+// assertion returns an RS256-signed JWT identifying the service account to
+// its token endpoint.
+func (sa *serviceAccount) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": sa.ClientID,
+		"key": sa.KeyID,
+		"aud": sa.TokenURI,
+		"sub": sa.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(assertionLifetime).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, sa.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("sign assertion: %w", err)
+	}
+	return signingInput + "." + enc.EncodeToString(sig), nil
+}
+
+// tokenRefreshMargin is how long before expiry a bearer token is replaced, so
+// a call never goes out with a token that lapses in flight.
+const tokenRefreshMargin = 5 * time.Minute
+
+// defaultTokenLifetime is assumed for bearer tokens whose expiry can't be read.
+const defaultTokenLifetime = time.Hour
+
+// bearerTokens mints bearer tokens for a service account and caches the
+// current one until shortly before it expires. It is shared by every entity's
+// client; a refresh holds the lock, so concurrent callers wait for one
+// exchange instead of each making their own.
+type bearerTokens struct {
+	account *serviceAccount
+	client  *http.Client
+	now     func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newBearerTokens(account *serviceAccount, client *http.Client) *bearerTokens {
+	return &bearerTokens{account: account, client: client, now: time.Now}
+}
+
+// get returns a bearer token valid for at least tokenRefreshMargin, minting a
+// new one when needed.
+func (b *bearerTokens) get(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.token != "" && b.now().Add(tokenRefreshMargin).Before(b.expiry) {
+		return b.token, nil
+	}
+	token, err := b.exchange(ctx)
+	if err != nil {
+		return "", err
+	}
+	b.token = token
+	b.expiry = b.now().Add(defaultTokenLifetime)
+	if exp, ok := jwtExpiry(token); ok {
+		b.expiry = exp
+	}
+	return token, nil
+}
+
+// invalidate drops the cached token after Skyflow rejected it, so the next
+// call mints a fresh one instead of failing until the expiry passes.
+func (b *bearerTokens) invalidate(token string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.token == token {
+		b.token = ""
+	}
+}
+
+// exchange trades a signed assertion for a bearer token at the account's
+// token endpoint.
+func (b *bearerTokens) exchange(ctx context.Context) (string, error) {
+	assertion, err := b.account.assertion(b.now())
+	if err != nil {
+		return "", err
+	}
+	body, _ := json.Marshal(map[string]string{
+		"grant_type": "urn:ietf:params:oauth:grant-type:jwt-bearer",
+		"assertion":  assertion,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.account.TokenURI, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, truncate(string(respBody), 200))
+	}
+	var out struct {
+		AccessToken string `json:"accessToken"`
+	}
+	if err := json.Unmarshal(respBody, &out); err != nil || out.AccessToken == "" {
+		return "", fmt.Errorf("token endpoint returned no accessToken: %s", truncate(string(respBody), 200))
+	}
+	return out.AccessToken, nil
+}
+
+// jwtExpiry reads the exp claim of a JWT without verifying it; the token is
+// only inspected to schedule its refresh.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
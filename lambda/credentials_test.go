@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTokenEndpoint verifies JWT assertions signed by key and answers each
+// with a fresh access token, "bearer-<n>", that expires after lifetime.
+type fakeTokenEndpoint struct {
+	t        *testing.T
+	key      *rsa.PublicKey
+	lifetime time.Duration
+	now      func() time.Time
+	issued   atomic.Int32
+}
+
+func (f *fakeTokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		GrantType string `json:"grant_type"`
+		Assertion string `json:"assertion"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	parts := strings.Split(req.Assertion, ".")
+	if req.GrantType != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+		http.Error(w, "bad grant", http.StatusBadRequest)
+		return
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if err := rsa.VerifyPKCS1v15(f.key, crypto.SHA256, digest[:], sig); err != nil {
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+	var claims map[string]interface{}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(payload, &claims)
+	if claims["iss"] != "client-1" || claims["key"] != "key-1" {
+		f.t.Errorf("assertion claims = %v", claims)
+	}
+
+	n := f.issued.Add(1)
+	exp, _ := json.Marshal(map[string]int64{"exp": f.now().Add(f.lifetime).Unix()})
+	token := fmt.Sprintf("bearer-%d.%s.sig", n, base64.RawURLEncoding.EncodeToString(exp))
+	json.NewEncoder(w).Encode(map[string]string{"accessToken": token, "tokenType": "Bearer"})
+}
+
+// writeCredentials writes a service-account file for tokenURI and returns its
+// path and public key.
+func writeCredentials(t *testing.T, tokenURI string) (string, *rsa.PublicKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	creds, _ := json.Marshal(map[string]string{
+		"clientID":   "client-1",
+		"clientName": "bench",
+		"keyID":      "key-1",
+		"tokenURI":   tokenURI,
+		"privateKey": string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(path, creds, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, &key.PublicKey
+}
+
+func TestBearerTokensRefreshBeforeExpiry(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	endpoint := &fakeTokenEndpoint{t: t, lifetime: time.Hour, now: clock}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+	path, pub := writeCredentials(t, srv.URL)
+	endpoint.key = pub
+
+	account, err := loadServiceAccount(path)
+	if err != nil {
+		t.Fatalf("loadServiceAccount: %v", err)
+	}
+	tokens := newBearerTokens(account, srv.Client())
+	tokens.now = clock
+
+	first, err := tokens.get(context.Background())
+	if err != nil || !strings.HasPrefix(first, "bearer-1.") {
+		t.Fatalf("first token = %q, %v", first, err)
+	}
+	now = now.Add(50 * time.Minute)
+	if tok, _ := tokens.get(context.Background()); tok != first {
+		t.Errorf("token replaced at 50m, want it reused until the refresh margin")
+	}
+	now = now.Add(6 * time.Minute) // inside the 5m margin before the 1h expiry
+	if tok, _ := tokens.get(context.Background()); !strings.HasPrefix(tok, "bearer-2.") {
+		t.Errorf("token at 56m = %q, want a refreshed bearer-2", tok)
+	}
+
+	tokens.invalidate("bearer-1.stale")
+	if tokens.get(context.Background()); endpoint.issued.Load() != 2 {
+		t.Errorf("invalidating an old token forced a refresh")
+	}
+}
+
+func TestServiceAccountTokenUsedForSkyflowCalls(t *testing.T) {
+	endpoint := &fakeTokenEndpoint{t: t, lifetime: time.Hour, now: time.Now}
+	tokenSrv := httptest.NewServer(endpoint)
+	defer tokenSrv.Close()
+	path, pub := writeCredentials(t, tokenSrv.URL)
+	endpoint.key = pub
+	account, err := loadServiceAccount(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var revoked atomic.Value
+	revoked.Store("")
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !strings.HasPrefix(auth, "bearer-") || auth == revoked.Load() {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fakeVault(w, r)
+	}))
+	defer vault.Close()
+
+	client := newTestClient(vault)
+	client.bearer = newBearerTokens(account, tokenSrv.Client())
+	rows := [][]interface{}{{0, "tok_a"}}
+	if got, _, _ := client.Detokenize(context.Background(), rows); got[0][1] != "a" {
+		t.Fatalf("Detokenize with service account = %v, want a", got)
+	}
+
+	// A token Skyflow rejects is dropped, and the next call mints another.
+	revoked.Store(client.bearer.token)
+	if got, _, _ := client.Detokenize(context.Background(), rows); !isErrorValue(got[0][1]) {
+		t.Errorf("revoked token: got %v, want an error", got)
+	}
+	if got, _, _ := client.Detokenize(context.Background(), rows); got[0][1] != "a" || endpoint.issued.Load() != 2 {
+		t.Errorf("after revocation: got %v with %d tokens issued, want a with 2", got, endpoint.issued.Load())
+	}
+
+	// Tenant keys replace the service account token.
+	if got, _, _ := client.withAPIKey("tenant-key").Detokenize(context.Background(), rows); !isErrorValue(got[0][1]) {
+		t.Errorf("tenant request authenticated with the service account token")
+	}
+}
+
+func TestLoadServiceAccountRejectsBadFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		"not-json":    "{",
+		"missing-uri": `{"clientID":"c","keyID":"k","privateKey":"x"}`,
+		"bad-key":     `{"clientID":"c","keyID":"k","tokenURI":"https://auth","privateKey":"not a key"}`,
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(body), 0o600)
+		if _, err := loadServiceAccount(path); err == nil {
+			t.Errorf("%s: loaded without error", name)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "sync"
+
+// errorRamp eases fan-out concurrency down while Skyflow calls keep failing,
+// and back up as they recover. It tracks a smoothed per-call error rate; once
+// the rate passes the threshold, concurrency shrinks in proportion to how far
+// past it the rate is, so a partly degraded vault gets less load but still
+// serves traffic instead of being cut off outright.
+type errorRamp struct {
+	threshold float64 // error fraction above which concurrency is reduced
+
+	mu   sync.Mutex
+	rate float64 // EWMA of the error fraction, one sample per fan-out
+	seen bool
+}
+
+// minRampFraction bounds the ramp-down: the limit never drops below this
+// fraction of the configured concurrency (or 1).
+const minRampFraction = 0.1
+
+func newErrorRamp(thresholdPct int) *errorRamp {
+	return &errorRamp{threshold: float64(thresholdPct) / 100}
+}
+
+// observe folds a fan-out's error fraction into the rolling rate.
+func (r *errorRamp) observe(calls, errors int) {
+	if calls == 0 {
+		return
+	}
+	sample := float64(errors) / float64(calls)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.seen {
+		r.rate, r.seen = sample, true
+		return
+	}
+	r.rate = ewmaAlpha*sample + (1-ewmaAlpha)*r.rate
+}
+
+// limit returns the concurrency to use in place of configured and the rolling
+// error rate as a percentage. At the threshold the full limit applies; at a
+// 100% error rate it is down to minRampFraction.
+func (r *errorRamp) limit(configured int) (int, float64) {
+	pct := r.ratePct()
+	rate := pct / 100
+	if rate <= r.threshold || r.threshold >= 1 {
+		return configured, pct
+	}
+	fraction := max(1-(rate-r.threshold)/(1-r.threshold), minRampFraction)
+	return max(int(float64(configured)*fraction), 1), pct
+}
+
+// ratePct returns the rolling error rate as a percentage.
+func (r *errorRamp) ratePct() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rate * 100
+}
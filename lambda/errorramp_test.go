@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestErrorRampDownAndUp(t *testing.T) {
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "degraded", http.StatusBadRequest)
+			return
+		}
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.MaxConcurrency = 10
+	client.errorRamp = newErrorRamp(20)
+	rows := [][]interface{}{{0, "tok_a"}, {1, "tok_b"}, {2, "tok_c"}, {3, "tok_d"}}
+
+	_, m, _ := client.Detokenize(context.Background(), rows)
+	if m.Concurrency != 10 || m.ErrorRatePct != 0 {
+		t.Errorf("healthy: concurrency=%d error_rate=%.1f, want 10, 0", m.Concurrency, m.ErrorRatePct)
+	}
+
+	// Sustained failures push the rolling rate past 20% and concurrency down.
+	failing.Store(true)
+	prev := 10
+	for i := 0; i < 15; i++ {
+		_, m, _ = client.Detokenize(context.Background(), rows)
+		if m.Concurrency > prev {
+			t.Fatalf("failing: concurrency rose from %d to %d", prev, m.Concurrency)
+		}
+		prev = m.Concurrency
+	}
+	if m.Concurrency >= 5 || m.Concurrency < 1 || m.ErrorRatePct < 90 {
+		t.Errorf("failing: concurrency=%d error_rate=%.1f, want 1..4, >= 90", m.Concurrency, m.ErrorRatePct)
+	}
+
+	// Recovery decays the rate and the limit climbs back to the configured value.
+	failing.Store(false)
+	for i := 0; i < 30; i++ {
+		_, m, _ = client.Detokenize(context.Background(), rows)
+		if m.Concurrency < prev {
+			t.Fatalf("recovering: concurrency fell from %d to %d", prev, m.Concurrency)
+		}
+		prev = m.Concurrency
+	}
+	if m.Concurrency != 10 {
+		t.Errorf("recovered: concurrency=%d error_rate=%.1f, want 10", m.Concurrency, m.ErrorRatePct)
+	}
+	if line := formatMetricKV(metricFields(invocationInfo{}, m)); !strings.Contains(line, "error_rate_pct=") {
+		t.Errorf("METRIC line missing error_rate_pct: %s", line)
+	}
+}
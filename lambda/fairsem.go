@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// fairSemaphore limits concurrency like a buffered channel, but grants slots
+// in the order they were requested. Blocked channel senders are woken in no
+// particular order, so under contention an early sub-batch can keep losing
+// the race for a slot and finish last, stretching the invocation's tail.
+// Tickets are taken synchronously in submission order and waited on later.
+type fairSemaphore struct {
+	mu      sync.Mutex
+	free    int
+	waiters []chan struct{} // FIFO; closed when granted
+}
+
+func newFairSemaphore(n int) *fairSemaphore {
+	return &fairSemaphore{free: n}
+}
+
+// ticket queues a request for a slot and returns a channel that is closed
+// once the slot is granted. Take tickets in the order slots should go out.
+func (s *fairSemaphore) ticket() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ready := make(chan struct{})
+	if s.free > 0 && len(s.waiters) == 0 {
+		s.free--
+		close(ready)
+		return ready
+	}
+	s.waiters = append(s.waiters, ready)
+	return ready
+}
+
+// wait blocks until ready is granted or ctx is done. On ctx done the ticket
+// is withdrawn, or its slot handed back if it was granted meanwhile, so the
+// caller must release only after a nil return.
+func (s *fairSemaphore) wait(ctx context.Context, ready chan struct{}) error {
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	for i, w := range s.waiters {
+		if w == ready {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			s.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	s.mu.Unlock()
+	s.release()
+	return ctx.Err()
+}
+
+// release frees a slot, passing it straight to the oldest waiter if any.
+func (s *fairSemaphore) release() {
+	s.resize(1)
+}
+
+// resize adds delta slots (or removes them, for a negative delta). Removed
+// slots that are in use are taken back as they are released, so free can
+// go negative until then.
+func (s *fairSemaphore) resize(delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.free += delta
+	for s.free > 0 && len(s.waiters) > 0 {
+		s.free--
+		close(s.waiters[0])
+		s.waiters = s.waiters[1:]
+	}
+}
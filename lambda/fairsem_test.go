@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFairSemaphoreFIFO(t *testing.T) {
+	sem := newFairSemaphore(1)
+	held := sem.ticket()
+	if sem.wait(context.Background(), held) != nil {
+		t.Fatal("first ticket not granted immediately")
+	}
+
+	const n = 50
+	tickets := make([]chan struct{}, n)
+	for i := range tickets {
+		tickets[i] = sem.ticket()
+	}
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	// Start waiters in reverse so goroutine start order can't explain FIFO.
+	for i := n - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := sem.wait(context.Background(), tickets[i]); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			sem.release()
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond) // let every waiter block
+	sem.release()
+	wg.Wait()
+
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("acquisition order = %v, want 0..%d", order, n-1)
+		}
+	}
+}
+
+func TestFairSemaphoreCancelledWaiter(t *testing.T) {
+	sem := newFairSemaphore(1)
+	held := sem.ticket()
+	sem.wait(context.Background(), held)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := sem.ticket()
+	next := sem.ticket()
+	cancel()
+	if sem.wait(ctx, abandoned) == nil {
+		t.Fatal("cancelled wait returned nil")
+	}
+	sem.release()
+	select {
+	case <-next:
+	case <-time.After(time.Second):
+		t.Fatal("slot went to the withdrawn ticket instead of the next waiter")
+	}
+}
+
+// BenchmarkSemaphoreOrder compares how far out of submission order a channel
+// semaphore and fairSemaphore start 200 sub-batches contending for 4 slots.
+// max_overtaken is the most later sub-batches that got a slot before some
+// earlier one; each overtake adds a call's latency to that sub-batch's wait.
+// With two CPUs the channel lets the first sub-batch start nearly last
+// (~196), while fairSemaphore stays within the slot count:
+//
+//	go test -run '^$' -bench SemaphoreOrder -cpu 2 ./...
+func BenchmarkSemaphoreOrder(b *testing.B) {
+	const n, limit = 200, 4
+	run := func(b *testing.B, enqueue func() (wait func() (release func()))) {
+		worst := 0
+		for iter := 0; iter < b.N; iter++ {
+			var mu sync.Mutex
+			var order []int
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				wait := enqueue()
+				go func(i int) {
+					defer wg.Done()
+					release := wait()
+					mu.Lock()
+					order = append(order, i)
+					mu.Unlock()
+					time.Sleep(50 * time.Microsecond)
+					release()
+				}(i)
+			}
+			wg.Wait()
+			for rank, i := range order {
+				worst = max(worst, rank-i)
+			}
+		}
+		b.ReportMetric(float64(worst), "max_overtaken")
+	}
+	b.Run("channel", func(b *testing.B) {
+		sem := make(chan struct{}, limit)
+		run(b, func() func() func() {
+			return func() func() { sem <- struct{}{}; return func() { <-sem } }
+		})
+	})
+	b.Run("fair", func(b *testing.B) {
+		sem := newFairSemaphore(limit)
+		run(b, func() func() func() {
+			ticket := sem.ticket()
+			return func() func() { sem.wait(context.Background(), ticket); return sem.release }
+		})
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// lifetimeStats accumulates per-container totals across invocations for the
+// flush summary. Like latencyRollup it resets on every cold start.
+type lifetimeStats struct {
+	rows         atomic.Int64
+	skyflowCalls atomic.Int64
+	errors       atomic.Int64
+	retries      atomic.Int64
+}
+
+var (
+	containerStats lifetimeStats
+	containerStart = time.Now()
+)
+
+func (s *lifetimeStats) observe(batchSize int, m *SkyflowMetrics) {
+	s.rows.Add(int64(batchSize))
+	s.skyflowCalls.Add(int64(m.SkyflowCalls))
+	s.errors.Add(int64(m.Errors))
+	s.retries.Add(int64(m.Retries))
+}
+
+// containerSummary is the body of an operation=flush response: the
+// container's lifetime stats at the moment its buffers were drained.
+type containerSummary struct {
+	Instance     string        `json:"instance"`
+	UptimeMs     int64         `json:"uptime_ms"`
+	Invocations  int64         `json:"invocations"`
+	Rows         int64         `json:"rows"`
+	SkyflowCalls int64         `json:"skyflow_calls"`
+	Errors       int64         `json:"errors"`
+	Retries      int64         `json:"retries"`
+	Latency      rollupSummary `json:"latency"`
+}
+
+// invocationReset is the body of an operation=reset-invocations response.
+type invocationReset struct {
+	Instance            string `json:"instance"`
+	PreviousInvocations int64  `json:"previous_invocations"` // including the reset call
+}
+
+// resetInvocations restarts the invocation counter reported in METRIC lines
+// and ROLLUP logs, so a benchmark run on a warm container counts from 1. The
+// lifetime count is lost: it is only returned here and logged. Cold-start
+// detection and the flush summary's counts are not affected.
+func resetInvocations() invocationReset {
+	res := invocationReset{
+		Instance:            redactMetricValue("instance", lambdaInstanceID),
+		PreviousInvocations: invocationCount.Swap(0),
+	}
+	log.Printf("RESET instance=%s previous_invocations=%d", res.Instance, res.PreviousInvocations)
+	return res
+}
+
+// flushAndSummarize drains everything the container holds in memory so a
+// harness can end a run without relying on Lambda freeze timing: it syncs
+// METRICS_FILE to disk and logs a final ROLLUP line, then returns the
+// lifetime summary. Invocations counts data-carrying calls only, not flushes.
+func flushAndSummarize() containerSummary {
+	if metricsFile != nil {
+		if err := metricsFile.Sync(); err != nil {
+			log.Printf("WARN: sync METRICS_FILE: %v", err)
+		}
+	}
+	latency := latencyRollup.summary()
+	summary := containerSummary{
+		Instance:     redactMetricValue("instance", lambdaInstanceID),
+		UptimeMs:     time.Since(containerStart).Milliseconds(),
+		Invocations:  latency.Cold.Count + latency.Warm.Count,
+		Rows:         containerStats.rows.Load(),
+		SkyflowCalls: containerStats.skyflowCalls.Load(),
+		Errors:       containerStats.errors.Load(),
+		Retries:      containerStats.retries.Load(),
+		Latency:      latency,
+	}
+	log.Printf("ROLLUP instance=%s invocations=%d %s", summary.Instance, summary.Invocations, latencyRollup.format())
+	log.Printf("FLUSH instance=%s uptime_ms=%d invocations=%d rows=%d skyflow_calls=%d errors=%d retries=%d",
+		summary.Instance, summary.UptimeMs, summary.Invocations, summary.Rows,
+		summary.SkyflowCalls, summary.Errors, summary.Retries)
+	return summary
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// healthResult is the JSON body of a readiness check.
+type healthResult struct {
+	Status string        `json:"status"` // "ok", or "unavailable" when a deep check failed
+	Mode   string        `json:"mode"`   // "skyflow" or "mock"
+	Vaults []vaultHealth `json:"vaults"`
+}
+
+type vaultHealth struct {
+	DataType string `json:"data_type"`
+	VaultID  string `json:"vault_id"` // redacted
+	Table    string `json:"table"`
+	Auth     string `json:"auth,omitempty"` // deep checks only: "ok" or the failure
+}
+
+// isHealthCheck reports whether req asks for a readiness check: a path
+// ending in /health, or sf-custom-x-healthcheck: true.
+func isHealthCheck(req events.APIGatewayProxyRequest, headers map[string]string) bool {
+	if strings.HasSuffix(strings.TrimSuffix(req.Path, "/"), "/health") {
+		return true
+	}
+	v := strings.ToLower(strings.TrimSpace(headers["sf-custom-x-healthcheck"]))
+	return v == "true" || v == "1"
+}
+
+// healthResponse answers a readiness check without touching Skyflow, or,
+// with ?deep=true, after a shallow auth check of each entity: an empty
+// detokenize call that reads no vault data. Any answer other than 401/403
+// counts as authenticated. A failed deep check returns 503 so orchestration
+// can hold a run until the Lambda is ready.
+func healthResponse(ctx context.Context, req events.APIGatewayProxyRequest, clients map[string]*SkyflowClient) (events.APIGatewayProxyResponse, error) {
+	res := healthResult{Status: "ok", Mode: "mock", Vaults: []vaultHealth{}}
+	if len(clients) > 0 {
+		res.Mode = "skyflow"
+	}
+	entities := make([]string, 0, len(clients))
+	for entity := range clients {
+		entities = append(entities, entity)
+	}
+	sort.Strings(entities)
+	for _, entity := range entities {
+		cfg := clients[entity].cfg
+		res.Vaults = append(res.Vaults, vaultHealth{DataType: entity, VaultID: redactVaultID(cfg.VaultID), Table: cfg.TableName})
+	}
+
+	if strings.EqualFold(req.QueryStringParameters["deep"], "true") {
+		var wg sync.WaitGroup
+		for i, entity := range entities {
+			wg.Add(1)
+			go func(v *vaultHealth, client *SkyflowClient) {
+				defer wg.Done()
+				v.Auth = client.checkAuth(ctx)
+			}(&res.Vaults[i], clients[entity])
+		}
+		wg.Wait()
+		for _, v := range res.Vaults {
+			if v.Auth != "ok" {
+				res.Status = "unavailable"
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if res.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	body, err := codec.Marshal(res)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 500, Body: `{"error":"marshal failure"}`}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}, nil
+}
+
+// checkAuth sends a detokenize call with no tokens and reports "ok" for a 2xx
+// or the 400 Skyflow may answer the empty token list with. Anything else,
+// including a gateway error or a moved endpoint, is reported with its status.
+func (sc *SkyflowClient) checkAuth(ctx context.Context) string {
+	ctx, cancel := context.WithTimeout(ctx, keepaliveTimeout)
+	defer cancel()
+	_, code, err := sc.doPost(ctx, sc.endpoint("/v2/tokens/detokenize"), detokenizeRequest{VaultID: sc.cfg.VaultID, Tokens: []string{}})
+	switch {
+	case err != nil:
+		return err.Error()
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return fmt.Sprintf("rejected with HTTP %d", code)
+	case (code < 200 || code >= 300) && code != http.StatusBadRequest:
+		return fmt.Sprintf("unavailable with HTTP %d", code)
+	}
+	return "ok"
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHandlerHealthCheck(t *testing.T) {
+	var calls atomic.Int32
+	var fail atomic.Int32 // status to answer with; 0 serves the vault
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if code := int(fail.Load()); code != 0 {
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	health := func(req events.APIGatewayProxyRequest) (int, healthResult) {
+		t.Helper()
+		resp, _ := handler(context.Background(), req)
+		if ct := resp.Headers["Content-Type"]; ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+		var res healthResult
+		if err := json.Unmarshal([]byte(resp.Body), &res); err != nil {
+			t.Fatalf("health body %s: %v", resp.Body, err)
+		}
+		return resp.StatusCode, res
+	}
+
+	useSkyflowClients(t, map[string]*SkyflowClient{})
+	status, res := health(events.APIGatewayProxyRequest{Headers: map[string]string{"sf-custom-x-healthcheck": "true"}, Body: "not json"})
+	if status != 200 || res.Status != "ok" || res.Mode != "mock" || len(res.Vaults) != 0 {
+		t.Errorf("mock health = %d %+v, want 200 ok mock with no vaults", status, res)
+	}
+
+	client := newTestClient(srv)
+	client.cfg.VaultID = "vault1234"
+	client.cfg.TableName = "persons"
+	useSkyflowClients(t, map[string]*SkyflowClient{"NAME": client})
+	req := events.APIGatewayProxyRequest{Path: "/prod/health/"}
+	status, res = health(req)
+	want := vaultHealth{DataType: "NAME", VaultID: "****1234", Table: "persons"}
+	if status != 200 || res.Mode != "skyflow" || len(res.Vaults) != 1 || res.Vaults[0] != want || calls.Load() != 0 {
+		t.Errorf("shallow health = %d %+v with %d vault calls, want 200 with %+v and no calls", status, res, calls.Load(), want)
+	}
+
+	req.QueryStringParameters = map[string]string{"deep": "true"}
+	if status, res = health(req); status != 200 || res.Vaults[0].Auth != "ok" || calls.Load() != 1 {
+		t.Errorf("deep health = %d %+v with %d vault calls, want 200 with auth ok after 1 call", status, res, calls.Load())
+	}
+	for code, auth := range map[int]string{
+		http.StatusBadRequest:   "ok",
+		http.StatusUnauthorized: "rejected with HTTP 401",
+		http.StatusNotFound:     "unavailable with HTTP 404",
+		http.StatusBadGateway:   "unavailable with HTTP 502",
+	} {
+		fail.Store(int32(code))
+		wantStatus := 503
+		if auth == "ok" {
+			wantStatus = 200
+		}
+		if status, res = health(req); status != wantStatus || res.Vaults[0].Auth != auth {
+			t.Errorf("deep health on HTTP %d = %d %+v, want %d with auth %q", code, status, res, wantStatus, auth)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// hostLimiter caps in-flight Skyflow requests per data-plane host. Entities
+// (or operations) served by different hosts each get their own semaphore, so
+// one saturated host does not hold back calls to another. It is shared by
+// every client in the container, since clients for different entities may
+// point at the same host.
+type hostLimiter struct {
+	limit int
+
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{limit: limit, sems: make(map[string]chan struct{})}
+}
+
+func (h *hostLimiter) sem(host string) chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sem, ok := h.sems[host]
+	if !ok {
+		sem = make(chan struct{}, h.limit)
+		h.sems[host] = sem
+	}
+	return sem
+}
+
+// acquire blocks until host has a free slot or ctx is done. The returned
+// release must be called once the request has finished.
+func (h *hostLimiter) acquire(ctx context.Context, host string) (release func(), err error) {
+	sem := h.sem(host)
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
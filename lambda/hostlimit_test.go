@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostLimiterIndependentPerHost(t *testing.T) {
+	type host struct {
+		srv               *httptest.Server
+		inFlight, maxSeen atomic.Int32
+	}
+	var hosts [2]*host
+	var bothBusy sync.WaitGroup // done once each host has had a call in flight
+	bothBusy.Add(2)
+	var once [2]sync.Once
+
+	for i := range hosts {
+		h := &host{}
+		i := i
+		h.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := h.inFlight.Add(1)
+			defer h.inFlight.Add(-1)
+			for {
+				m := h.maxSeen.Load()
+				if n <= m || h.maxSeen.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			// Hold the slot until the other host is busy too; a single shared
+			// semaphore would never let that happen.
+			once[i].Do(bothBusy.Done)
+			waitTimeout(&bothBusy, 2*time.Second)
+			time.Sleep(5 * time.Millisecond)
+			fakeVault(w, r)
+		}))
+		defer h.srv.Close()
+		hosts[i] = h
+	}
+
+	limiter := newHostLimiter(1)
+	var wg sync.WaitGroup
+	for _, h := range hosts {
+		client := newTestClient(h.srv)
+		client.hosts = limiter
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rows := [][]interface{}{{0, "tok_a"}, {1, "tok_b"}, {2, "tok_c"}, {3, "tok_d"}, {4, "tok_e"}, {5, "tok_f"}}
+			if _, m, err := client.Detokenize(context.Background(), rows); err != nil || m.Errors != 0 {
+				t.Errorf("Detokenize: err=%v errors=%d", err, m.Errors)
+			}
+		}()
+	}
+	if !waitTimeout(&wg, 5*time.Second) {
+		t.Fatal("detokenize calls did not finish; hosts are not limited independently")
+	}
+	for i, h := range hosts {
+		if got := h.maxSeen.Load(); got != 1 {
+			t.Errorf("host %d: max in-flight = %d, want 1", i, got)
+		}
+	}
+}
+
+// waitTimeout waits for wg and reports whether it finished within d.
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
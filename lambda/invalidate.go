@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"path"
+)
+
+// invalidateResult is the JSON summary returned for operation=cache-invalidate.
+type invalidateResult struct {
+	Cache        string `json:"cache"`             // "on", or "off" when there was nothing to purge
+	Tokens       int    `json:"tokens"`            // distinct tokens listed in the rows
+	Pattern      string `json:"pattern,omitempty"` // sf-custom-x-invalidate-pattern
+	Removed      int    `json:"removed"`           // cache entries purged, across redaction levels
+	CacheEntries int    `json:"cache_entries"`     // entity cache size afterwards
+}
+
+// runCacheInvalidate purges client's detokenize cache of the tokens in rows
+// and of tokens matching pattern, a path.Match glob ("" matches nothing), at
+// every redaction level. Use it after records were updated or deleted in the
+// vault. Caches are per container, so only the container that receives the
+// call is purged. The caller has already checked that pattern is valid.
+func runCacheInvalidate(client *SkyflowClient, rows [][]interface{}, pattern string) invalidateResult {
+	res := invalidateResult{Cache: "off", Pattern: pattern}
+	tokens := make(map[string]bool)
+	for _, row := range rows {
+		for k := 1; k < len(row); k++ {
+			if tok, ok := row[k].(string); ok && tok != "" {
+				tokens[tok] = true
+			}
+		}
+	}
+	res.Tokens = len(tokens)
+	if client == nil || client.cache == nil {
+		log.Printf("INFO: INVALIDATE skipped: detokenize cache is off")
+		return res
+	}
+	res.Cache = "on"
+
+	res.Removed = client.cache.removeIf(func(key string) bool {
+		token := cacheKeyToken(key)
+		if tokens[token] {
+			return true
+		}
+		matched, _ := path.Match(pattern, token)
+		return pattern != "" && matched
+	})
+	res.CacheEntries = client.cache.len()
+	log.Printf("INVALIDATE data_type=%s tokens=%d pattern=%q removed=%d cache_entries=%d",
+		client.cfg.Entity, res.Tokens, res.Pattern, res.Removed, res.CacheEntries)
+	return res
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestCacheInvalidateRemovesEntries(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	client := newTestClient(srv)
+	client.cache = newValueCache(100, 0)
+	for _, redaction := range []string{"PLAIN_TEXT", "MASKED"} {
+		client.cfg.Redaction = redaction
+		for _, tok := range []string{"tok_a", "tok_b", "ssn_1", "ssn_2", "keep"} {
+			client.cacheValue(tok, "v")
+		}
+	}
+
+	res := runCacheInvalidate(client, [][]interface{}{{0, "tok_a"}, {1, "tok_a", nil}, {2}, {3, "missing"}}, "ssn_*")
+	want := invalidateResult{Cache: "on", Tokens: 2, Pattern: "ssn_*", Removed: 6, CacheEntries: 4}
+	if res != want {
+		t.Errorf("invalidate = %+v, want %+v", res, want)
+	}
+	for _, redaction := range []string{"PLAIN_TEXT", "MASKED"} {
+		client.cfg.Redaction = redaction
+		for tok, kept := range map[string]bool{"tok_a": false, "ssn_1": false, "ssn_2": false, "tok_b": true, "keep": true} {
+			if client.cache.has(client.cacheKey(tok)) != kept {
+				t.Errorf("%s %s cached = %v, want %v", redaction, tok, !kept, kept)
+			}
+		}
+	}
+
+	if res := runCacheInvalidate(newTestClient(srv), nil, "*"); res.Cache != "off" || res.Removed != 0 {
+		t.Errorf("cache off: %+v, want a no-op", res)
+	}
+}
+
+func TestHandlerCacheInvalidate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(fakeVault))
+	defer srv.Close()
+	client := newTestClient(srv)
+	client.cache = newValueCache(100, 0)
+	useSkyflowClients(t, map[string]*SkyflowClient{"NAME": client})
+	client.Detokenize(context.Background(), [][]interface{}{{0, "tok_a"}, {1, "tok_b"}, {2, "tok_c"}})
+
+	invalidate := func(pattern, body string) events.APIGatewayProxyResponse {
+		resp, _ := handler(context.Background(), events.APIGatewayProxyRequest{
+			Headers: map[string]string{"sf-custom-x-operation": "cache-invalidate", "sf-custom-x-invalidate-pattern": pattern},
+			Body:    body,
+		})
+		return resp
+	}
+	resp := invalidate("tok_[ab]", `{"data":[[0,"tok_c"]]}`)
+	var out struct {
+		Data [][]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &out); err != nil || resp.StatusCode != 200 || len(out.Data) != 1 {
+		t.Fatalf("invalidate = %d %s (%v)", resp.StatusCode, resp.Body, err)
+	}
+	var res invalidateResult
+	json.Unmarshal(out.Data[0][1], &res)
+	if res.Removed != 3 || client.cache.len() != 0 {
+		t.Errorf("invalidate = %+v leaving %d entries, want all 3 removed", res, client.cache.len())
+	}
+
+	if resp := invalidate("tok_[", `{"data":[[0,"x"]]}`); resp.StatusCode != 400 {
+		t.Errorf("malformed pattern status = %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// keepaliveScheduler runs ping every interval on a background goroutine until
+// stop is called. Lambda freezes a container between invocations, and timers
+// do not fire while it is frozen, so this keeps pooled connections primed
+// during and between closely spaced bursts; it cannot stop the container from
+// being frozen or reclaimed.
+type keepaliveScheduler struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+func startKeepalive(interval time.Duration, ping func(ctx context.Context)) *keepaliveScheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	k := &keepaliveScheduler{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(k.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ping(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return k
+}
+
+// stop cancels any in-flight ping and waits for the goroutine to exit. It is
+// safe to call more than once.
+func (k *keepaliveScheduler) stop() {
+	k.once.Do(k.cancel)
+	<-k.done
+}
+
+// keepaliveTimeout bounds one ping so a hung host cannot pile up pings.
+const keepaliveTimeout = 5 * time.Second
+
+// ping issues an unauthenticated GET to the data plane root over the client's
+// pooled connections. Any response, even a 404, keeps the connection warm;
+// no API key is sent and no vault data is touched.
+func (sc *SkyflowClient) ping(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, keepaliveTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sc.endpoint("/"), nil)
+	if err != nil {
+		return
+	}
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("WARN: keepalive ping to %s failed: %v", sc.cfg.DataPlaneURL, err)
+		}
+		return
+	}
+	// Drain so the connection goes back to the pool.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveFiresAtInterval(t *testing.T) {
+	var pings atomic.Int32
+	k := startKeepalive(20*time.Millisecond, func(ctx context.Context) { pings.Add(1) })
+	time.Sleep(110 * time.Millisecond)
+	k.stop()
+	k.stop() // idempotent
+
+	got := pings.Load()
+	if got < 3 || got > 6 {
+		t.Errorf("pings in 110ms at 20ms interval = %d, want about 5", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if pings.Load() != got {
+		t.Errorf("pinged after stop: %d -> %d", got, pings.Load())
+	}
+}
+
+func TestPingHostsOncePerHost(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Error("keepalive ping sent the API key")
+		}
+		hits.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	clients := map[string]*SkyflowClient{"NAME": newTestClient(srv), "SSN": newTestClient(srv)}
+	pingHosts(clients)(context.Background())
+	if hits.Load() != 1 {
+		t.Errorf("hits = %d, want 1 for two entities on one host", hits.Load())
+	}
+}
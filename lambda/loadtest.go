@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Load test bounds. The duration is further capped by the invocation's own
+// deadline.
+const (
+	maxLoadtestRPS        = 200
+	maxLoadtestDuration   = 60 * time.Second
+	maxLoadtestBatchSize  = 1000
+	loadtestDeadlineSlack = 2 * time.Second // left to summarize and respond
+)
+
+// loadtestParams are read from sf-custom-x-loadtest-* headers.
+type loadtestParams struct {
+	Operation string        // tokenize or detokenize (default)
+	RPS       int           // batches started per second
+	Duration  time.Duration // how long to keep starting batches
+	BatchSize int           // rows per synthetic batch
+}
+
+// parseLoadtestParams reads and bounds the load test headers.
+func parseLoadtestParams(headers map[string]string) (loadtestParams, error) {
+	p := loadtestParams{Operation: "detokenize", RPS: 10, Duration: 10 * time.Second, BatchSize: 100}
+	if op := headers["sf-custom-x-loadtest-operation"]; op != "" {
+		if op != "tokenize" && op != "detokenize" {
+			return p, fmt.Errorf("invalid loadtest operation %q, want tokenize or detokenize", op)
+		}
+		p.Operation = op
+	}
+	ints := []struct {
+		header string
+		max    int
+		set    func(int)
+	}{
+		{"sf-custom-x-loadtest-rps", maxLoadtestRPS, func(n int) { p.RPS = n }},
+		{"sf-custom-x-loadtest-duration-ms", int(maxLoadtestDuration.Milliseconds()), func(n int) { p.Duration = time.Duration(n) * time.Millisecond }},
+		{"sf-custom-x-loadtest-batch-size", maxLoadtestBatchSize, func(n int) { p.BatchSize = n }},
+	}
+	for _, h := range ints {
+		v := headers[h.header]
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > h.max {
+			return p, fmt.Errorf("invalid %s %q, want 1-%d", h.header, v, h.max)
+		}
+		h.set(n)
+	}
+	return p, nil
+}
+
+// loadtestResult is the JSON summary returned for a load test.
+type loadtestResult struct {
+	Operation   string  `json:"operation"`
+	Mode        string  `json:"mode"`
+	TargetRPS   int     `json:"target_rps"`
+	AchievedRPS float64 `json:"achieved_rps"`
+	DurationMs  int64   `json:"duration_ms"`
+	BatchSize   int     `json:"batch_size"`
+	Batches     int     `json:"batches"`
+	Rows        int     `json:"rows"`
+	RowsPerSec  float64 `json:"rows_per_sec"`
+	Errors      int     `json:"errors"` // batches that failed or returned any ERROR: row
+	P50Ms       int64   `json:"p50_ms"`
+	P95Ms       int64   `json:"p95_ms"`
+	P99Ms       int64   `json:"p99_ms"`
+	MaxMs       int64   `json:"max_ms"`
+}
+
+// runLoadtest starts one synthetic batch every 1/RPS for the duration (cut
+// short by ctx), waits for them all, and summarizes per-batch latency. A nil
+// client runs the mock path. Tokenize batches insert real, uniquely valued
+// records when pointed at a vault; detokenize batches send made-up tokens,
+// which Skyflow answers with per-token errors but at realistic latency.
+func runLoadtest(ctx context.Context, client *SkyflowClient, p loadtestParams) loadtestResult {
+	mode := "skyflow"
+	if client == nil {
+		mode = "mock"
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		p.Duration = min(p.Duration, max(time.Until(deadline)-loadtestDeadlineSlack, 0))
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies []int64
+		errors    int
+		wg        sync.WaitGroup
+	)
+	runBatch := func(seq int) {
+		defer wg.Done()
+		rows := syntheticRows(p.Operation, seq, p.BatchSize)
+		start := time.Now()
+		failed := false
+		if client != nil {
+			out, m, err := runOperation(ctx, client, p.Operation, rows)
+			failed = err != nil || m.Errors > 0 || m.RecordErrors > 0 || hasErrorRow(out)
+		} else if simulatedDelay > 0 {
+			sleepCtx(ctx, simulatedDelay)
+		}
+		ms := elapsedMs(start)
+		mu.Lock()
+		defer mu.Unlock()
+		latencies = append(latencies, ms)
+		if failed {
+			errors++
+		}
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Second / time.Duration(p.RPS))
+	defer ticker.Stop()
+	stop := time.NewTimer(p.Duration)
+	defer stop.Stop()
+	seq := 0
+	for running := p.Duration > 0; running; {
+		wg.Add(1)
+		go runBatch(seq)
+		seq++
+		select {
+		case <-ticker.C:
+		case <-stop.C:
+			running = false
+		case <-ctx.Done():
+			running = false
+		}
+	}
+	startedFor := time.Since(start)
+	wg.Wait()
+
+	res := loadtestResult{
+		Operation:  p.Operation,
+		Mode:       mode,
+		TargetRPS:  p.RPS,
+		DurationMs: elapsedMs(start),
+		BatchSize:  p.BatchSize,
+		Batches:    seq,
+		Rows:       seq * p.BatchSize,
+		Errors:     errors,
+	}
+	if startedFor > 0 {
+		res.AchievedRPS = float64(seq) / startedFor.Seconds()
+	}
+	if res.DurationMs > 0 {
+		res.RowsPerSec = float64(res.Rows) / (float64(res.DurationMs) / 1000)
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		res.P50Ms = percentile(latencies, 50)
+		res.P95Ms = percentile(latencies, 95)
+		res.P99Ms = percentile(latencies, 99)
+		res.MaxMs = latencies[len(latencies)-1]
+	}
+	log.Printf("LOADTEST operation=%s mode=%s target_rps=%d achieved_rps=%.1f batches=%d rows=%d errors=%d p50_ms=%d p95_ms=%d p99_ms=%d max_ms=%d",
+		res.Operation, res.Mode, res.TargetRPS, res.AchievedRPS, res.Batches, res.Rows, res.Errors,
+		res.P50Ms, res.P95Ms, res.P99Ms, res.MaxMs)
+	return res
+}
+
+// syntheticRows builds batch seq of a load test. Values are unique per
+// container and batch so tokenize never collides with earlier runs.
+func syntheticRows(operation string, seq, n int) [][]interface{} {
+	prefix := "loadtest-" + lambdaInstanceID + "-" + strconv.Itoa(seq) + "-"
+	if operation == "detokenize" {
+		prefix = "tok_" + prefix
+	}
+	rows := make([][]interface{}, n)
+	for i := range rows {
+		rows[i] = []interface{}{i, prefix + strconv.Itoa(i)}
+	}
+	return rows
+}
+
+// hasErrorRow reports whether any single-argument row carries an in-band error.
+func hasErrorRow(rows [][]interface{}) bool {
+	for _, row := range rows {
+		if len(row) > 1 && isErrorValue(row[1]) {
+			return true
+		}
+	}
+	return false
+}
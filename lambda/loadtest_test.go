@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestLoadtestHitsTargetRPS(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	params := loadtestParams{Operation: "detokenize", RPS: 40, Duration: time.Second, BatchSize: 4}
+	res := runLoadtest(context.Background(), newTestClient(srv), params)
+
+	if res.AchievedRPS < 30 || res.AchievedRPS > 50 {
+		t.Errorf("achieved_rps = %.1f, want about 40", res.AchievedRPS)
+	}
+	if res.Batches < 30 || res.Batches > 50 || res.Rows != res.Batches*4 {
+		t.Errorf("batches = %d rows = %d, want about 40 batches of 4 rows", res.Batches, res.Rows)
+	}
+	// Batch size 2 on the test client: two sub-batches per synthetic batch.
+	if got := int(calls.Load()); got != res.Batches*2 {
+		t.Errorf("vault saw %d calls, want %d", got, res.Batches*2)
+	}
+	if res.Errors != 0 || res.Mode != "skyflow" {
+		t.Errorf("errors = %d mode = %s, want 0 errors against the skyflow client", res.Errors, res.Mode)
+	}
+	if res.P50Ms < 20 || res.P95Ms < res.P50Ms || res.MaxMs < res.P99Ms {
+		t.Errorf("latency p50=%d p95=%d p99=%d max=%d, want ordered and at least the 20ms vault delay",
+			res.P50Ms, res.P95Ms, res.P99Ms, res.MaxMs)
+	}
+}
+
+func TestParseLoadtestParams(t *testing.T) {
+	p, err := parseLoadtestParams(map[string]string{
+		"sf-custom-x-loadtest-operation":   "tokenize",
+		"sf-custom-x-loadtest-rps":         "25",
+		"sf-custom-x-loadtest-duration-ms": "1500",
+		"sf-custom-x-loadtest-batch-size":  "50",
+	})
+	want := loadtestParams{Operation: "tokenize", RPS: 25, Duration: 1500 * time.Millisecond, BatchSize: 50}
+	if err != nil || p != want {
+		t.Errorf("parseLoadtestParams = %+v, %v, want %+v", p, err, want)
+	}
+
+	for header, value := range map[string]string{
+		"sf-custom-x-loadtest-operation":   "delete",
+		"sf-custom-x-loadtest-rps":         "201",
+		"sf-custom-x-loadtest-duration-ms": "60001",
+		"sf-custom-x-loadtest-batch-size":  "0",
+	} {
+		if _, err := parseLoadtestParams(map[string]string{header: value}); err == nil {
+			t.Errorf("%s: %s accepted, want an error", header, value)
+		}
+	}
+}
+
+func TestHandlerLoadtest(t *testing.T) {
+	useSkyflowClients(t, nil)
+	req := events.APIGatewayProxyRequest{Headers: map[string]string{
+		"sf-custom-x-operation":            "loadtest",
+		"sf-custom-x-loadtest-rps":         "20",
+		"sf-custom-x-loadtest-duration-ms": "200",
+		"sf-custom-x-loadtest-batch-size":  "3",
+	}}
+
+	resp, _ := handler(context.Background(), req)
+	if resp.StatusCode != 403 {
+		t.Errorf("disabled loadtest status = %d, want 403", resp.StatusCode)
+	}
+
+	loadtestEnabled = true
+	t.Cleanup(func() { loadtestEnabled = false })
+	resp, _ = handler(context.Background(), req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("loadtest status = %d, body = %s", resp.StatusCode, resp.Body)
+	}
+	var out struct {
+		Data [][]json.RawMessage `json:"data"`
+	}
+	var res loadtestResult
+	if err := json.Unmarshal([]byte(resp.Body), &out); err != nil || len(out.Data) != 1 || len(out.Data[0]) != 2 {
+		t.Fatalf("loadtest body = %s (%v)", resp.Body, err)
+	}
+	if err := json.Unmarshal(out.Data[0][1], &res); err != nil || res.Mode != "mock" || res.Batches == 0 || res.BatchSize != 3 {
+		t.Errorf("loadtest result = %+v (%v), want a mock run of 3-row batches", res, err)
+	}
+}
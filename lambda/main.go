@@ -2,9 +2,15 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"encoding/base64"
 	"fmt"
 	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -15,7 +21,8 @@ import (
 
 var (
 	simulatedDelay  time.Duration
-	invocationCount atomic.Int64
+	invocationCount atomic.Int64 // restarts at operation=reset-invocations
+	warmed          atomic.Bool  // set by the container's first invocation
 	skyflowClients  map[string]*SkyflowClient
 )
 
@@ -25,26 +32,215 @@ type sfRequest struct {
 
 type sfResponse struct {
 	Data [][]interface{} `json:"data"`
+
+	// Errors is a non-standard, debug-only field filled when the caller sends
+	// sf-custom-x-error-channel: 1. Failed rows then carry null in Data and
+	// their messages are listed here instead of as "ERROR: ..." values.
+	Errors []rowError `json:"errors,omitempty"`
+}
+
+type rowError struct {
+	Row   interface{} `json:"row"`
+	Error string      `json:"error"`
 }
 
+// maxErrorRowsHeader caps how many row indexes go into X-Error-Rows.
+const maxErrorRowsHeader = 100
+
 var lambdaInstanceID string
 
+// mockDeterministicTokens (MOCK_DETERMINISTIC_TOKENS=1) is test-only: in mock
+// mode, tokenize returns sequential TOK_<DATA_TYPE>_<n> tokens numbered by
+// first appearance instead of the DETOK_ echo, so golden-file tests of
+// tokenize output are stable. Never enable it against real data.
+var mockDeterministicTokens bool
+
+// mockEmptyTokenValue is the mock detokenize result for an empty-string
+// token: nil, or "" with DETOKENIZE_EMPTY_TOKENS=empty, as in Skyflow mode.
+var mockEmptyTokenValue interface{}
+
+// maxResponseBytes (MAX_RESPONSE_BYTES) caps the response body. Snowflake
+// rejects external function responses over its payload limit as a whole, so
+// an oversized response is turned into a retryable 429 that names the limit
+// instead of being sent. The default leaves headroom under Lambda's 6 MB
+// (6291456 byte) synchronous response limit for the proxy envelope and
+// headers; the body is measured as it will be escaped inside that envelope.
+var maxResponseBytes int
+
+// heuristicRouter is set when SKYFLOW_HEURISTIC_ROUTING=1; requests without an
+// X-Data-Type header are then split across vaults by token shape.
+var heuristicRouter *tokenRouter
+
+// columnAllowlist (SKYFLOW_COLUMN_ALLOWLIST, comma-separated) restricts the
+// per-request sf-custom-x-column override; nil allows any column.
+var columnAllowlist map[string]bool
+
+// tenantAPIKeys maps tenant IDs to Skyflow API keys, loaded from
+// SKYFLOW_TENANT_API_KEY_<TENANT> variables. A request selects one with
+// sf-custom-x-tenant; the key itself never travels in a header.
+var tenantAPIKeys map[string]string
+
+const tenantKeyEnvPrefix = "SKYFLOW_TENANT_API_KEY_"
+
+// loadTenantAPIKeys collects SKYFLOW_TENANT_API_KEY_<TENANT>=<key> pairs from
+// environ. Tenant IDs are matched case-insensitively; nil means no tenants.
+func loadTenantAPIKeys(environ []string) map[string]string {
+	var keys map[string]string
+	for _, kv := range environ {
+		name, key, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, tenantKeyEnvPrefix) || key == "" {
+			continue
+		}
+		if keys == nil {
+			keys = make(map[string]string)
+		}
+		keys[strings.ToUpper(strings.TrimPrefix(name, tenantKeyEnvPrefix))] = key
+	}
+	return keys
+}
+
+// forwardBenchConfig (SKYFLOW_FORWARD_BENCH_CONFIG=1) forwards the
+// sf-benchmark-config header to Skyflow. Off by default: the value names the
+// benchmark scenario, which is internal to the benchmark.
+var forwardBenchConfig bool
+
+// keepalive pings each Skyflow host every SKYFLOW_KEEPALIVE_INTERVAL_MS; nil
+// when unset.
+var keepalive *keepaliveScheduler
+
+// latencyRollup splits handler latency into the cold invocation and warm ones
+// and logs a ROLLUP line every ROLLUP_EVERY invocations (default 100).
+var latencyRollup coldWarmRollup
+
+// handlerInFlight tracks concurrently executing handler calls; its peak goes
+// into each ROLLUP line.
+var handlerInFlight inFlightGauge
+
+// loadtestEnabled (LOADTEST_ENABLED=1) allows operation=loadtest, which
+// drives synthetic batches at Skyflow from inside the Lambda. Off by default
+// so a caller of the endpoint can't aim load at the vault.
+var loadtestEnabled bool
+
 func init() {
 	lambdaInstanceID = fmt.Sprintf("%d", time.Now().UnixNano())
+	mockDeterministicTokens = envBool("MOCK_DETERMINISTIC_TOKENS")
+	if strings.ToLower(os.Getenv("DETOKENIZE_EMPTY_TOKENS")) == "empty" {
+		mockEmptyTokenValue = ""
+	}
+	maxResponseBytes = envIntOrDefault("MAX_RESPONSE_BYTES", 6000000)
+	initMetricsOutput()
+	latencyRollup.every = int64(envIntOrDefault("ROLLUP_EVERY", 100))
+	handlerInFlight.warnAt = int64(envIntOrDefault("INFLIGHT_WARN_THRESHOLD", 0))
+	tenantAPIKeys = loadTenantAPIKeys(os.Environ())
+	forwardBenchConfig = envBool("SKYFLOW_FORWARD_BENCH_CONFIG")
+	loadtestEnabled = envBool("LOADTEST_ENABLED")
+	traceSampleRate = loadTraceSampleRate()
+	if v := os.Getenv("SKYFLOW_COLUMN_ALLOWLIST"); v != "" {
+		columnAllowlist = make(map[string]bool)
+		for _, col := range splitColumns(v) {
+			columnAllowlist[col] = true
+		}
+	}
 
 	// Initialize Skyflow clients (nil map if SKYFLOW_DATA_PLANE_URL not set → mock mode)
 	configs := loadSkyflowConfigs()
+	if err := validateSkyflowConfigs(configs); err != nil {
+		if !envBool("SKYFLOW_SKIP_VALIDATION") {
+			log.Fatalf("ERROR: %v (set SKYFLOW_SKIP_VALIDATION=true to start anyway)", err)
+		}
+		log.Printf("WARN: %v; starting anyway (SKYFLOW_SKIP_VALIDATION)", err)
+	}
 	if configs != nil {
 		skyflowClients = make(map[string]*SkyflowClient, len(configs))
 		for entity, cfg := range configs {
 			skyflowClients[entity] = NewSkyflowClient(*cfg)
-			log.Printf("INFO: Skyflow entity %s enabled (vault=%s, table=%s, column=%s)",
-				entity, cfg.VaultID, cfg.TableName, cfg.ColumnName)
 		}
+		// Optional container-wide concurrency budget shared across entities
+		if budget := envIntOrDefault("SKYFLOW_GLOBAL_CONCURRENCY", 0); budget > 0 {
+			sched := newEntityScheduler(budget, os.Getenv("SKYFLOW_CONCURRENCY_WEIGHTING"))
+			for _, client := range skyflowClients {
+				client.scheduler = sched
+			}
+			log.Printf("INFO: Skyflow entity scheduler enabled (budget=%d, policy=%s)", budget, sched.policy)
+		}
+		if limit := envIntOrDefault("SKYFLOW_HOST_CONCURRENCY", 0); limit > 0 {
+			hosts := newHostLimiter(limit)
+			for _, client := range skyflowClients {
+				client.hosts = hosts
+			}
+			log.Printf("INFO: Skyflow per-host concurrency limit enabled (limit=%d)", limit)
+		}
+		heuristicRouter = loadTokenRouter()
+		if ms := envIntOrDefault("SKYFLOW_SATURATION_LAG_MS", 0); ms > 0 {
+			monitor := newSaturationMonitor(time.Duration(ms) * time.Millisecond)
+			for _, client := range skyflowClients {
+				client.saturation = monitor
+			}
+			log.Printf("INFO: CPU saturation backoff enabled (lag threshold=%dms)", ms)
+		}
+		if pct := envIntOrDefault("SKYFLOW_ERROR_RAMP_PCT", 0); pct > 0 {
+			for _, client := range skyflowClients {
+				client.errorRamp = newErrorRamp(pct) // per entity: one failing vault shouldn't slow the others
+			}
+			log.Printf("INFO: Error-rate concurrency ramp-down enabled (threshold=%d%%)", pct)
+		}
+		switch mode := strings.ToLower(envOrDefault("SKYFLOW_CONCURRENCY_MODE", "fixed")); mode {
+		case "fixed":
+		case "adaptive":
+			start := envIntOrDefault("SKYFLOW_CONCURRENCY_START", 2)
+			for _, client := range skyflowClients {
+				client.adaptive = newAdaptiveConcurrency(start) // per entity, like the error ramp
+			}
+			log.Printf("INFO: Adaptive concurrency enabled (start=%d, ceiling=SKYFLOW_MAX_CONCURRENCY)", start)
+		default:
+			log.Printf("WARN: invalid SKYFLOW_CONCURRENCY_MODE %q, using fixed", mode)
+		}
+		if path := os.Getenv("SKYFLOW_CREDENTIALS_FILE"); path != "" {
+			account, err := loadServiceAccount(path)
+			if err != nil && keyless(configs) {
+				// No API key to fall back to: every call would fail with a 401.
+				if !envBool("SKYFLOW_SKIP_VALIDATION") {
+					log.Fatalf("ERROR: SKYFLOW_CREDENTIALS_FILE: %v and SKYFLOW_API_KEY is empty (set SKYFLOW_SKIP_VALIDATION=true to start anyway)", err)
+				}
+				log.Printf("WARN: SKYFLOW_CREDENTIALS_FILE: %v and SKYFLOW_API_KEY is empty; starting anyway (SKYFLOW_SKIP_VALIDATION)", err)
+			} else if err != nil {
+				log.Printf("ERROR: SKYFLOW_CREDENTIALS_FILE: %v; falling back to SKYFLOW_API_KEY", err)
+			} else {
+				tokens := newBearerTokens(account, &http.Client{Timeout: loadHTTPTimeout()})
+				for _, client := range skyflowClients {
+					client.bearer = tokens
+				}
+				log.Printf("INFO: Skyflow bearer tokens minted for service account %s", account.ClientID)
+			}
+		}
+		if threshold := envIntOrDefault("SKYFLOW_CB_THRESHOLD", 0); threshold > 0 {
+			cooldown := time.Duration(envIntOrDefault("SKYFLOW_CB_COOLDOWN_MS", 30000)) * time.Millisecond
+			for entity, client := range skyflowClients {
+				client.breaker = newCircuitBreaker(entity, threshold, cooldown) // per entity, like the error ramp
+			}
+			log.Printf("INFO: Skyflow circuit breaker enabled (threshold=%d, cooldown=%v)", threshold, cooldown)
+		}
+		if size := envIntOrDefault("SKYFLOW_CACHE_SIZE", 0); size > 0 {
+			ttl := time.Duration(envIntOrDefault("SKYFLOW_CACHE_TTL_MS", 0)) * time.Millisecond
+			for _, client := range skyflowClients {
+				client.cache = newValueCache(size, ttl) // per entity: tokens belong to one vault
+			}
+			log.Printf("INFO: Detokenize cache enabled (size=%d per entity, ttl=%v)", size, ttl)
+		}
+		if ms := envIntOrDefault("SKYFLOW_KEEPALIVE_INTERVAL_MS", 0); ms > 0 {
+			keepalive = startKeepalive(time.Duration(ms)*time.Millisecond, pingHosts(skyflowClients))
+			log.Printf("INFO: Skyflow keepalive ping every %dms", ms)
+		}
+		logEntitySummary(skyflowClients)
 		// Log shared settings from first config
 		for _, cfg := range configs {
-			log.Printf("INFO: Skyflow shared settings (url=%s, batch=%d, concurrency=%d)",
-				cfg.DataPlaneURL, cfg.BatchSize, cfg.MaxConcurrency)
+			log.Printf("INFO: Skyflow data plane url=%s", cfg.DataPlaneURL)
+			if len(tenantAPIKeys) > 0 {
+				log.Printf("INFO: %d tenant API keys loaded", len(tenantAPIKeys))
+				if !strings.HasPrefix(cfg.DataPlaneURL, "https://") {
+					log.Printf("WARN: tenant API keys will be sent over a non-TLS data plane URL")
+				}
+			}
 			break
 		}
 	} else {
@@ -53,15 +249,19 @@ func init() {
 }
 
 func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	receiveTs := time.Now().UnixNano()
+	// Keep the time.Time (not UnixNano) so the duration uses the monotonic
+	// clock and an NTP step mid-invocation can't skew it.
+	receiveTime := time.Now()
 	invNum := invocationCount.Add(1)
+	// Not invNum == 1: the counter restarts on reset-invocations, the
+	// container stays warm.
+	coldStart := !warmed.Swap(true)
+	inFlight := handlerInFlight.enter()
+	defer handlerInFlight.exit()
 
 	// Normalize headers to lowercase (HTTP headers are case-insensitive,
 	// but Go maps are case-sensitive. Snowflake/API Gateway may vary casing.)
-	lowerHeaders := make(map[string]string, len(req.Headers))
-	for k, v := range req.Headers {
-		lowerHeaders[strings.ToLower(k)] = v
-	}
+	lowerHeaders := snowflakeHeaders(req.Headers)
 
 	// Extract Snowflake headers (Snowflake prepends "sf-custom-" to custom headers)
 	queryID := lowerHeaders["sf-external-function-current-query-id"]
@@ -73,7 +273,12 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 	}
 	operation = strings.ToLower(operation)
 
+	// X-Entity is accepted as an alias; X-Data-Type wins if both are sent.
 	dataType := strings.ToUpper(lowerHeaders["sf-custom-x-data-type"])
+	if dataType == "" {
+		dataType = strings.ToUpper(lowerHeaders["sf-custom-x-entity"])
+	}
+	untagged := dataType == ""
 	if dataType == "" {
 		dataType = "NAME" // backward compatible
 	}
@@ -87,10 +292,87 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 	if benchConfig == "" {
 		benchConfig = "unknown"
 	}
+	debug := lowerHeaders["sf-custom-x-debug"] == "1"
+	errorChannel := lowerHeaders["sf-custom-x-error-channel"] == "1"
+	latencyMetaOn := lowerHeaders["sf-custom-x-latency-meta"] == "1"
+	var outputObject bool
+	switch output := strings.ToLower(strings.TrimSpace(lowerHeaders["sf-custom-x-output"])); output {
+	case "", "positional":
+	case "object":
+		outputObject = true
+	default:
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf(`{"error": "invalid output %q, want positional or object"}`, output),
+		}, nil
+	}
+	opts := requestOptions{Debug: debug, Trace: sampleTrace(traceSampleRate, rand.Float64)}
+	if forwardBenchConfig {
+		opts.BenchConfig = lowerHeaders["sf-benchmark-config"]
+	}
+	ctx = withRequestOptions(ctx, opts)
+
+	// Readiness checks answer before any body parsing or vault work.
+	if isHealthCheck(req, lowerHeaders) {
+		return healthResponse(ctx, req, skyflowClients)
+	}
+
+	// operation=flush ends a benchmark run: drain buffers and answer every
+	// input row (or a single row 0 when there is no body) with the summary.
+	if operation == "flush" {
+		return flushResponse(req)
+	}
+
+	// operation=reset-invocations restarts the invocation counter so the
+	// next run on this warm container numbers its invocations from 1.
+	if operation == "reset-invocations" {
+		return summaryResponse(req, resetInvocations())
+	}
+
+	// operation=loadtest runs a bounded synthetic load test against this
+	// entity's vault (or the mock) and answers like flush with the stats.
+	if operation == "loadtest" {
+		if !loadtestEnabled {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 403,
+				Body:       `{"error": "operation=loadtest is disabled, set LOADTEST_ENABLED=1"}`,
+			}, nil
+		}
+		params, err := parseLoadtestParams(lowerHeaders)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf(`{"error": %q}`, err.Error()),
+			}, nil
+		}
+		client := skyflowClients[dataType]
+		if client == nil && len(skyflowClients) > 0 {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf(`{"error": "no Skyflow client configured for data_type=%s"}`, dataType),
+			}, nil
+		}
+		return summaryResponse(req, runLoadtest(ctx, client, params))
+	}
+
+	// API Gateway base64-encodes bodies it treats as binary (depends on
+	// binaryMediaTypes / content handling config), so decode before parsing.
+	body := []byte(req.Body)
+	if req.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(req.Body)
+		if err != nil {
+			log.Printf("ERROR: failed to base64-decode request body: %v", err)
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf(`{"error": "invalid base64 request body: %v"}`, err),
+			}, nil
+		}
+		body = decoded
+	}
 
 	// Parse request
 	var sfReq sfRequest
-	if err := json.Unmarshal([]byte(req.Body), &sfReq); err != nil {
+	if err := codec.Unmarshal(body, &sfReq); err != nil {
 		log.Printf("ERROR: failed to parse request body: %v", err)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 400,
@@ -105,20 +387,104 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 	var resp sfResponse
 	var skyflowM *SkyflowMetrics
 	skyflowClient := skyflowClients[dataType]
-	if skyflowClient != nil {
+	if column := strings.TrimSpace(lowerHeaders["sf-custom-x-column"]); column != "" && skyflowClient != nil {
+		if columnAllowlist != nil && !columnAllowlist[column] {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf(`{"error": "column %q is not in SKYFLOW_COLUMN_ALLOWLIST"}`, column),
+			}, nil
+		}
+		skyflowClient = skyflowClient.withColumn(column)
+	}
+	if columns := splitColumns(lowerHeaders["sf-custom-x-columns"]); len(columns) > 0 && skyflowClient != nil {
+		for _, column := range columns {
+			if columnAllowlist != nil && !columnAllowlist[column] {
+				return events.APIGatewayProxyResponse{
+					StatusCode: 400,
+					Body:       fmt.Sprintf(`{"error": "column %q is not in SKYFLOW_COLUMN_ALLOWLIST"}`, column),
+				}, nil
+			}
+		}
+		skyflowClient = skyflowClient.withColumns(columns)
+	}
+	if redaction := strings.ToUpper(strings.TrimSpace(lowerHeaders["sf-custom-x-redaction"])); redaction != "" && skyflowClient != nil {
+		if !redactionLevels[redaction] {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf(`{"error": "invalid redaction %q, want PLAIN_TEXT, MASKED, REDACTED or DEFAULT"}`, redaction),
+			}, nil
+		}
+		skyflowClient = skyflowClient.withRedaction(redaction)
+	}
+	tenant := strings.ToUpper(strings.TrimSpace(lowerHeaders["sf-custom-x-tenant"]))
+	if tenant != "" && skyflowClient != nil {
+		key, ok := tenantAPIKeys[tenant]
+		if !ok {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 403,
+				Body:       fmt.Sprintf(`{"error": "unknown tenant %q"}`, tenant),
+			}, nil
+		}
+		skyflowClient = skyflowClient.withAPIKey(key)
+	}
+	// operation=cache-invalidate purges stale detokenize cache entries for
+	// the rows' tokens and a token glob, on this container only.
+	if operation == "cache-invalidate" {
+		pattern := strings.TrimSpace(lowerHeaders["sf-custom-x-invalidate-pattern"])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf(`{"error": "invalid invalidate pattern %q: %v"}`, pattern, err),
+			}, nil
+		}
+		return summaryResponse(req, runCacheInvalidate(skyflowClients[dataType], sfReq.Data, pattern))
+	}
+	// operation=preload warms the detokenize cache from the request's rows
+	// and answers every row with counts instead of the data.
+	if operation == "preload" {
+		preloadOp := strings.ToLower(strings.TrimSpace(lowerHeaders["sf-custom-x-preload-operation"]))
+		switch preloadOp {
+		case "":
+			preloadOp = "detokenize"
+		case "tokenize", "detokenize":
+		default:
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf(`{"error": "invalid preload operation %q, want tokenize or detokenize"}`, preloadOp),
+			}, nil
+		}
+		result, err := runPreload(ctx, skyflowClient, preloadOp, sfReq.Data)
+		if err != nil {
+			log.Printf("ERROR: preload %s (data_type=%s) failed: %v", preloadOp, dataType, err)
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       fmt.Sprintf(`{"error": "preload %s failed: %v"}`, preloadOp, err),
+			}, nil
+		}
+		return summaryResponse(req, result)
+	}
+
+	routeByHeuristic := heuristicRouter != nil && untagged && len(skyflowClients) > 0
+	if operation == "echo" {
+		// operation=echo answers every row with its own value in any mode,
+		// so the METRIC line times the Snowflake-to-Lambda path alone.
+		mode = "echo"
+		resp.Data, skyflowM = echoRows(sfReq.Data)
+	} else if skyflowClient != nil || routeByHeuristic {
 		mode = "skyflow"
 		var respData [][]interface{}
 		var skyflowErr error
-		switch operation {
-		case "tokenize":
-			respData, skyflowM, skyflowErr = skyflowClient.Tokenize(ctx, sfReq.Data)
-		case "detokenize":
-			respData, skyflowM, skyflowErr = skyflowClient.Detokenize(ctx, sfReq.Data)
-		default:
+		switch {
+		case operation != "tokenize" && operation != "detokenize":
 			return events.APIGatewayProxyResponse{
 				StatusCode: 400,
 				Body:       fmt.Sprintf(`{"error": "unknown operation: %s"}`, operation),
 			}, nil
+		case routeByHeuristic:
+			dataType = "HEURISTIC"
+			respData, skyflowM, skyflowErr = heuristicRouter.dispatch(ctx, skyflowClients, operation, sfReq.Data)
+		default:
+			respData, skyflowM, skyflowErr = runOperation(ctx, skyflowClient, operation, sfReq.Data)
 		}
 		if skyflowErr != nil {
 			log.Printf("ERROR: Skyflow %s (data_type=%s) failed: %v", operation, dataType, skyflowErr)
@@ -135,51 +501,239 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 			Body:       fmt.Sprintf(`{"error": "no Skyflow client configured for data_type=%s"}`, dataType),
 		}, nil
 	} else {
-		// Mock mode: simulated delay + DETOK_ prefix
+		// Mock mode: simulated delay + DETOK_ prefix. Rows without a value,
+		// NULLs and empty detokenize tokens are answered as in Skyflow mode.
 		if simulatedDelay > 0 {
 			time.Sleep(simulatedDelay)
 		}
-		seen := make(map[string]struct{}, batchSize)
+		seen := make(map[string]int, batchSize)
+		var mockTokens map[string]string
+		if operation == "tokenize" && mockDeterministicTokens {
+			mockTokens = make(map[string]string, batchSize)
+		}
 		resp = sfResponse{Data: make([][]interface{}, batchSize)}
+		slots, nullRows, emptyTokens := 0, 0, 0
 		for i, row := range sfReq.Data {
 			if len(row) < 2 {
-				resp.Data[i] = []interface{}{i, "DETOK_ERROR_MISSING_VALUE"}
+				resp.Data[i] = []interface{}{rowIndex(row, i), errMissingValue}
 				continue
 			}
 			rowNum := row[0]
-			tokenVal := fmt.Sprintf("%v", row[1])
-			seen[tokenVal] = struct{}{}
-			resp.Data[i] = []interface{}{rowNum, "DETOK_" + tokenVal}
+			values := make([]interface{}, len(row)-1)
+			for k := range values {
+				if row[k+1] == nil {
+					nullRows++
+					continue
+				}
+				if row[k+1] == "" && operation != "tokenize" {
+					emptyTokens++
+					values[k] = mockEmptyTokenValue
+					continue
+				}
+				slots++
+				tokenVal := argString(row[k+1])
+				seen[tokenVal]++
+				if mockTokens != nil {
+					values[k] = deterministicToken(mockTokens, dataType, tokenVal)
+				} else {
+					values[k] = "DETOK_" + tokenVal
+				}
+			}
+			if len(values) == 1 {
+				resp.Data[i] = []interface{}{rowNum, values[0]}
+			} else {
+				resp.Data[i] = []interface{}{rowNum, values}
+			}
 		}
 		uniqueTokens := len(seen)
 		dedupPct := 0.0
-		if batchSize > 0 {
-			dedupPct = (1 - float64(uniqueTokens)/float64(batchSize)) * 100
+		if slots > 0 {
+			dedupPct = (1 - float64(uniqueTokens)/float64(slots)) * 100
 		}
 		skyflowM = &SkyflowMetrics{
 			UniqueTokens: uniqueTokens,
 			DedupPct:     dedupPct,
+			NullRows:     nullRows,
+			EmptyTokens:  emptyTokens,
+		}
+		if debug {
+			skyflowM.TopDuplicates = topDuplicates(seen, debugTopN)
 		}
 	}
 
-	processingDur := time.Now().UnixNano() - receiveTs
+	processingMs := elapsedMs(receiveTime)
 
 	// Log to CloudWatch (skyflowM is always set — both Skyflow and mock modes populate it)
-	lambdaOverheadMs := processingDur/1e6 - skyflowM.SkyflowWallMs
-	log.Printf("METRIC query_id=%s batch_id=%s batch_size=%d operation=%s data_type=%s mode=%s duration_ms=%d "+
-		"unique_tokens=%d dedup_pct=%.1f skyflow_calls=%d skyflow_wall_ms=%d "+
-		"call_min_ms=%d call_avg_ms=%d call_max_ms=%d lambda_overhead_ms=%d errors=%d "+
-		"invocation=%d instance=%s config=%s",
-		queryID, batchID, batchSize, operation, dataType, mode, processingDur/1e6,
-		skyflowM.UniqueTokens, skyflowM.DedupPct, skyflowM.SkyflowCalls, skyflowM.SkyflowWallMs,
-		skyflowM.CallMinMs, skyflowM.CallAvgMs, skyflowM.CallMaxMs, lambdaOverheadMs, skyflowM.Errors,
-		invNum, lambdaInstanceID, benchConfig)
-
-	respBody, err := json.Marshal(resp)
+	inv := invocationInfo{
+		QueryID:    queryID,
+		BatchID:    batchID,
+		BatchSize:  batchSize,
+		Operation:  operation,
+		DataType:   dataType,
+		Mode:       mode,
+		ColdStart:  coldStart,
+		DurationMs: processingMs,
+		Invocation: invNum,
+		Instance:   lambdaInstanceID,
+		Config:     benchConfig,
+		Traced:     opts.Trace,
+		InFlight:   inFlight,
+	}
+	emitMetrics(metricFields(inv, skyflowM))
+
+	containerStats.observe(batchSize, skyflowM)
+	if latencyRollup.observe(coldStart, processingMs) {
+		log.Printf("ROLLUP instance=%s invocations=%d %s peak_in_flight=%d",
+			redactMetricValue("instance", lambdaInstanceID), invNum, latencyRollup.format(), handlerInFlight.takePeak())
+	}
+
+	if debug {
+		log.Printf("DEDUP query_id=%s batch_id=%s unique_tokens=%d top=%s",
+			redactMetricValue("query_id", queryID), redactMetricValue("batch_id", batchID),
+			skyflowM.UniqueTokens, formatTokenCounts(skyflowM.TopDuplicates))
+	}
+	if metricsVerbose && len(skyflowM.CallLatencies) > 0 {
+		log.Printf("LATENCIES query_id=%s batch_id=%s values=%s",
+			redactMetricValue("query_id", queryID), redactMetricValue("batch_id", batchID),
+			formatLatencies(skyflowM.CallLatencies))
+	}
+
+	respHeaders := map[string]string{"Content-Type": "application/json"}
+	if debug {
+		respHeaders["X-Effective-Config"] = effectiveConfig(inv, skyflowM, skyflowClient, tenant)
+	}
+	if errorChannel {
+		resp.Errors = separateErrors(resp.Data)
+		respHeaders["X-Error-Count"] = fmt.Sprintf("%d", len(resp.Errors))
+		if len(resp.Errors) > 0 {
+			respHeaders["X-Error-Rows"] = formatErrorRows(resp.Errors, maxErrorRowsHeader)
+		}
+	}
+	if outputObject {
+		nameOutputColumns(resp.Data, skyflowClient)
+	}
+	if latencyMetaOn {
+		attachLatencyMeta(resp.Data, newLatencyMeta(inv, skyflowM))
+	}
+
+	respBody, err := codec.Marshal(resp)
 	if err != nil {
 		return events.APIGatewayProxyResponse{StatusCode: 500, Body: `{"error":"marshal failure"}`}, nil
 	}
+	if size := proxyBodyBytes(respBody); size > maxResponseBytes {
+		log.Printf("WARN: response for query_id=%s batch_id=%s is %d bytes, over the %d byte limit (batch_size=%d)",
+			redactMetricValue("query_id", queryID), redactMetricValue("batch_id", batchID), size, maxResponseBytes, batchSize)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 429,
+			Body: fmt.Sprintf(`{"error": "response of %d bytes exceeds the %d byte limit; retry with a smaller batch (lower MAX_BATCH_ROWS on the external function)", "response_bytes": %d, "limit_bytes": %d}`,
+				size, maxResponseBytes, size, maxResponseBytes),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    respHeaders,
+		Body:       string(respBody),
+	}, nil
+}
+
+// logEntitySummary logs one line per configured entity, in name order, with
+// the settings its client actually runs with, so a multi-vault deployment can
+// be audited from the cold-start log. Vault IDs are shortened to their last
+// four characters.
+func logEntitySummary(clients map[string]*SkyflowClient) {
+	entities := make([]string, 0, len(clients))
+	for entity := range clients {
+		entities = append(entities, entity)
+	}
+	sort.Strings(entities)
+	for _, entity := range entities {
+		client := clients[entity]
+		cfg := client.cfg
+		concurrency := strconv.Itoa(cfg.MaxConcurrency)
+		if client.scheduler != nil {
+			concurrency = fmt.Sprintf("shared(%d)", client.scheduler.budget)
+		}
+		batch := strconv.Itoa(cfg.BatchSize)
+		if client.batches != nil {
+			batch += "(adaptive)"
+		}
+		log.Printf("INFO: Skyflow entity %s (vault=%s, table=%s, column=%s, batch=%s, concurrency=%s, retries=%d)",
+			entity, redactVaultID(cfg.VaultID), cfg.TableName, cfg.ColumnName, batch, concurrency, cfg.RetryMaxAttempts)
+	}
+}
+
+// redactVaultID keeps the last four characters of id.
+func redactVaultID(id string) string {
+	if len(id) <= 4 {
+		return "****"
+	}
+	return "****" + id[len(id)-4:]
+}
+
+// snowflakeHeaders returns the sf-* headers of h keyed in lower case. They
+// are the only ones handler reads, so the dozen or so API Gateway and
+// CloudFront headers on every request are skipped without being lowercased
+// or copied.
+func snowflakeHeaders(h map[string]string) map[string]string {
+	out := make(map[string]string, len(h)/2)
+	for k, v := range h {
+		if len(k) < 3 || !strings.EqualFold(k[:3], "sf-") {
+			continue
+		}
+		out[strings.ToLower(k)] = v
+	}
+	return out
+}
+
+// elapsedMs returns the milliseconds since start, never negative. time.Since
+// is monotonic for times from time.Now; the floor covers a start time that
+// lost its monotonic reading (e.g. rebuilt from a wall-clock timestamp).
+func elapsedMs(start time.Time) int64 {
+	return max(time.Since(start), 0).Milliseconds()
+}
+
+// proxyBodyBytes returns the size of body once encoding/json escapes it into
+// the string field of the Lambda proxy response, which is what counts against
+// the payload limit: quotes, backslashes and control characters grow to two
+// or six bytes, and <, >, & to six.
+func proxyBodyBytes(body []byte) int {
+	n := len(body)
+	for _, c := range body {
+		switch {
+		case c == '"' || c == '\\' || c == '\n' || c == '\r' || c == '\t':
+			n++
+		case c < 0x20 || c == '<' || c == '>' || c == '&':
+			n += 5
+		}
+	}
+	return n
+}
 
+// flushResponse answers operation=flush with the container summary.
+func flushResponse(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return summaryResponse(req, flushAndSummarize())
+}
+
+// summaryResponse answers every input row with summary, or a single row 0
+// when there is no body, so a harness can call the endpoint directly.
+func summaryResponse(req events.APIGatewayProxyRequest, summary interface{}) (events.APIGatewayProxyResponse, error) {
+	var sfReq sfRequest
+	body := []byte(req.Body)
+	if req.IsBase64Encoded {
+		body, _ = base64.StdEncoding.DecodeString(req.Body)
+	}
+	resp := sfResponse{Data: [][]interface{}{{0, summary}}}
+	if err := codec.Unmarshal(body, &sfReq); err == nil && len(sfReq.Data) > 0 {
+		resp.Data = make([][]interface{}, len(sfReq.Data))
+		for i, row := range sfReq.Data {
+			resp.Data[i] = []interface{}{rowIndex(row, i), summary}
+		}
+	}
+	respBody, err := codec.Marshal(resp)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 500, Body: `{"error":"marshal failure"}`}, nil
+	}
 	return events.APIGatewayProxyResponse{
 		StatusCode: 200,
 		Headers:    map[string]string{"Content-Type": "application/json"},
@@ -187,6 +741,194 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 	}, nil
 }
 
+// rowIndex returns a row's Snowflake index, row[0], falling back to its
+// position for an empty row, so even malformed rows are answered under the
+// index Snowflake sent.
+func rowIndex(row []interface{}, pos int) interface{} {
+	if len(row) > 0 {
+		return row[0]
+	}
+	return pos
+}
+
+// runOperation calls the client method for operation ("tokenize" or "detokenize").
+func runOperation(ctx context.Context, client *SkyflowClient, operation string, rows [][]interface{}) ([][]interface{}, *SkyflowMetrics, error) {
+	if operation == "tokenize" {
+		return client.Tokenize(ctx, rows)
+	}
+	return client.Detokenize(ctx, rows)
+}
+
+// echoRows answers each row with its arguments unchanged, in the shape a
+// tokenize or detokenize would return them.
+func echoRows(rows [][]interface{}) ([][]interface{}, *SkyflowMetrics) {
+	metrics := &SkyflowMetrics{TotalRows: len(rows)}
+	out := newRowAssembler(rows)
+	for i, row := range rows {
+		for k := 1; k < len(row); k++ {
+			if row[k] == nil {
+				metrics.NullRows++
+			}
+			out.set(i, k-1, row[k])
+		}
+	}
+	return out.rows(), metrics
+}
+
+// isErrorValue reports whether v is an in-band error sentinel.
+func isErrorValue(v interface{}) bool {
+	s, ok := v.(string)
+	return ok && strings.HasPrefix(s, "ERROR:")
+}
+
+// separateErrors moves in-band error values out of data, leaving null in their
+// place, and returns them keyed by the row's Snowflake index. Errors inside a
+// multi-argument result array are reported once per failed argument.
+func separateErrors(data [][]interface{}) []rowError {
+	var errs []rowError
+	for _, row := range data {
+		if len(row) < 2 {
+			continue
+		}
+		if values, ok := row[1].([]interface{}); ok {
+			for k, v := range values {
+				if isErrorValue(v) {
+					errs = append(errs, rowError{Row: row[0], Error: v.(string)})
+					values[k] = nil
+				}
+			}
+			continue
+		}
+		if !isErrorValue(row[1]) {
+			continue
+		}
+		errs = append(errs, rowError{Row: row[0], Error: row[1].(string)})
+		row[1] = nil
+	}
+	return errs
+}
+
+// nameOutputColumns rewrites multi-argument rows' [r1, ..., rN] results as
+// objects keyed by column name, for sf-custom-x-output: object. Arguments
+// with no configured column, a repeated column, or no client (mock mode) are
+// keyed by position as arg1..argN.
+func nameOutputColumns(data [][]interface{}, client *SkyflowClient) {
+	for _, row := range data {
+		if len(row) < 2 {
+			continue
+		}
+		values, ok := row[1].([]interface{})
+		if !ok {
+			continue
+		}
+		named := make(map[string]interface{}, len(values))
+		for k, v := range values {
+			name := ""
+			if client != nil {
+				name, _ = client.columnFor(len(values), k)
+			}
+			if _, dup := named[name]; dup || name == "" {
+				name = fmt.Sprintf("arg%d", k+1)
+			}
+			named[name] = v
+		}
+		row[1] = named
+	}
+}
+
+// splitColumns parses a comma-separated column list, dropping blanks.
+func splitColumns(s string) []string {
+	var columns []string
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+// formatErrorRows lists up to max failed row indexes, comma-separated, with a
+// trailing "..." when truncated.
+func formatErrorRows(errs []rowError, max int) string {
+	parts := make([]string, 0, len(errs))
+	for i, e := range errs {
+		if i == max {
+			parts = append(parts, "...")
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%v", e.Row))
+	}
+	return strings.Join(parts, ",")
+}
+
+// effectiveConfig summarizes, for the X-Effective-Config debug header, the
+// settings this invocation actually ran with after header overrides. Only
+// names and sizes go in; API keys never do (the tenant is named by its ID).
+func effectiveConfig(inv invocationInfo, m *SkyflowMetrics, client *SkyflowClient, tenant string) string {
+	parts := []string{
+		"operation=" + inv.Operation,
+		"entity=" + inv.DataType,
+		"mode=" + inv.Mode,
+		fmt.Sprintf("batch_size=%d", m.BatchSize),
+		fmt.Sprintf("concurrency=%d", m.Concurrency),
+	}
+	if client != nil {
+		if len(client.cfg.Columns) > 0 {
+			parts = append(parts, "columns="+strings.Join(client.cfg.Columns, "|"))
+		} else {
+			parts = append(parts, "column="+client.cfg.ColumnName)
+		}
+		if inv.Operation == "detokenize" && client.cfg.Redaction != "" {
+			parts = append(parts, "redaction="+client.cfg.Redaction)
+		}
+	}
+	if tenant != "" {
+		parts = append(parts, "tenant="+tenant)
+	}
+	return strings.Join(parts, ";")
+}
+
+// deterministicToken returns the mock token for value, assigning the next
+// sequence number the first time value is seen in assigned.
+func deterministicToken(assigned map[string]string, dataType, value string) string {
+	tok, ok := assigned[value]
+	if !ok {
+		tok = fmt.Sprintf("TOK_%s_%06d", dataType, len(assigned))
+		assigned[value] = tok
+	}
+	return tok
+}
+
+// formatTokenCounts renders token counts as "token:count,token:count".
+func formatTokenCounts(counts []tokenCount) string {
+	parts := make([]string, len(counts))
+	for i, tc := range counts {
+		parts[i] = fmt.Sprintf("%s:%d", tc.Token, tc.Count)
+	}
+	return strings.Join(parts, ",")
+}
+
+// pingHosts returns a keepalive ping that hits each distinct data plane host
+// once, whichever entity's client it goes through.
+func pingHosts(clients map[string]*SkyflowClient) func(ctx context.Context) {
+	byURL := make(map[string]*SkyflowClient)
+	for _, client := range clients {
+		byURL[client.cfg.DataPlaneURL] = client
+	}
+	return func(ctx context.Context) {
+		for _, client := range byURL {
+			client.ping(ctx)
+		}
+	}
+}
+
 func main() {
-	lambda.Start(handler)
+	lambda.StartWithOptions(handler, lambda.WithEnableSIGTERM(func() {
+		if keepalive != nil {
+			keepalive.stop()
+		}
+		if metricsFile != nil {
+			metricsFile.Close()
+		}
+	}))
 }
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// invocationInfo is the handler-side context of a METRIC record.
+type invocationInfo struct {
+	QueryID    string
+	BatchID    string
+	BatchSize  int
+	Operation  string
+	DataType   string
+	Mode       string
+	ColdStart  bool
+	DurationMs int64
+	Invocation int64
+	Instance   string
+	Config     string
+	InFlight   int64 // handler calls executing in this container when this one started, itself included
+	Traced     bool  // TRACE_SAMPLE_RATE picked this invocation; its timings include tracing overhead
+}
+
+// metricField is one named value of the per-invocation METRIC record.
+type metricField struct {
+	Key   string
+	Value interface{}
+}
+
+// metricFields lists the METRIC record in its stable column order. New fields
+// go before "invocation" so the trailing identity columns stay put.
+func metricFields(inv invocationInfo, m *SkyflowMetrics) []metricField {
+	breakerState := m.BreakerState
+	if breakerState == "" {
+		breakerState = "off" // mock mode
+	}
+	return []metricField{
+		{"query_id", inv.QueryID},
+		{"batch_id", inv.BatchID},
+		{"batch_size", inv.BatchSize},
+		{"operation", inv.Operation},
+		{"data_type", inv.DataType},
+		{"mode", inv.Mode},
+		{"duration_ms", inv.DurationMs},
+		{"unique_tokens", m.UniqueTokens},
+		{"dedup_pct", m.DedupPct},
+		{"skyflow_calls", m.SkyflowCalls},
+		{"skyflow_wall_ms", m.SkyflowWallMs},
+		{"call_min_ms", m.CallMinMs},
+		{"call_avg_ms", m.CallAvgMs},
+		{"call_max_ms", m.CallMaxMs},
+		{"lambda_overhead_ms", inv.DurationMs - m.SkyflowWallMs},
+		{"errors", m.Errors},
+		{"expired_batches", m.ExpiredBatches},
+		{"concurrency", m.Concurrency},
+		{"retries", m.Retries},
+		{"evictions", m.Evictions},
+		{"maintenance_mode_suspected", m.MaintenanceSuspected},
+		{"deleted_tokens", m.DeletedTokens},
+		{"call_p50_ms", m.CallP50Ms},
+		{"call_p95_ms", m.CallP95Ms},
+		{"rows_within_sla", m.RowsWithinSLA},
+		{"rows_over_sla", m.RowsOverSLA},
+		{"null_rows", m.NullRows},
+		{"cpu_saturated", m.CPUSaturated},
+		{"sub_batch_size", m.BatchSize},
+		{"value_conflicts", m.ValueConflicts},
+		{"traced", inv.Traced},
+		{"resolved_conflicts", m.ResolvedConflicts},
+		{"error_rate_pct", m.ErrorRatePct},
+		{"call_p99_ms", m.CallP99Ms},
+		{"empty_tokens", m.EmptyTokens},
+		{"oversized_values", m.Oversized},
+		{"cache_hits", m.CacheHits},
+		{"concurrency_efficiency", ratio(m.ConcurrencyEfficiency)},
+		{"record_errors", m.RecordErrors},
+		{"breaker_state", breakerState},
+		{"final_concurrency", m.FinalConcurrency},
+		{"call_ttfb_avg_ms", m.CallTTFBAvgMs},
+		{"call_transfer_avg_ms", m.CallTransferAvgMs},
+		{"in_flight", inv.InFlight},
+		{"cold_start", inv.ColdStart},
+		{"invocation", inv.Invocation},
+		{"instance", inv.Instance},
+		{"config", inv.Config},
+	}
+}
+
+// metricsFormat is "kv" (default: a "METRIC key=value ..." log line) or
+// "csv" (METRICS_FORMAT=csv: one CSV row per invocation on stdout, after a
+// header row written once at cold start).
+var metricsFormat = "kv"
+
+// metricsOut receives CSV rows; log lines still go through the log package.
+var metricsOut io.Writer = os.Stdout
+
+// metricsFile, when METRICS_FILE is set, also receives every record as a
+// JSON line.
+var metricsFile *metricsFileSink
+
+// metricRedact lists METRIC fields (METRIC_REDACT_FIELDS) whose values are
+// replaced before any output: by a short SHA-256 prefix when
+// metricRedactMode is "hash" (the default, so records can still be grouped
+// by the field), or by metricRedactPlaceholder when it is "placeholder".
+var (
+	metricRedact     map[string]bool
+	metricRedactMode = "hash"
+)
+
+const metricRedactPlaceholder = "REDACTED"
+
+// metricsVerbose (METRICS_VERBOSE) adds a LATENCIES line per invocation
+// listing every Skyflow call's latency, for percentiles computed offline.
+var metricsVerbose bool
+
+// metricSinksEnabled are the sinks named in METRIC_SINKS (default "log,file";
+// "file" writes only when METRICS_FILE is set too). metricSinkTimeout bounds
+// how long an invocation waits for them (METRIC_SINK_TIMEOUT_MS).
+var (
+	metricSinksEnabled = map[string]bool{"log": true, "file": true}
+	metricSinkTimeout  = 200 * time.Millisecond
+)
+
+// metricSink receives every METRIC record, already redacted. Sinks run
+// concurrently, so write must not modify fields, and a late write may overlap
+// the next invocation's, so write must be safe for concurrent use.
+type metricSink interface {
+	name() string
+	write(fields []metricField) error
+}
+
+// activeMetricSinks returns the enabled sinks that are ready to write. A new
+// sink needs a name in loadMetricSinks and a line here.
+func activeMetricSinks() []metricSink {
+	var sinks []metricSink
+	if metricSinksEnabled["log"] {
+		sinks = append(sinks, logSink{})
+	}
+	if metricSinksEnabled["file"] && metricsFile != nil {
+		sinks = append(sinks, metricsFile)
+	}
+	return sinks
+}
+
+// loadMetricSinks parses METRIC_SINKS, skipping unknown names with a warning.
+func loadMetricSinks() map[string]bool {
+	v := os.Getenv("METRIC_SINKS")
+	if v == "" {
+		return map[string]bool{"log": true, "file": true}
+	}
+	enabled := make(map[string]bool)
+	for _, name := range splitColumns(strings.ToLower(v)) {
+		if name != "log" && name != "file" {
+			log.Printf("WARN: unknown METRIC_SINKS entry %q ignored", name)
+			continue
+		}
+		enabled[name] = true
+	}
+	return enabled
+}
+
+func initMetricsOutput() {
+	metricsVerbose = envBool("METRICS_VERBOSE")
+	metricSinksEnabled = loadMetricSinks()
+	metricSinkTimeout = time.Duration(envIntOrDefault("METRIC_SINK_TIMEOUT_MS", 200)) * time.Millisecond
+	if v := os.Getenv("METRIC_REDACT_FIELDS"); v != "" {
+		metricRedact = make(map[string]bool)
+		for _, key := range splitColumns(v) {
+			metricRedact[key] = true
+		}
+		if strings.EqualFold(os.Getenv("METRIC_REDACT_MODE"), "placeholder") {
+			metricRedactMode = "placeholder"
+		}
+	}
+	if strings.EqualFold(os.Getenv("METRICS_FORMAT"), "csv") {
+		metricsFormat = "csv"
+		if metricSinksEnabled["log"] {
+			fmt.Fprintln(metricsOut, formatMetricCSVHeader())
+		}
+	}
+	if path := os.Getenv("METRICS_FILE"); path != "" {
+		sink, err := openMetricsFile(path)
+		if err != nil {
+			log.Printf("WARN: METRICS_FILE disabled: %v", err)
+			return
+		}
+		metricsFile = sink
+		log.Printf("INFO: Appending metrics to %s", path)
+	}
+}
+
+// emitMetrics writes one invocation's METRIC record to every active sink.
+func emitMetrics(fields []metricField) {
+	writeMetricSinks(activeMetricSinks(), redactMetricFields(fields), metricSinkTimeout)
+}
+
+// writeMetricSinks writes fields to all sinks concurrently and waits at most
+// timeout for them, so the response waits for the slowest sink, bounded,
+// rather than for the sum of their I/O. A sink still writing at the deadline
+// is best-effort: its name is logged and returned, and its goroutine is left
+// running. Lambda freezes the container once the handler returns, so that
+// write resumes with the next invocation, or is lost if the container is
+// reclaimed first.
+func writeMetricSinks(sinks []metricSink, fields []metricField, timeout time.Duration) (late []string) {
+	done := make(chan int, len(sinks))
+	for i, sink := range sinks {
+		go func(i int, sink metricSink) {
+			if err := sink.write(fields); err != nil {
+				log.Printf("WARN: write %s metrics: %v", sink.name(), err)
+			}
+			done <- i
+		}(i, sink)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	finished := make([]bool, len(sinks))
+	for range sinks {
+		select {
+		case i := <-done:
+			finished[i] = true
+			continue
+		case <-timer.C:
+		}
+		for i, sink := range sinks {
+			if !finished[i] {
+				late = append(late, sink.name())
+			}
+		}
+		log.Printf("WARN: metric sinks %s still writing after %v; their records may be lost", strings.Join(late, ","), timeout)
+		return late
+	}
+	return nil
+}
+
+// logSink is the METRIC log line, or with METRICS_FORMAT=csv the CSV row on
+// metricsOut.
+type logSink struct{}
+
+func (logSink) name() string { return "log" }
+
+func (logSink) write(fields []metricField) error {
+	if metricsFormat == "csv" {
+		_, err := fmt.Fprintln(metricsOut, formatMetricCSV(fields))
+		return err
+	}
+	log.Printf("METRIC %s", formatMetricKV(fields))
+	return nil
+}
+
+// redactMetricFields returns fields with the METRIC_REDACT_FIELDS values
+// replaced. fields itself is left untouched.
+func redactMetricFields(fields []metricField) []metricField {
+	if len(metricRedact) == 0 {
+		return fields
+	}
+	out := make([]metricField, len(fields))
+	for i, f := range fields {
+		if metricRedact[f.Key] {
+			f.Value = redactMetricValue(f.Key, formatMetricValue(f.Value))
+		}
+		out[i] = f
+	}
+	return out
+}
+
+// redactMetricValue applies the configured redaction to value if key is
+// listed in METRIC_REDACT_FIELDS, for log lines outside the METRIC record.
+func redactMetricValue(key, value string) string {
+	if !metricRedact[key] {
+		return value
+	}
+	if metricRedactMode == "placeholder" {
+		return metricRedactPlaceholder
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:6])
+}
+
+// ratio is a metric value in [0, 1], printed with two decimals where
+// percentages get one.
+type ratio float64
+
+func formatMetricValue(v interface{}) string {
+	switch f := v.(type) {
+	case float64:
+		return strconv.FormatFloat(f, 'f', 1, 64)
+	case ratio:
+		return strconv.FormatFloat(float64(f), 'f', 2, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// formatLatencies renders latencies as a comma-separated list of ms.
+func formatLatencies(latencies []int64) string {
+	b := make([]byte, 0, 4*len(latencies))
+	for i, l := range latencies {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendInt(b, l, 10)
+	}
+	return string(b)
+}
+
+func formatMetricKV(fields []metricField) string {
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = f.Key + "=" + formatMetricValue(f.Value)
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatMetricCSVHeader() string {
+	fields := metricFields(invocationInfo{}, &SkyflowMetrics{})
+	keys := make([]string, len(fields))
+	for i, f := range fields {
+		keys[i] = f.Key
+	}
+	return csvLine(keys)
+}
+
+func formatMetricCSV(fields []metricField) string {
+	values := make([]string, len(fields))
+	for i, f := range fields {
+		values[i] = formatMetricValue(f.Value)
+	}
+	return csvLine(values)
+}
+
+// csvLine encodes one CSV record (quoting as needed) without the newline.
+func csvLine(record []string) string {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(record)
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// metricsFileSink appends METRIC records as JSON lines to a local file, for
+// offline analysis of local load tests. On Lambda the filesystem is read-only
+// outside /tmp, so METRICS_FILE must point there if it is set at all.
+type metricsFileSink struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func (s *metricsFileSink) name() string { return "file" }
+
+func openMetricsFile(path string) (*metricsFileSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsFileSink{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// write appends one record and flushes it, so a frozen or killed process
+// loses at most the line being written.
+func (s *metricsFileSink) write(fields []metricField) error {
+	line, err := metricJSON(fields)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(line)
+	s.w.WriteByte('\n')
+	return s.w.Flush()
+}
+
+// Sync flushes buffered output and commits the file to stable storage.
+func (s *metricsFileSink) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *metricsFileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// metricJSON encodes fields as a JSON object, keeping the column order.
+func metricJSON(fields []metricField) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := codec.Marshal(f.Key)
+		if err != nil {
+			return nil, err
+		}
+		val, err := codec.Marshal(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// latencyMeta is the per-invocation latency breakdown attached to every row
+// when the caller sends sf-custom-x-latency-meta: 1, for analysis in SQL.
+type latencyMeta struct {
+	BatchID          string `json:"batch_id"`
+	DurationMs       int64  `json:"duration_ms"`
+	SkyflowCalls     int    `json:"skyflow_calls"`
+	SkyflowWallMs    int64  `json:"skyflow_wall_ms"`
+	CallMinMs        int64  `json:"call_min_ms"`
+	CallP50Ms        int64  `json:"call_p50_ms"`
+	CallP95Ms        int64  `json:"call_p95_ms"`
+	CallP99Ms        int64  `json:"call_p99_ms"`
+	CallMaxMs        int64  `json:"call_max_ms"`
+	LambdaOverheadMs int64  `json:"lambda_overhead_ms"`
+}
+
+func newLatencyMeta(inv invocationInfo, m *SkyflowMetrics) latencyMeta {
+	return latencyMeta{
+		BatchID:          redactMetricValue("batch_id", inv.BatchID),
+		DurationMs:       inv.DurationMs,
+		SkyflowCalls:     m.SkyflowCalls,
+		SkyflowWallMs:    m.SkyflowWallMs,
+		CallMinMs:        m.CallMinMs,
+		CallP50Ms:        m.CallP50Ms,
+		CallP95Ms:        m.CallP95Ms,
+		CallP99Ms:        m.CallP99Ms,
+		CallMaxMs:        m.CallMaxMs,
+		LambdaOverheadMs: inv.DurationMs - m.SkyflowWallMs,
+	}
+}
+
+// attachLatencyMeta replaces each row's value with {"value": v, "latency": meta}.
+func attachLatencyMeta(data [][]interface{}, meta latencyMeta) {
+	for _, row := range data {
+		if len(row) < 2 {
+			continue
+		}
+		row[1] = map[string]interface{}{"value": row[1], "latency": meta}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsCSVHeaderAndRowAlign(t *testing.T) {
+	var out bytes.Buffer
+	prevFormat, prevOut := metricsFormat, metricsOut
+	metricsOut = &out
+	t.Setenv("METRICS_FORMAT", "csv")
+	initMetricsOutput()
+	t.Cleanup(func() { metricsFormat, metricsOut = prevFormat, prevOut })
+
+	inv := invocationInfo{
+		QueryID: "q1", BatchID: "b1", BatchSize: 3, Operation: "detokenize", DataType: "NAME",
+		Mode: "skyflow", DurationMs: 42, Invocation: 7, Instance: "i1", Config: "XL,with comma",
+	}
+	m := &SkyflowMetrics{UniqueTokens: 2, DedupPct: 33.333, SkyflowCalls: 1, SkyflowWallMs: 30}
+	emitMetrics(metricFields(inv, m))
+
+	records, err := csv.NewReader(strings.NewReader(out.String())).ReadAll()
+	if err != nil {
+		t.Fatalf("output is not valid CSV: %v\n%s", err, out.String())
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected header + 1 row, got %d lines", len(records))
+	}
+	header, row := records[0], records[1]
+	if len(header) != len(row) {
+		t.Fatalf("header has %d columns, row has %d", len(header), len(row))
+	}
+
+	got := make(map[string]string, len(header))
+	for i, key := range header {
+		got[key] = row[i]
+	}
+	want := map[string]string{
+		"query_id":           "q1",
+		"batch_size":         "3",
+		"dedup_pct":          "33.3",
+		"lambda_overhead_ms": "12",
+		"invocation":         "7",
+		"config":             "XL,with comma",
+	}
+	for key, w := range want {
+		if got[key] != w {
+			t.Errorf("%s = %q, want %q", key, got[key], w)
+		}
+	}
+	if header[0] != "query_id" || header[len(header)-1] != "config" {
+		t.Errorf("unexpected column order: %v", header)
+	}
+}
+
+func TestMetricsKVFormat(t *testing.T) {
+	fields := []metricField{{"query_id", "q1"}, {"dedup_pct", 12.34}, {"errors", 0}}
+	if got := formatMetricKV(fields); got != "query_id=q1 dedup_pct=12.3 errors=0" {
+		t.Errorf("formatMetricKV = %q", got)
+	}
+}
+
+func TestMetricsKVFormatRatio(t *testing.T) {
+	fields := []metricField{{"concurrency_efficiency", ratio(0.876)}}
+	if got := formatMetricKV(fields); got != "concurrency_efficiency=0.88" {
+		t.Errorf("formatMetricKV = %q", got)
+	}
+}
+
+func TestMetricsRedaction(t *testing.T) {
+	prevFields, prevMode := metricRedact, metricRedactMode
+	t.Cleanup(func() { metricRedact, metricRedactMode = prevFields, prevMode })
+	metricRedact = map[string]bool{"query_id": true, "instance": true}
+
+	fields := []metricField{{"query_id", "01b2-q1"}, {"errors", 0}, {"instance", "abc123"}}
+	metricRedactMode = "hash"
+	got := redactMetricFields(fields)
+	if got[0].Value != redactMetricValue("query_id", "01b2-q1") || got[0].Value == "01b2-q1" {
+		t.Errorf("query_id = %v, want a stable hash", got[0].Value)
+	}
+	if v, _ := got[0].Value.(string); len(v) != 12 {
+		t.Errorf("hash %q, want 12 hex chars", v)
+	}
+	if got[1].Value != 0 {
+		t.Errorf("unlisted field changed: %v", got[1])
+	}
+	if fields[0].Value != "01b2-q1" {
+		t.Errorf("input fields modified")
+	}
+
+	metricRedactMode = "placeholder"
+	got = redactMetricFields(fields)
+	if kv := formatMetricKV(got); kv != "query_id=REDACTED errors=0 instance=REDACTED" {
+		t.Errorf("formatMetricKV = %q", kv)
+	}
+	if csv := formatMetricCSV(got); csv != "REDACTED,0,REDACTED" {
+		t.Errorf("formatMetricCSV = %q", csv)
+	}
+}
+
+func TestMetricsFileAppendsJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.jsonl")
+	sink, err := openMetricsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		inv := invocationInfo{QueryID: "q1", BatchSize: 10 * (i + 1), Invocation: int64(i + 1)}
+		if err := sink.write(metricFields(inv, &SkyflowMetrics{DedupPct: 12.5})); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening appends rather than truncating.
+	sink, _ = openMetricsFile(path)
+	sink.write(metricFields(invocationInfo{Invocation: 4}, &SkyflowMetrics{}))
+	sink.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("line %q is not JSON: %v", scanner.Text(), err)
+		}
+		lines = append(lines, rec)
+	}
+	if len(lines) != 4 {
+		t.Fatalf("read %d lines, want 4", len(lines))
+	}
+	if lines[1]["batch_size"] != float64(20) || lines[1]["dedup_pct"] != 12.5 || lines[3]["invocation"] != float64(4) {
+		t.Errorf("unexpected records: %v", lines)
+	}
+	if !strings.HasPrefix(string(mustReadFile(t, path)), `{"query_id":"q1","batch_id":""`) {
+		t.Errorf("column order not preserved")
+	}
+}
+
+// stubSink records what it was given, after an optional hold.
+type stubSink struct {
+	id   string
+	hold chan struct{} // nil writes at once
+	err  error
+	got  chan []metricField
+}
+
+func newStubSink(id string) *stubSink { return &stubSink{id: id, got: make(chan []metricField, 1)} }
+
+func (s *stubSink) name() string { return s.id }
+
+func (s *stubSink) write(fields []metricField) error {
+	if s.hold != nil {
+		<-s.hold
+	}
+	s.got <- fields
+	return s.err
+}
+
+func TestWriteMetricSinksConcurrently(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	fast, failing, slow := newStubSink("fast"), newStubSink("failing"), newStubSink("slow")
+	failing.err = errors.New("disk full")
+	slow.hold = make(chan struct{})
+	defer close(slow.hold)
+	fields := []metricField{{"query_id", "q1"}}
+
+	start := time.Now()
+	late := writeMetricSinks([]metricSink{fast, slow, failing}, fields, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %v for a blocked sink, want about the 50ms timeout", elapsed)
+	}
+	if !reflect.DeepEqual(late, []string{"slow"}) {
+		t.Errorf("late sinks = %v, want [slow]", late)
+	}
+	for _, sink := range []*stubSink{fast, failing} {
+		select {
+		case got := <-sink.got:
+			if !reflect.DeepEqual(got, fields) {
+				t.Errorf("%s got %v, want %v", sink.id, got, fields)
+			}
+		default:
+			t.Errorf("%s was not written before the timeout", sink.id)
+		}
+	}
+	for _, want := range []string{"write failing metrics: disk full", "metric sinks slow still writing after 50ms"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log missing %q:\n%s", want, buf.String())
+		}
+	}
+
+	// Sinks overlap: three sinks taking 30ms each finish well before 90ms.
+	var held []metricSink
+	for _, id := range []string{"a", "b", "c"} {
+		sink := newStubSink(id)
+		sink.hold = make(chan struct{})
+		time.AfterFunc(30*time.Millisecond, func() { close(sink.hold) })
+		held = append(held, sink)
+	}
+	start = time.Now()
+	if late := writeMetricSinks(held, fields, time.Second); late != nil || time.Since(start) >= 90*time.Millisecond {
+		t.Errorf("late = %v after %v, want none well under 90ms", late, time.Since(start))
+	}
+}
+
+func TestLoadMetricSinks(t *testing.T) {
+	t.Setenv("METRIC_SINKS", "File, prometheus")
+	if got := loadMetricSinks(); !reflect.DeepEqual(got, map[string]bool{"file": true}) {
+		t.Errorf("loadMetricSinks = %v, want only file", got)
+	}
+
+	prev, prevFile := metricSinksEnabled, metricsFile
+	t.Cleanup(func() { metricSinksEnabled, metricsFile = prev, prevFile })
+	metricsFile = nil
+	metricSinksEnabled = map[string]bool{"log": true, "file": true}
+	if sinks := activeMetricSinks(); len(sinks) != 1 || sinks[0].name() != "log" {
+		t.Errorf("active sinks without METRICS_FILE = %v, want only log", sinks)
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
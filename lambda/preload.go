@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// preloadResult is the JSON summary returned for operation=preload.
+type preloadResult struct {
+	Operation     string `json:"operation"`
+	Cache         string `json:"cache"` // "on", or "off" when there was nothing to warm
+	Rows          int    `json:"rows"`
+	Loaded        int    `json:"loaded"`         // tokens newly cached by this call
+	AlreadyCached int    `json:"already_cached"` // tokens that were cached before it
+	Errors        int    `json:"errors"`         // values Skyflow failed; they are not cached
+	CacheEntries  int    `json:"cache_entries"`  // entity cache size afterwards
+}
+
+// runPreload warms client's detokenize cache with rows so later timed runs
+// hit it deterministically. Detokenize rows are tokens, fetched through the
+// normal (caching) path. Tokenize rows are plaintext values: they are
+// inserted and each new token is cached with the value it was minted from,
+// which is only the detokenized value at PLAIN_TEXT redaction, so other
+// levels insert without caching. Without a cache (SKYFLOW_CACHE_SIZE unset,
+// mock mode, or a tenant request) it does nothing.
+func runPreload(ctx context.Context, client *SkyflowClient, operation string, rows [][]interface{}) (preloadResult, error) {
+	res := preloadResult{Operation: operation, Cache: "off", Rows: len(rows)}
+	if client == nil || client.cache == nil {
+		log.Printf("INFO: PRELOAD skipped: detokenize cache is off")
+		return res, nil
+	}
+	res.Cache = "on"
+
+	var out [][]interface{}
+	var err error
+	cached := make(map[string]bool) // tokens from this set found in or added to the cache
+	if operation == "tokenize" {
+		out, _, err = client.Tokenize(ctx, rows)
+		if err != nil {
+			return res, err
+		}
+		cacheable := client.cfg.Redaction == "PLAIN_TEXT"
+		for i, row := range out {
+			if len(rows[i]) < 2 {
+				res.Errors++ // no value to preload
+				continue
+			}
+			for k, token := range rowResults(row) {
+				switch tok, _ := token.(string); {
+				case isErrorValue(token):
+					res.Errors++
+				case tok == "" || cached[tok]:
+				case client.cache.has(client.cacheKey(tok)):
+					cached[tok] = true
+					res.AlreadyCached++
+				default:
+					// Only string arguments: a number may come back from the
+					// vault as a JSON number, not the text that was sent.
+					if value, ok := rows[i][k+1].(string); ok && cacheable {
+						client.cacheValue(tok, value)
+						cached[tok] = true
+						res.Loaded++
+					}
+				}
+			}
+		}
+	} else {
+		var m *SkyflowMetrics
+		out, m, err = client.Detokenize(ctx, rows)
+		if err != nil {
+			return res, err
+		}
+		res.AlreadyCached = m.CacheHits
+		for i, row := range out {
+			if len(rows[i]) < 2 {
+				res.Errors++ // no value to preload
+				continue
+			}
+			for k, value := range rowResults(row) {
+				tok, _ := rows[i][k+1].(string)
+				switch {
+				case isErrorValue(value):
+					res.Errors++
+				case tok == "" || cached[tok]:
+				case client.cache.has(client.cacheKey(tok)):
+					cached[tok] = true
+				}
+			}
+		}
+		res.Loaded = max(len(cached)-res.AlreadyCached, 0)
+	}
+	res.CacheEntries = client.cache.len()
+	log.Printf("PRELOAD operation=%s data_type=%s rows=%d loaded=%d already_cached=%d errors=%d cache_entries=%d",
+		operation, client.cfg.Entity, res.Rows, res.Loaded, res.AlreadyCached, res.Errors, res.CacheEntries)
+	return res, nil
+}
+
+// rowResults returns the per-argument results of an output row: the value of
+// a single-argument row or the array of a multi-argument one.
+func rowResults(row []interface{}) []interface{} {
+	if len(row) < 2 {
+		return nil
+	}
+	if values, ok := row[1].([]interface{}); ok {
+		return values
+	}
+	return row[1:2]
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestPreloadPopulatesCache(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.Redaction = "PLAIN_TEXT"
+	client.cache = newValueCache(100, 0)
+	tokens := [][]interface{}{{0, "tok_a"}, {1, "tok_b"}, {2, "tok_a"}, {3}, {4, "tok_c"}}
+
+	res, err := runPreload(context.Background(), client, "detokenize", tokens)
+	if err != nil {
+		t.Fatalf("runPreload failed: %v", err)
+	}
+	want := preloadResult{Operation: "detokenize", Cache: "on", Rows: 5, Loaded: 3, Errors: 1, CacheEntries: 3}
+	if res != want {
+		t.Errorf("detokenize preload = %+v, want %+v", res, want)
+	}
+
+	// The timed run is answered from the cache alone.
+	calls.Store(0)
+	got, m, _ := client.Detokenize(context.Background(), tokens)
+	if calls.Load() != 0 || m.CacheHits != 3 || got[4][1] != "c" {
+		t.Errorf("after preload: %d vault calls, %d cache hits, got %v; want 0, 3", calls.Load(), m.CacheHits, got)
+	}
+	if res, _ = runPreload(context.Background(), client, "detokenize", tokens); res.Loaded != 0 || res.AlreadyCached != 3 {
+		t.Errorf("second preload loaded=%d already_cached=%d, want 0 and 3", res.Loaded, res.AlreadyCached)
+	}
+
+	// Tokenize preload caches each new token with its plaintext value.
+	res, err = runPreload(context.Background(), client, "tokenize", [][]interface{}{{0, "d"}, {1, "e"}, {2, "d"}, {3, 7.5}})
+	if err != nil || res.Loaded != 2 || res.CacheEntries != 5 {
+		t.Errorf("tokenize preload = %+v (%v), want 2 loaded (the number is not cached), 5 entries", res, err)
+	}
+	calls.Store(0)
+	if got, _, _ := client.Detokenize(context.Background(), [][]interface{}{{0, "tok_d"}, {1, "tok_e"}}); calls.Load() != 0 || got[0][1] != "d" || got[1][1] != "e" {
+		t.Errorf("detokenize of preloaded tokens = %v with %d vault calls, want d, e from the cache", got, calls.Load())
+	}
+
+	// Without a cache there is nothing to warm, so Skyflow isn't called.
+	calls.Store(0)
+	res, _ = runPreload(context.Background(), newTestClient(srv), "detokenize", tokens)
+	if res.Cache != "off" || res.Loaded != 0 || calls.Load() != 0 {
+		t.Errorf("cache off: %+v with %d vault calls, want a no-op", res, calls.Load())
+	}
+}
+
+func TestHandlerPreload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(fakeVault))
+	defer srv.Close()
+	client := newTestClient(srv)
+	client.cache = newValueCache(100, 0)
+	useSkyflowClients(t, map[string]*SkyflowClient{"NAME": client})
+
+	req := events.APIGatewayProxyRequest{
+		Headers: map[string]string{"sf-custom-x-operation": "preload"},
+		Body:    `{"data": [[0, "tok_a"], [1, "tok_b"]]}`,
+	}
+	resp, _ := handler(context.Background(), req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("preload status = %d, body = %s", resp.StatusCode, resp.Body)
+	}
+	var out struct {
+		Data [][]json.RawMessage `json:"data"`
+	}
+	var res preloadResult
+	if err := json.Unmarshal([]byte(resp.Body), &out); err != nil || len(out.Data) != 2 {
+		t.Fatalf("preload body = %s (%v), want a summary per row", resp.Body, err)
+	}
+	if err := json.Unmarshal(out.Data[1][1], &res); err != nil || res.Loaded != 2 {
+		t.Errorf("preload summary = %s, want 2 loaded", out.Data[1][1])
+	}
+
+	req.Headers["sf-custom-x-preload-operation"] = "delete"
+	if resp, _ = handler(context.Background(), req); resp.StatusCode != 400 {
+		t.Errorf("invalid preload operation status = %d, want 400", resp.StatusCode)
+	}
+}
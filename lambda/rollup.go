@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// histogramBoundsMs are the upper bounds of the latency histogram buckets;
+// a final overflow bucket catches anything slower.
+var histogramBoundsMs = []int64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// latencyAccumulator is a running count/sum/min/max plus histogram.
+type latencyAccumulator struct {
+	count   int64
+	sumMs   int64
+	minMs   int64
+	maxMs   int64
+	buckets []int64
+}
+
+func (a *latencyAccumulator) add(ms int64) {
+	if a.buckets == nil {
+		a.buckets = make([]int64, len(histogramBoundsMs)+1)
+	}
+	if a.count == 0 || ms < a.minMs {
+		a.minMs = ms
+	}
+	if ms > a.maxMs {
+		a.maxMs = ms
+	}
+	a.count++
+	a.sumMs += ms
+	i := 0
+	for i < len(histogramBoundsMs) && ms > histogramBoundsMs[i] {
+		i++
+	}
+	a.buckets[i]++
+}
+
+func (a *latencyAccumulator) avgMs() int64 {
+	if a.count == 0 {
+		return 0
+	}
+	return a.sumMs / a.count
+}
+
+// histogram renders non-empty buckets as "le10:3,le25:1,gt5000:1".
+func (a *latencyAccumulator) histogram() string {
+	var parts []string
+	for i, n := range a.buckets {
+		if n == 0 {
+			continue
+		}
+		label := "gt" + fmt.Sprint(histogramBoundsMs[len(histogramBoundsMs)-1])
+		if i < len(histogramBoundsMs) {
+			label = "le" + fmt.Sprint(histogramBoundsMs[i])
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d", label, n))
+	}
+	return strings.Join(parts, ",")
+}
+
+// coldWarmRollup keeps separate latency accumulators for the container's cold
+// invocation (its first) and its warm ones, answering "what's my cold-start
+// penalty" without log post-processing. State lives for the container's
+// lifetime, so it resets on every cold start.
+type coldWarmRollup struct {
+	mu    sync.Mutex
+	every int64 // emit a ROLLUP line every N invocations
+	seen  int64
+	cold  latencyAccumulator
+	warm  latencyAccumulator
+}
+
+// observe records one invocation and reports whether a rollup is due.
+func (r *coldWarmRollup) observe(cold bool, durationMs int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cold {
+		r.cold.add(durationMs)
+	} else {
+		r.warm.add(durationMs)
+	}
+	r.seen++
+	return r.every > 0 && r.seen%r.every == 0
+}
+
+// format renders the rollup as key=value pairs for a ROLLUP log line.
+func (r *coldWarmRollup) format() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	penalty := int64(0)
+	if r.cold.count > 0 && r.warm.count > 0 {
+		penalty = r.cold.avgMs() - r.warm.avgMs()
+	}
+	return fmt.Sprintf("cold_count=%d cold_avg_ms=%d cold_max_ms=%d cold_hist=%s "+
+		"warm_count=%d warm_avg_ms=%d warm_min_ms=%d warm_max_ms=%d warm_hist=%s cold_penalty_ms=%d",
+		r.cold.count, r.cold.avgMs(), r.cold.maxMs, r.cold.histogram(),
+		r.warm.count, r.warm.avgMs(), r.warm.minMs, r.warm.maxMs, r.warm.histogram(), penalty)
+}
+
+// latencySummary is one accumulator's stats in JSON form.
+type latencySummary struct {
+	Count     int64  `json:"count"`
+	AvgMs     int64  `json:"avg_ms"`
+	MinMs     int64  `json:"min_ms"`
+	MaxMs     int64  `json:"max_ms"`
+	Histogram string `json:"hist"`
+}
+
+// rollupSummary is the JSON form of a coldWarmRollup for the flush summary.
+type rollupSummary struct {
+	Cold          latencySummary `json:"cold"`
+	Warm          latencySummary `json:"warm"`
+	ColdPenaltyMs int64          `json:"cold_penalty_ms"`
+}
+
+func (a *latencyAccumulator) summary() latencySummary {
+	return latencySummary{Count: a.count, AvgMs: a.avgMs(), MinMs: a.minMs, MaxMs: a.maxMs, Histogram: a.histogram()}
+}
+
+func (r *coldWarmRollup) summary() rollupSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := rollupSummary{Cold: r.cold.summary(), Warm: r.warm.summary()}
+	if r.cold.count > 0 && r.warm.count > 0 {
+		s.ColdPenaltyMs = r.cold.avgMs() - r.warm.avgMs()
+	}
+	return s
+}
+
+// inFlightGauge counts handler calls executing at once in this container and
+// the peak since the last ROLLUP line. A single Lambda container serves one
+// invocation at a time, so a peak above 1 means a local harness or a
+// multi-concurrency runtime is stacking work on one process, which is then
+// the bottleneck rather than Skyflow.
+type inFlightGauge struct {
+	current atomic.Int64
+	peak    atomic.Int64
+
+	// warnAt (INFLIGHT_WARN_THRESHOLD) logs an INFLIGHT WARN line whenever a
+	// call starts with more than this many in flight; 0 disables. A
+	// CloudWatch metric filter on that line can drive an alarm.
+	warnAt int64
+}
+
+// enter records a call starting and returns how many are now in flight.
+func (g *inFlightGauge) enter() int64 {
+	n := g.current.Add(1)
+	for {
+		p := g.peak.Load()
+		if n <= p || g.peak.CompareAndSwap(p, n) {
+			break
+		}
+	}
+	if g.warnAt > 0 && n > g.warnAt {
+		log.Printf("WARN: INFLIGHT in_flight=%d threshold=%d", n, g.warnAt)
+	}
+	return n
+}
+
+func (g *inFlightGauge) exit() {
+	g.current.Add(-1)
+}
+
+// takePeak returns the peak since the last call and starts a new window at
+// the current level.
+func (g *inFlightGauge) takePeak() int64 {
+	return g.peak.Swap(g.current.Load())
+}
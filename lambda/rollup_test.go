@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestColdWarmRollupSplit(t *testing.T) {
+	r := coldWarmRollup{every: 4}
+	due := []bool{
+		r.observe(true, 900), // cold start
+		r.observe(false, 20),
+		r.observe(false, 40),
+		r.observe(false, 60),
+	}
+	if due[0] || due[1] || due[2] || !due[3] {
+		t.Errorf("rollup due = %v, want only the 4th", due)
+	}
+
+	if r.cold.count != 1 || r.cold.avgMs() != 900 {
+		t.Errorf("cold: count=%d avg=%d, want 1/900", r.cold.count, r.cold.avgMs())
+	}
+	if r.warm.count != 3 || r.warm.avgMs() != 40 || r.warm.minMs != 20 || r.warm.maxMs != 60 {
+		t.Errorf("warm: count=%d avg=%d min=%d max=%d", r.warm.count, r.warm.avgMs(), r.warm.minMs, r.warm.maxMs)
+	}
+
+	out := r.format()
+	for _, want := range []string{
+		"cold_count=1 cold_avg_ms=900", "cold_hist=le1000:1",
+		"warm_count=3 warm_avg_ms=40", "warm_hist=le25:1,le50:1,le100:1", "cold_penalty_ms=860",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("format() = %q, missing %q", out, want)
+		}
+	}
+}
+
+func TestLatencyHistogramOverflow(t *testing.T) {
+	var a latencyAccumulator
+	a.add(5)
+	a.add(10)
+	a.add(60000)
+	if got := a.histogram(); got != "le10:2,gt5000:1" {
+		t.Errorf("histogram = %q", got)
+	}
+}
+
+func TestInFlightPeakUnderConcurrentHandlers(t *testing.T) {
+	prevDelay := simulatedDelay
+	simulatedDelay = 50 * time.Millisecond
+	t.Cleanup(func() { simulatedDelay = prevDelay })
+	handlerInFlight.takePeak() // start a fresh window
+
+	const n = 5
+	var started, wg sync.WaitGroup
+	started.Add(n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			started.Wait()
+			handler(context.Background(), events.APIGatewayProxyRequest{Body: `{"data":[[0,"x"]]}`})
+		}()
+	}
+	wg.Wait()
+
+	if peak := handlerInFlight.takePeak(); peak != n {
+		t.Errorf("peak in flight = %d, want %d", peak, n)
+	}
+	if handlerInFlight.current.Load() != 0 {
+		t.Errorf("in flight after all calls returned = %d, want 0", handlerInFlight.current.Load())
+	}
+	if peak := handlerInFlight.takePeak(); peak != 0 {
+		t.Errorf("peak of an idle window = %d, want 0", peak)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// tokenRouter infers the target entity of each row from its token (or, for
+// tokenize, its value) when the caller doesn't send X-Data-Type. This is a
+// best-effort convenience for mixed batches: rules are checked in order and
+// the first match wins, so overlapping rules must be ordered by specificity.
+type tokenRouter struct {
+	rules         []routingRule
+	defaultEntity string // used when no rule matches; "" = per-row error
+}
+
+// routingRule matches a token by prefix, length bounds, and allowed
+// characters. Zero-valued fields are not checked.
+type routingRule struct {
+	Entity  string `json:"entity"`
+	Prefix  string `json:"prefix,omitempty"`
+	MinLen  int    `json:"min_len,omitempty"`
+	MaxLen  int    `json:"max_len,omitempty"`
+	Charset string `json:"charset,omitempty"`
+}
+
+// errNoRouteValue is written to rows that match no rule and have no default.
+const errNoRouteValue = "ERROR: no routing rule matched"
+
+// loadTokenRouter reads SKYFLOW_HEURISTIC_RULES (a JSON array of rules) and
+// SKYFLOW_HEURISTIC_DEFAULT_ENTITY. Returns nil unless
+// SKYFLOW_HEURISTIC_ROUTING=1.
+func loadTokenRouter() *tokenRouter {
+	if !envBool("SKYFLOW_HEURISTIC_ROUTING") {
+		return nil
+	}
+	r := &tokenRouter{defaultEntity: strings.ToUpper(os.Getenv("SKYFLOW_HEURISTIC_DEFAULT_ENTITY"))}
+	if raw := os.Getenv("SKYFLOW_HEURISTIC_RULES"); raw != "" {
+		if err := codec.Unmarshal([]byte(raw), &r.rules); err != nil {
+			log.Printf("WARN: invalid SKYFLOW_HEURISTIC_RULES, heuristic routing disabled: %v", err)
+			return nil
+		}
+	}
+	for i := range r.rules {
+		r.rules[i].Entity = strings.ToUpper(r.rules[i].Entity)
+	}
+	if len(r.rules) == 0 && r.defaultEntity == "" {
+		log.Printf("WARN: SKYFLOW_HEURISTIC_ROUTING=1 but no rules or default entity, heuristic routing disabled")
+		return nil
+	}
+	log.Printf("INFO: Heuristic routing enabled (%d rules, default=%q)", len(r.rules), r.defaultEntity)
+	return r
+}
+
+func (rule routingRule) matches(token string) bool {
+	if !strings.HasPrefix(token, rule.Prefix) {
+		return false
+	}
+	if rule.MinLen > 0 && len(token) < rule.MinLen {
+		return false
+	}
+	if rule.MaxLen > 0 && len(token) > rule.MaxLen {
+		return false
+	}
+	if rule.Charset != "" {
+		for _, c := range token {
+			if !strings.ContainsRune(rule.Charset, c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// infer returns the entity for token, falling back to the default entity.
+func (r *tokenRouter) infer(token string) (string, bool) {
+	for _, rule := range r.rules {
+		if rule.matches(token) {
+			return rule.Entity, true
+		}
+	}
+	return r.defaultEntity, r.defaultEntity != ""
+}
+
+// dispatch groups rows by inferred entity, runs operation on each group with
+// that entity's client (one group at a time), and reassembles the results in
+// input order. Metrics are summed across groups.
+func (r *tokenRouter) dispatch(ctx context.Context, clients map[string]*SkyflowClient, operation string, rows [][]interface{}) ([][]interface{}, *SkyflowMetrics, error) {
+	result := make([][]interface{}, len(rows))
+	groups := make(map[string][]int) // entity → input positions
+	var order []string
+	nulls, slots := 0, 0
+
+	for i, row := range rows {
+		if len(row) < 2 {
+			result[i] = []interface{}{rowIndex(row, i), "ERROR: missing value"}
+			continue
+		}
+		if row[1] == nil {
+			result[i] = []interface{}{row[0], nil}
+			nulls++
+			continue
+		}
+		entity, ok := r.infer(argString(row[1]))
+		if !ok {
+			result[i] = []interface{}{row[0], errNoRouteValue}
+			continue
+		}
+		if clients[entity] == nil {
+			result[i] = []interface{}{row[0], fmt.Sprintf("ERROR: no Skyflow client configured for data_type=%s", entity)}
+			continue
+		}
+		if _, seen := groups[entity]; !seen {
+			order = append(order, entity)
+		}
+		groups[entity] = append(groups[entity], i)
+		// Dedup slots as the operation counts them: NULLs and, for
+		// detokenize, empty tokens never reach Skyflow.
+		for _, v := range row[1:] {
+			if v != nil && (operation == "tokenize" || v != "") {
+				slots++
+			}
+		}
+	}
+
+	metrics := &SkyflowMetrics{}
+	for _, entity := range order {
+		positions := groups[entity]
+		groupRows := make([][]interface{}, len(positions))
+		for j, pos := range positions {
+			groupRows[j] = rows[pos]
+		}
+		groupResult, groupMetrics, err := runOperation(ctx, clients[entity], operation, groupRows)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", entity, err)
+		}
+		for j, pos := range positions {
+			result[pos] = groupResult[j]
+		}
+		mergeMetrics(metrics, groupMetrics)
+	}
+	metrics.TotalRows = len(rows)
+	metrics.NullRows += nulls
+	if slots > 0 {
+		metrics.DedupPct = 100.0 * (1.0 - float64(metrics.UniqueTokens)/float64(slots))
+	}
+	return result, metrics, nil
+}
+
+// mergeMetrics folds src into dst for sequentially executed groups: counts
+// and wall time add up, min/max widen, and the average is call-weighted.
+// DedupPct is left for the caller to recompute from the totals.
+func mergeMetrics(dst, src *SkyflowMetrics) {
+	if src.SkyflowCalls > 0 {
+		if dst.SkyflowCalls == 0 || src.CallMinMs < dst.CallMinMs {
+			dst.CallMinMs = src.CallMinMs
+		}
+		dst.CallMaxMs = max(dst.CallMaxMs, src.CallMaxMs)
+		// Percentiles don't merge exactly; keep the worst group's as an upper bound.
+		dst.CallP50Ms = max(dst.CallP50Ms, src.CallP50Ms)
+		dst.CallP95Ms = max(dst.CallP95Ms, src.CallP95Ms)
+		dst.CallP99Ms = max(dst.CallP99Ms, src.CallP99Ms)
+		dst.CallAvgMs = (dst.CallAvgMs*int64(dst.SkyflowCalls) + src.CallAvgMs*int64(src.SkyflowCalls)) /
+			int64(dst.SkyflowCalls+src.SkyflowCalls)
+		dst.CallTTFBAvgMs = (dst.CallTTFBAvgMs*int64(dst.SkyflowCalls) + src.CallTTFBAvgMs*int64(src.SkyflowCalls)) /
+			int64(dst.SkyflowCalls+src.SkyflowCalls)
+		dst.CallTransferAvgMs = (dst.CallTransferAvgMs*int64(dst.SkyflowCalls) + src.CallTransferAvgMs*int64(src.SkyflowCalls)) /
+			int64(dst.SkyflowCalls+src.SkyflowCalls)
+	}
+	// Groups run one after another, so weight efficiency by each one's wall time.
+	if wall := dst.SkyflowWallMs + src.SkyflowWallMs; wall > 0 {
+		dst.ConcurrencyEfficiency = (dst.ConcurrencyEfficiency*float64(dst.SkyflowWallMs) +
+			src.ConcurrencyEfficiency*float64(src.SkyflowWallMs)) / float64(wall)
+	}
+	dst.TotalRows += src.TotalRows
+	dst.UniqueTokens += src.UniqueTokens
+	dst.SkyflowCalls += src.SkyflowCalls
+	dst.SkyflowWallMs += src.SkyflowWallMs
+	dst.Errors += src.Errors
+	dst.ExpiredBatches += src.ExpiredBatches
+	dst.Retries += src.Retries
+	dst.Evictions += src.Evictions
+	dst.DeletedTokens += src.DeletedTokens
+	dst.RowsWithinSLA += src.RowsWithinSLA
+	dst.RowsOverSLA += src.RowsOverSLA
+	dst.NullRows += src.NullRows
+	dst.CPUSaturated = dst.CPUSaturated || src.CPUSaturated
+	dst.BatchSize = max(dst.BatchSize, src.BatchSize)
+	dst.ValueConflicts += src.ValueConflicts
+	dst.ResolvedConflicts += src.ResolvedConflicts
+	dst.EmptyTokens += src.EmptyTokens
+	dst.Oversized += src.Oversized
+	dst.CacheHits += src.CacheHits
+	dst.RecordErrors += src.RecordErrors
+	if breakerSeverity[src.BreakerState] > breakerSeverity[dst.BreakerState] {
+		dst.BreakerState = src.BreakerState
+	}
+	dst.ErrorRatePct = max(dst.ErrorRatePct, src.ErrorRatePct)
+	dst.MaintenanceSuspected = dst.MaintenanceSuspected || src.MaintenanceSuspected
+	dst.Concurrency = max(dst.Concurrency, src.Concurrency)
+	dst.FinalConcurrency = max(dst.FinalConcurrency, src.FinalConcurrency)
+	dst.TopDuplicates = append(dst.TopDuplicates, src.TopDuplicates...)
+	dst.CallLatencies = append(dst.CallLatencies, src.CallLatencies...)
+}
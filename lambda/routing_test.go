@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testRouter() *tokenRouter {
+	return &tokenRouter{rules: []routingRule{
+		{Entity: "SSN", MinLen: 11, MaxLen: 11, Charset: "0123456789-"},
+		{Entity: "EMAIL", Prefix: "em_"},
+		{Entity: "DOB", MinLen: 10, MaxLen: 10, Charset: "0123456789/"},
+	}}
+}
+
+func TestTokenRouterInfer(t *testing.T) {
+	r := testRouter()
+	cases := []struct {
+		token  string
+		entity string
+		ok     bool
+	}{
+		{"123-45-6789", "SSN", true},
+		{"123-45-678", "", false},   // too short for SSN
+		{"123-45-67890", "", false}, // too long
+		{"em_4f9a2c", "EMAIL", true},
+		{"01/02/1990", "DOB", true},
+		{"01-02-1990", "", false}, // DOB charset excludes '-', SSN length doesn't fit
+		{"8f14e45f-ceea-467a-9a36-dedd4bea2543", "", false},
+	}
+	for _, c := range cases {
+		entity, ok := r.infer(c.token)
+		if entity != c.entity || ok != c.ok {
+			t.Errorf("infer(%q) = %q, %v; want %q, %v", c.token, entity, ok, c.entity, c.ok)
+		}
+	}
+
+	r.defaultEntity = "NAME"
+	if entity, ok := r.infer("8f14e45f-ceea-467a-9a36-dedd4bea2543"); entity != "NAME" || !ok {
+		t.Errorf("infer with default = %q, %v; want NAME, true", entity, ok)
+	}
+}
+
+func TestTokenRouterDispatch(t *testing.T) {
+	clients := make(map[string]*SkyflowClient)
+	for _, entity := range []string{"SSN", "EMAIL"} {
+		entity := entity
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req detokenizeRequest
+			codec.Unmarshal(mustReadAll(t, r), &req)
+			var resp detokenizeResponse
+			for _, tok := range req.Tokens {
+				resp.Response = append(resp.Response, detokenizeEntry{Token: tok, Value: jsonString(entity + ":" + tok)})
+			}
+			body, _ := codec.Marshal(resp)
+			w.Write(body)
+		}))
+		t.Cleanup(srv.Close)
+		clients[entity] = newTestClient(srv)
+	}
+
+	rows := [][]interface{}{
+		{0, "123-45-6789"},
+		{1, "em_abc"},
+		{2, "unknown-shape"},
+		{3, "987-65-4321"},
+		{4},
+	}
+	result, metrics, err := testRouter().dispatch(context.Background(), clients, "detokenize", rows)
+	if err != nil {
+		t.Fatalf("dispatch failed: %v", err)
+	}
+
+	want := []interface{}{"SSN:123-45-6789", "EMAIL:em_abc", errNoRouteValue, "SSN:987-65-4321", "ERROR: missing value"}
+	for i, row := range result {
+		if row[0] != i || row[1] != want[i] {
+			t.Errorf("row %d = %v, want [%d %v]", i, row, i, want[i])
+		}
+	}
+	// Only the three routed values are dedup slots, and all are distinct.
+	if metrics.TotalRows != 5 || metrics.UniqueTokens != 3 || metrics.SkyflowCalls != 2 || metrics.DedupPct != 0 {
+		t.Errorf("metrics = %+v, want 5 rows, 3 unique tokens, 2 calls, 0%% dedup", metrics)
+	}
+
+	// A batch with nothing to route has no slots, so nothing was deduplicated.
+	malformed := [][]interface{}{{0}, {1, nil}, {2, "unknown-shape"}, {3, ""}}
+	_, metrics, err = testRouter().dispatch(context.Background(), clients, "detokenize", malformed)
+	if err != nil {
+		t.Fatalf("dispatch failed: %v", err)
+	}
+	if metrics.SkyflowCalls != 0 || metrics.UniqueTokens != 0 || metrics.DedupPct != 0 {
+		t.Errorf("all-malformed metrics = %+v, want no calls and 0%% dedup", metrics)
+	}
+}
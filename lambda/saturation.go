@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// saturationMonitor estimates local CPU starvation from goroutine scheduling
+// lag: how much longer than intended a short sleep takes. On a small Lambda
+// running many goroutines the lag grows, and more concurrency only makes it
+// worse, so fanOut scales its limit down by the ratio of the allowed lag to
+// the observed one.
+type saturationMonitor struct {
+	threshold time.Duration // lag above which the container counts as saturated
+	probe     func() time.Duration
+
+	mu   sync.Mutex
+	ewma time.Duration
+}
+
+// saturationProbeSleep is the sleep whose overshoot is measured; short enough
+// to add no noticeable latency to an invocation.
+const saturationProbeSleep = time.Millisecond
+
+// minSaturationFraction bounds how far the limit is cut: it never drops below
+// this fraction of the configured concurrency (or 1).
+const minSaturationFraction = 0.25
+
+func newSaturationMonitor(threshold time.Duration) *saturationMonitor {
+	return &saturationMonitor{threshold: threshold, probe: sleepLag}
+}
+
+// sleepLag sleeps saturationProbeSleep and returns the overshoot.
+func sleepLag() time.Duration {
+	start := time.Now()
+	time.Sleep(saturationProbeSleep)
+	return max(time.Since(start)-saturationProbeSleep, 0)
+}
+
+// limit probes once, folds the sample into the smoothed lag, and returns the
+// concurrency to use in place of configured and whether it was reduced.
+func (s *saturationMonitor) limit(configured int) (int, bool) {
+	lag := s.probe()
+	s.mu.Lock()
+	if s.ewma == 0 {
+		s.ewma = lag
+	} else {
+		s.ewma = time.Duration(ewmaAlpha*float64(lag) + (1-ewmaAlpha)*float64(s.ewma))
+	}
+	ewma := s.ewma
+	s.mu.Unlock()
+
+	if ewma <= s.threshold {
+		return configured, false
+	}
+	fraction := max(float64(s.threshold)/float64(ewma), minSaturationFraction)
+	return max(int(float64(configured)*fraction), 1), true
+}
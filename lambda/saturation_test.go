@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSaturationReducesConcurrency(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(fakeVault))
+	defer srv.Close()
+
+	lag := time.Duration(0)
+	monitor := newSaturationMonitor(2 * time.Millisecond)
+	monitor.probe = func() time.Duration { return lag }
+	client := newTestClient(srv)
+	client.cfg.MaxConcurrency = 8
+	client.saturation = monitor
+	rows := [][]interface{}{{0, "tok_a"}, {1, "tok_b"}, {2, "tok_c"}}
+
+	_, m, _ := client.Detokenize(context.Background(), rows)
+	if m.Concurrency != 8 || m.CPUSaturated {
+		t.Errorf("idle: concurrency=%d saturated=%v, want 8, false", m.Concurrency, m.CPUSaturated)
+	}
+
+	// Sustained 4ms lag against a 2ms threshold: the smoothed lag climbs
+	// past the threshold and concurrency is cut.
+	lag = 4 * time.Millisecond
+	for i := 0; i < 20; i++ {
+		_, m, _ = client.Detokenize(context.Background(), rows)
+	}
+	if !m.CPUSaturated || m.Concurrency >= 8 || m.Concurrency < 4 {
+		t.Errorf("saturated: concurrency=%d saturated=%v, want 4..7, true", m.Concurrency, m.CPUSaturated)
+	}
+
+	// Heavy lag is floored at minSaturationFraction of the limit.
+	lag = time.Second
+	for i := 0; i < 20; i++ {
+		_, m, _ = client.Detokenize(context.Background(), rows)
+	}
+	if m.Concurrency != 2 {
+		t.Errorf("heavy lag: concurrency=%d, want 2", m.Concurrency)
+	}
+}
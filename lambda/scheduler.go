@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// entityScheduler splits a container-wide concurrency budget across entities
+// that share the container. Each entity's share is weighted by its recent
+// per-call latency and the number of sub-batches it has queued, so the
+// allocation follows the observed workload across invocations.
+type entityScheduler struct {
+	budget int
+	policy string // "latency": slower entities get more slots; "inverse": fewer
+
+	mu    sync.Mutex
+	stats map[string]*entityStats
+}
+
+type entityStats struct {
+	ewmaMs float64 // smoothed per-call latency; 0 until the first observation
+	queued int     // sub-batches submitted but not yet finished
+}
+
+// ewmaAlpha weights the newest latency sample in entityStats.ewmaMs.
+const ewmaAlpha = 0.2
+
+func newEntityScheduler(budget int, policy string) *entityScheduler {
+	if policy != "inverse" {
+		policy = "latency"
+	}
+	return &entityScheduler{
+		budget: budget,
+		policy: policy,
+		stats:  make(map[string]*entityStats),
+	}
+}
+
+func (s *entityScheduler) entity(name string) *entityStats {
+	st, ok := s.stats[name]
+	if !ok {
+		st = &entityStats{}
+		s.stats[name] = st
+	}
+	return st
+}
+
+// enqueue registers n pending sub-batches for entity.
+func (s *entityScheduler) enqueue(entity string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entity(entity).queued += n
+}
+
+// dequeue marks one of entity's sub-batches as finished.
+func (s *entityScheduler) dequeue(entity string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.entity(entity); st.queued > 0 {
+		st.queued--
+	}
+}
+
+// observe folds a call latency into entity's moving average.
+func (s *entityScheduler) observe(entity string, latencyMs int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.entity(entity)
+	if st.ewmaMs == 0 {
+		st.ewmaMs = float64(latencyMs)
+		return
+	}
+	st.ewmaMs = ewmaAlpha*float64(latencyMs) + (1-ewmaAlpha)*st.ewmaMs
+}
+
+// allocate returns entity's current share of the budget (at least 1). Only
+// entities with queued work compete for slots; an entity with no latency
+// history is weighted at the average of those that have one.
+func (s *entityScheduler) allocate(entity string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sumMs float64
+	var observed int
+	for _, st := range s.stats {
+		if st.ewmaMs > 0 {
+			sumMs += st.ewmaMs
+			observed++
+		}
+	}
+	defaultMs := 1.0
+	if observed > 0 {
+		defaultMs = sumMs / float64(observed)
+	}
+
+	weight := func(st *entityStats) float64 {
+		ms := st.ewmaMs
+		if ms <= 0 {
+			ms = defaultMs
+		}
+		ms = math.Max(ms, 1)
+		depth := float64(max(st.queued, 1))
+		if s.policy == "inverse" {
+			return depth / ms
+		}
+		return depth * ms
+	}
+
+	self := weight(s.entity(entity))
+	total := 0.0
+	for name, st := range s.stats {
+		if st.queued > 0 || name == entity {
+			total += weight(st)
+		}
+	}
+
+	slots := int(math.Round(float64(s.budget) * self / total))
+	return min(max(slots, 1), s.budget)
+}
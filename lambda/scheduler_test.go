@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEntitySchedulerLatencyWeighting(t *testing.T) {
+	sched := newEntityScheduler(50, "latency")
+	sched.enqueue("NAME", 10)
+	sched.enqueue("SSN", 10)
+	for i := 0; i < 5; i++ {
+		sched.observe("NAME", 50)
+		sched.observe("SSN", 200)
+	}
+
+	name, ssn := sched.allocate("NAME"), sched.allocate("SSN")
+	if name != 10 || ssn != 40 {
+		t.Errorf("latency policy: NAME=%d SSN=%d, want 10 and 40", name, ssn)
+	}
+
+	sched.policy = "inverse"
+	name, ssn = sched.allocate("NAME"), sched.allocate("SSN")
+	if name != 40 || ssn != 10 {
+		t.Errorf("inverse policy: NAME=%d SSN=%d, want 40 and 10", name, ssn)
+	}
+}
+
+func TestEntitySchedulerIdleEntityReleasesBudget(t *testing.T) {
+	sched := newEntityScheduler(50, "latency")
+	sched.observe("NAME", 50)
+	sched.observe("SSN", 200)
+	sched.enqueue("NAME", 4)
+
+	// SSN has history but nothing queued, so NAME gets the whole budget.
+	if got := sched.allocate("NAME"); got != 50 {
+		t.Errorf("allocate(NAME) = %d, want 50", got)
+	}
+}
+
+func TestFanOutReportsSchedulerAllocation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(fakeVault))
+	defer srv.Close()
+
+	sched := newEntityScheduler(8, "latency")
+	sched.enqueue("SSN", 100)
+	sched.observe("SSN", 300)
+	sched.observe("NAME", 100)
+
+	client := newTestClient(srv)
+	client.cfg.Entity = "NAME"
+	client.scheduler = sched
+
+	rows := [][]interface{}{{0, "tok_a"}, {1, "tok_b"}, {2, "tok_c"}}
+	_, metrics, err := client.Detokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	// NAME: 2 queued x 100ms vs SSN: 100 queued x 300ms → NAME's share rounds to 1.
+	if metrics.Concurrency != 1 {
+		t.Errorf("Concurrency = %d, want 1", metrics.Concurrency)
+	}
+	if sched.stats["NAME"].queued != 0 {
+		t.Errorf("NAME queue depth = %d after Detokenize, want 0", sched.stats["NAME"].queued)
+	}
+}
@@ -2,48 +2,425 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // SkyflowConfig holds environment-driven configuration for the Skyflow v2 API.
 type SkyflowConfig struct {
+	Entity         string // NAME, ID, SSN, DOB, EMAIL
 	DataPlaneURL   string
 	AccountID      string
 	APIKey         string
 	VaultID        string
 	TableName      string
 	ColumnName     string
+	Columns        []string // per-argument columns for multi-argument rows
 	BatchSize      int
+	MaxBatchSize   int           // per-call API limit; upper bound for the adaptive size
+	TargetP95      time.Duration // p95 call-latency objective; > 0 makes BatchSize adaptive
 	MaxConcurrency int
+
+	// SortBeforeBatch orders values (tokenize) or unique tokens (detokenize)
+	// before splitting them into sub-batches, so similar values travel
+	// together. Results are still written back by row position.
+	SortBeforeBatch bool
+
+	// TokenizeDedup inserts each distinct (column, value) of a tokenize call
+	// once and copies its token to every row holding it.
+	TokenizeDedup bool
+
+	// BYOT (SKYFLOW_BYOT) lets tokenize rows bring their own token as
+	// [idx, value, token]: "ENABLE" uses it when present, "ENABLE_STRICT"
+	// requires one for every value, and "" (DISABLE) leaves three-element
+	// rows as two-argument rows.
+	BYOT string
+
+	// PartialResults stops waiting for sub-batches after PartialDeadline and
+	// returns what has completed, marking the rest "ERROR: deadline".
+	PartialResults  bool
+	PartialDeadline time.Duration
+
+	// DeadlineMargin stops the fan-out this long before the invocation's
+	// deadline: sub-batches not yet started are skipped with
+	// errDeadlineExceededValue and in-flight calls are cancelled, leaving
+	// time to answer instead of timing out at API Gateway. 0 disables.
+	DeadlineMargin time.Duration
+
+	// TokenizeDeadlineMargin and DetokenizeDeadlineMargin replace
+	// DeadlineMargin for one operation, so slower inserts can stop earlier
+	// than reads; 0 uses DeadlineMargin.
+	TokenizeDeadlineMargin   time.Duration
+	DetokenizeDeadlineMargin time.Duration
+
+	// HTTPTimeout bounds each Skyflow request end to end (connect, send,
+	// wait, read); 0 means defaultHTTPTimeout.
+	HTTPTimeout time.Duration
+
+	// CallTimeout gives each sub-batch's Skyflow call, retries included, its
+	// own deadline, so one slow call fails alone instead of holding its
+	// concurrency slot for up to HTTPTimeout per attempt. Its rows get an
+	// ERROR: value and its latency is recorded as CallTimeout. 0 disables it.
+	CallTimeout time.Duration
+
+	// TCPKeepAlive is the interval between keep-alive probes on pooled
+	// connections. It keeps NAT/firewall idle timers from silently dropping
+	// connections between benchmark bursts; IdleConnTimeout still decides
+	// how long an unused connection stays in the pool.
+	TCPKeepAlive time.Duration
+
+	// RetryMaxAttempts is the total number of attempts (first try included)
+	// for 5xx/429 responses. RetryBackoff is the pause between attempts, or
+	// the base of the Backoff strategy ("fixed", "exponential",
+	// "full-jitter" or "decorrelated"; see backoff.go), whose pauses are
+	// capped at RetryBackoffMax.
+	RetryMaxAttempts int
+	RetryBackoff     time.Duration
+	Backoff          string
+	RetryBackoffMax  time.Duration
+
+	// RetryEmptyResponse treats a 2xx with an empty or whitespace-only body
+	// (other than 204 No Content) as a dropped response and retries it like
+	// a 5xx. Some intermediaries occasionally lose bodies on the way back.
+	RetryEmptyResponse bool
+
+	// ContinueOnError asks Skyflow to answer the rest of a detokenize call
+	// when some tokens fail, instead of rejecting the whole call. Failed
+	// tokens come back as error entries or are left out; either way only
+	// their own rows get an ERROR: value (see entriesByToken).
+	ContinueOnError bool
+
+	// MaintenanceThreshold consecutive 503s (across requests on this client)
+	// are taken as a Skyflow maintenance window: retries then wait
+	// MaintenanceBackoff, doubling per further 503 up to MaintenanceBackoffMax,
+	// instead of RetryBackoff. Any other response ends the window. 0 disables.
+	MaintenanceThreshold  int
+	MaintenanceBackoff    time.Duration
+	MaintenanceBackoffMax time.Duration
+
+	// MaxRequestBytes starts a new sub-batch before its estimated JSON size
+	// passes this many bytes, even if it holds fewer than BatchSize values,
+	// so batches of long values stay under gateway payload limits. A single
+	// value over the limit still goes out alone. 0 caps by count only.
+	MaxRequestBytes int
+
+	// MaxValueBytes rejects tokenize values longer than this many bytes with
+	// a per-row error before batching, so one oversized field doesn't fail
+	// the whole insert. 0 disables the check.
+	MaxValueBytes int
+
+	// InsertOrder is how insert response records are matched to request
+	// records: "position" (record i answers request record i) or
+	// "request_index" (by the requestIndex each record echoes back, for
+	// gateways or vault versions that may reorder them).
+	InsertOrder string
+
+	// OnConflict is "error" (a uniqueness conflict on insert fails the
+	// sub-batch) or "resolve" (the existing record's token is looked up and
+	// returned, so re-tokenizing a value is idempotent).
+	OnConflict string
+
+	// DeletedTokenSentinel replaces the value of tokens whose record was
+	// deleted, so SQL can tell them apart from "ERROR: ..." values.
+	DeletedTokenSentinel string
+
+	// SingleRowFastPath serves one-row, one-argument requests (row-at-a-time
+	// query plans) with a direct call, skipping the fan-out's goroutines,
+	// semaphore and dedup maps. It stands aside when the partial-results
+	// deadline or the entity scheduler is in play.
+	SingleRowFastPath bool
+
+	// ValueTypes is "preserve" (non-string detokenized values keep their JSON
+	// type) or "string" (they are returned as their JSON text).
+	ValueTypes string
+
+	// EmptyTokens is what detokenize returns for an empty-string token, which
+	// Snowflake commonly produces for NULLs and Skyflow rejects: "null" or
+	// "empty" (""). Either way the token is never sent.
+	EmptyTokens string
+
+	// Redaction is the redaction level detokenize asks Skyflow for, one of
+	// redactionLevels. Requests can override it with sf-custom-x-redaction.
+	Redaction string
+
+	// RowSLA is the sub-batch latency under which, in debug mode, a row counts
+	// as served within SLA (RowsWithinSLA / RowsOverSLA).
+	RowSLA time.Duration
+
+	// Compression "gzip" gzips request bodies of at least CompressMinBytes
+	// and asks Skyflow for gzipped responses; "" sends plain JSON.
+	Compression      string
+	CompressMinBytes int
+
+	// HMACSecret, when set, signs each request for gateways that require it:
+	// HMACTimestampHeader carries the unix time and HMACSignatureHeader the
+	// hex HMAC-SHA256 of "<timestamp>.<body>".
+	HMACSecret          string
+	HMACSignatureHeader string
+	HMACTimestampHeader string
+
+	// CredentialsFile (SKYFLOW_CREDENTIALS_FILE) is a service-account file
+	// whose bearer tokens stand in for APIKey.
+	CredentialsFile string
+}
+
+// Validate reports every required setting that is missing or malformed, so
+// a misconfigured deployment fails at startup instead of with a 401 or a
+// bad URL on each call. It returns nil for a usable config.
+func (c *SkyflowConfig) Validate() error {
+	var problems []string
+	if u, err := url.Parse(c.DataPlaneURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("SKYFLOW_DATA_PLANE_URL %q is not an http(s) URL", c.DataPlaneURL))
+	}
+	if c.VaultID == "" {
+		problems = append(problems, "vault ID is empty")
+	}
+	if c.APIKey == "" && c.CredentialsFile == "" {
+		problems = append(problems, "SKYFLOW_API_KEY is empty and SKYFLOW_CREDENTIALS_FILE is not set")
+	}
+	if c.BatchSize <= 0 {
+		problems = append(problems, fmt.Sprintf("batch size %d is not positive", c.BatchSize))
+	}
+	if c.MaxConcurrency <= 0 {
+		problems = append(problems, fmt.Sprintf("max concurrency %d is not positive", c.MaxConcurrency))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// keyless reports whether any entity has no API key, so it depends on the
+// credentials file loading.
+func keyless(configs map[string]*SkyflowConfig) bool {
+	for _, cfg := range configs {
+		if cfg.APIKey == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSkyflowConfigs validates every entity's config and combines the
+// problems, one entity at a time in name order.
+func validateSkyflowConfigs(configs map[string]*SkyflowConfig) error {
+	entities := make([]string, 0, len(configs))
+	for entity := range configs {
+		entities = append(entities, entity)
+	}
+	sort.Strings(entities)
+	var problems []string
+	for _, entity := range entities {
+		if err := configs[entity].Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", entity, err))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid Skyflow configuration: %s", strings.Join(problems, "; "))
 }
 
 // SkyflowMetrics captures per-invocation metrics across all three layers.
 type SkyflowMetrics struct {
-	TotalRows    int   // rows received from Snowflake
-	UniqueTokens int   // unique tokens after dedup (= TotalRows for tokenize)
-	DedupPct     float64 // percent reduction from dedup
-	SkyflowCalls int   // number of Skyflow API sub-batch calls
-	SkyflowWallMs int64 // wall clock ms for all Skyflow work (concurrent)
-	CallMinMs    int64  // fastest individual API call
-	CallMaxMs    int64  // slowest individual API call
-	CallAvgMs    int64  // average individual API call
-	Errors       int   // API errors/retries
+	TotalRows      int     // rows received from Snowflake
+	UniqueTokens   int     // unique tokens after dedup (tokenize: values sent)
+	DedupPct       float64 // percent reduction from dedup
+	SkyflowCalls   int     // number of Skyflow API sub-batch calls
+	SkyflowWallMs  int64   // wall clock ms for all Skyflow work (concurrent)
+	CallMinMs      int64   // fastest individual API call
+	CallMaxMs      int64   // slowest individual API call
+	CallAvgMs      int64   // average individual API call
+	CallP50Ms      int64   // median individual API call
+	CallP95Ms      int64   // 95th percentile individual API call
+	CallP99Ms      int64   // 99th percentile individual API call
+	Errors         int     // API errors/retries
+	ExpiredBatches int     // sub-batches abandoned at the partial-results deadline
+	Concurrency    int     // concurrency limit in effect for the fan-out
+	Retries        int     // retried Skyflow requests across all sub-batches
+	Evictions      int     // times pooled connections were dropped after a transport error
+
+	MaintenanceSuspected bool // sustained 503s pushed retries into the maintenance backoff
+	DeletedTokens        int  // unique tokens whose record Skyflow reported as deleted
+	RowsWithinSLA        int  // debug only: row slots whose sub-batch finished within RowSLA
+	RowsOverSLA          int  // debug only: row slots whose sub-batch was slower or never finished
+	NullRows             int  // SQL NULL arguments passed through as null without a Skyflow call
+	CPUSaturated         bool // scheduling lag cut Concurrency below the configured limit
+	BatchSize            int  // sub-batch size used (adaptive under SKYFLOW_TARGET_P95_MS)
+	ValueConflicts       int  // tokens resolved more than once with differing values (should be 0)
+	ResolvedConflicts    int  // tokenize values already in the vault whose existing token was returned
+
+	EmptyTokens  int     // empty-string tokens answered without a Skyflow call
+	CacheHits    int     // unique tokens answered from the detokenize cache
+	RecordErrors int     // values Skyflow failed individually; only their rows get ERROR:
+	BreakerState string  // circuit breaker state after the calls: closed, open, half_open or off
+	Oversized    int     // tokenize values over SKYFLOW_MAX_VALUE_BYTES, answered with an error
+	ErrorRatePct float64 // rolling Skyflow call error rate driving the ramp-down (SKYFLOW_ERROR_RAMP_PCT)
+
+	ConcurrencyEfficiency float64 // summed call time / (wall time × usable concurrency); see concurrencyEfficiency
+	FinalConcurrency      int     // adaptive concurrency limit when the fan-out ended; 0 unless SKYFLOW_CONCURRENCY_MODE=adaptive
+
+	// Traced invocations only (TRACE_SAMPLE_RATE), per HTTP request: time to
+	// the first response byte (server-side time) and from there until the
+	// body was read (transfer time).
+	CallTTFBAvgMs     int64
+	CallTransferAvgMs int64
+
+	TopDuplicates []tokenCount // most repeated tokens in the batch (debug only)
+	CallLatencies []int64      // every call's latency in ms, in completion order; logged with METRICS_VERBOSE
+}
+
+// tokenCount is a token and the number of rows in the batch that carried it.
+type tokenCount struct {
+	Token string
+	Count int
+}
+
+// debugTopN bounds the TopDuplicates list so debug logs stay small.
+const debugTopN = 10
+
+// requestOptions carries per-invocation flags from the handler to the client.
+type requestOptions struct {
+	Debug bool
+
+	// BenchConfig, when non-empty, is sent to Skyflow as benchConfigHeader so
+	// Skyflow-side logs can be lined up with benchmark scenarios.
+	BenchConfig string
+
+	// Trace, decided once per invocation from TRACE_SAMPLE_RATE, logs a TRACE
+	// line with connection timings for each Skyflow request.
+	Trace bool
+}
+
+// benchConfigHeader carries the forwarded sf-benchmark-config value.
+const benchConfigHeader = "X-Benchmark-Config"
+
+type requestOptionsKey struct{}
+
+// callCounters accumulates per-invocation counts from inside the HTTP layer,
+// where the invocation's SkyflowMetrics is not in reach. fanOut attaches one
+// to the context and copies the totals into metrics when the fan-out ends.
+type callCounters struct {
+	retries     atomic.Int64
+	evictions   atomic.Int64
+	maintenance atomic.Bool
+	resolved    atomic.Int64
+	failed      atomic.Int64 // per-record errors inside otherwise successful responses
+
+	traced  atomic.Int64 // traced requests that got a response
+	ttfbUs  atomic.Int64 // their summed time to first byte
+	totalUs atomic.Int64 // their summed time until the body was read
+}
+
+func (c *callCounters) copyTo(m *SkyflowMetrics) {
+	m.Retries = int(c.retries.Load())
+	m.Evictions = int(c.evictions.Load())
+	m.MaintenanceSuspected = c.maintenance.Load()
+	m.ResolvedConflicts = int(c.resolved.Load())
+	m.RecordErrors = int(c.failed.Load())
+	if n := c.traced.Load(); n > 0 {
+		ttfb, total := c.ttfbUs.Load(), c.totalUs.Load()
+		m.CallTTFBAvgMs = ttfb / n / 1000
+		m.CallTransferAvgMs = (total - ttfb) / n / 1000
+	}
+}
+
+type callCountersKey struct{}
+
+func withCallCounters(ctx context.Context, c *callCounters) context.Context {
+	return context.WithValue(ctx, callCountersKey{}, c)
+}
+
+// countersFrom returns ctx's counters, or a throwaway set if none is attached.
+func countersFrom(ctx context.Context) *callCounters {
+	if c, ok := ctx.Value(callCountersKey{}).(*callCounters); ok {
+		return c
+	}
+	return &callCounters{}
+}
+
+func withRequestOptions(ctx context.Context, opts requestOptions) context.Context {
+	return context.WithValue(ctx, requestOptionsKey{}, opts)
+}
+
+func requestOptionsFrom(ctx context.Context) requestOptions {
+	opts, _ := ctx.Value(requestOptionsKey{}).(requestOptions)
+	return opts
 }
 
 // SkyflowClient makes batched, concurrent calls to the Skyflow v2 API.
 type SkyflowClient struct {
-	cfg    SkyflowConfig
-	client *http.Client
+	cfg       SkyflowConfig
+	client    *http.Client
+	scheduler *entityScheduler // shared across entities; nil = fixed MaxConcurrency
+
+	// consecutive503 counts back-to-back 503s for maintenance detection. It
+	// is a pointer so per-request copies (withColumn etc.) share it.
+	consecutive503 *atomic.Int64
+
+	hosts *hostLimiter // shared per-host cap; nil = unlimited
+
+	saturation *saturationMonitor // shared CPU-starvation backoff; nil = off
+
+	errorRamp *errorRamp // per-entity concurrency ramp-down on errors; nil = off
+
+	adaptive *adaptiveConcurrency // per-entity AIMD concurrency; nil = fixed limit
+
+	batches *batchController // adaptive sub-batch size; nil = fixed BatchSize
+
+	cache *valueCache // per-entity detokenize cache; nil = off
+
+	bearer *bearerTokens // service-account tokens; nil = static APIKey
+
+	breaker *circuitBreaker // per-entity circuit breaker; nil = off
+}
+
+// defaultMaxAPIBatch is the most records per insert / tokens per detokenize
+// call the client will send. Batches above the vault's limit fail every call
+// with a 400, so SKYFLOW_BATCH_SIZE is clamped to this (or
+// SKYFLOW_MAX_API_BATCH) at startup.
+const defaultMaxAPIBatch = 1000
+
+// Lambda allocates CPU in proportion to memory: one full vCPU at
+// lambdaMBPerVCPU, up to six at the 10,240 MB maximum.
+const (
+	lambdaMBPerVCPU       = 1769
+	concurrencyPerVCPU    = 10
+	minDerivedConcurrency = 2
+)
+
+// concurrencyForMemory derives the default MaxConcurrency from the function's
+// memory size: concurrencyPerVCPU per vCPU's worth of memory, at least
+// minDerivedConcurrency. memMB <= 0 (not running on Lambda) gives the
+// one-vCPU value.
+func concurrencyForMemory(memMB int) int {
+	if memMB <= 0 {
+		return concurrencyPerVCPU
+	}
+	n := (concurrencyPerVCPU*memMB + lambdaMBPerVCPU/2) / lambdaMBPerVCPU
+	return max(n, minDerivedConcurrency)
 }
 
 // loadSkyflowConfigs reads Skyflow configuration from environment variables.
@@ -55,15 +432,78 @@ func loadSkyflowConfigs() map[string]*SkyflowConfig {
 	if url == "" {
 		return nil
 	}
+	url = strings.TrimRight(url, "/") // a pasted "https://host/" would otherwise yield "//v2/..."
 
 	apiKey := os.Getenv("SKYFLOW_API_KEY")
 	accountID := os.Getenv("SKYFLOW_ACCOUNT_ID")
 	batchSize := envIntOrDefault("SKYFLOW_BATCH_SIZE", 25)
-	maxConcurrency := envIntOrDefault("SKYFLOW_MAX_CONCURRENCY", 10)
+	maxAPIBatch := envIntOrDefault("SKYFLOW_MAX_API_BATCH", defaultMaxAPIBatch)
+	if batchSize > maxAPIBatch {
+		log.Printf("WARN: SKYFLOW_BATCH_SIZE=%d exceeds the Skyflow per-call limit of %d, clamping to %d",
+			batchSize, maxAPIBatch, maxAPIBatch)
+		batchSize = maxAPIBatch
+	}
+	maxConcurrency := envIntOrDefault("SKYFLOW_MAX_CONCURRENCY", 0)
+	if maxConcurrency == 0 {
+		memMB := envIntOrDefault("AWS_LAMBDA_FUNCTION_MEMORY_SIZE", 0)
+		maxConcurrency = concurrencyForMemory(memMB)
+		if memMB > 0 {
+			log.Printf("INFO: SKYFLOW_MAX_CONCURRENCY not set, derived %d from %d MB function memory",
+				maxConcurrency, memMB)
+		}
+	}
 
-	if apiKey == "" {
-		log.Printf("WARN: SKYFLOW_DATA_PLANE_URL set but SKYFLOW_API_KEY missing — Skyflow calls will fail")
+	// Settings shared by every entity; per-entity fields are filled in below.
+	base := SkyflowConfig{
+		DataPlaneURL:    url,
+		AccountID:       accountID,
+		APIKey:          apiKey,
+		CredentialsFile: os.Getenv("SKYFLOW_CREDENTIALS_FILE"),
+		BatchSize:       batchSize,
+		MaxBatchSize:    maxAPIBatch,
+		TargetP95:       time.Duration(envIntOrDefault("SKYFLOW_TARGET_P95_MS", 0)) * time.Millisecond,
+		MaxConcurrency:  maxConcurrency,
+		SortBeforeBatch: envBool("SKYFLOW_SORT_BEFORE_BATCH"),
+		TokenizeDedup:   envBool("SKYFLOW_TOKENIZE_DEDUP"),
+		BYOT:            loadBYOT(),
+		PartialResults:  envBool("PARTIAL_RESULTS_ON_DEADLINE"),
+		PartialDeadline: time.Duration(envIntOrDefault("PARTIAL_RESULTS_DEADLINE_MS", 5000)) * time.Millisecond,
+		DeadlineMargin:  time.Duration(envIntOrDefault("SKYFLOW_DEADLINE_MARGIN_MS", 500)) * time.Millisecond,
+		HTTPTimeout:     loadHTTPTimeout(),
+		CallTimeout:     time.Duration(envIntOrDefault("SKYFLOW_CALL_TIMEOUT_MS", 0)) * time.Millisecond,
+		TCPKeepAlive:    time.Duration(envIntOrDefault("SKYFLOW_TCP_KEEPALIVE_MS", 30000)) * time.Millisecond,
+		RetryBackoff:    time.Duration(envIntOrDefault("SKYFLOW_RETRY_BACKOFF_MS", 500)) * time.Millisecond,
+		Backoff:         loadBackoff(),
+		RetryBackoffMax: time.Duration(envIntOrDefault("SKYFLOW_RETRY_BACKOFF_MAX_MS", 10000)) * time.Millisecond,
+
+		TokenizeDeadlineMargin:   time.Duration(envIntOrDefault("SKYFLOW_DEADLINE_MARGIN_MS_TOKENIZE", 0)) * time.Millisecond,
+		DetokenizeDeadlineMargin: time.Duration(envIntOrDefault("SKYFLOW_DEADLINE_MARGIN_MS_DETOKENIZE", 0)) * time.Millisecond,
+
+		RetryEmptyResponse: envBoolOrDefault("SKYFLOW_RETRY_EMPTY_RESPONSE", true),
+		ContinueOnError:    envBoolOrDefault("SKYFLOW_CONTINUE_ON_ERROR", true),
+
+		MaintenanceThreshold:  envIntOrDefault("SKYFLOW_MAINTENANCE_THRESHOLD", 3),
+		MaintenanceBackoff:    time.Duration(envIntOrDefault("SKYFLOW_MAINTENANCE_BACKOFF_MS", 5000)) * time.Millisecond,
+		MaintenanceBackoffMax: time.Duration(envIntOrDefault("SKYFLOW_MAINTENANCE_BACKOFF_MAX_MS", 30000)) * time.Millisecond,
+
+		OnConflict:           strings.ToLower(envOrDefault("SKYFLOW_ON_CONFLICT", "error")),
+		InsertOrder:          strings.ToLower(envOrDefault("SKYFLOW_INSERT_ORDER", "position")),
+		MaxValueBytes:        envIntOrDefault("SKYFLOW_MAX_VALUE_BYTES", 0),
+		MaxRequestBytes:      envIntOrDefault("SKYFLOW_MAX_REQUEST_BYTES", 0),
+		DeletedTokenSentinel: envOrDefault("DELETED_TOKEN_SENTINEL", "DELETED"),
+		SingleRowFastPath:    envBoolOrDefault("SKYFLOW_SINGLE_ROW_FAST_PATH", true),
+		ValueTypes:           strings.ToLower(envOrDefault("DETOKENIZE_VALUE_TYPES", "preserve")),
+		EmptyTokens:          strings.ToLower(envOrDefault("DETOKENIZE_EMPTY_TOKENS", "null")),
+		Redaction:            loadRedaction(),
+		RowSLA:               time.Duration(envIntOrDefault("SKYFLOW_ROW_SLA_MS", 1000)) * time.Millisecond,
+		Compression:          loadCompression(),
+		CompressMinBytes:     envIntOrDefault("SKYFLOW_COMPRESSION_MIN_BYTES", 1024),
+
+		HMACSecret:          os.Getenv("SKYFLOW_HMAC_SECRET"),
+		HMACSignatureHeader: envOrDefault("SKYFLOW_HMAC_SIGNATURE_HEADER", "X-Signature"),
+		HMACTimestampHeader: envOrDefault("SKYFLOW_HMAC_TIMESTAMP_HEADER", "X-Timestamp"),
 	}
+	globalRetries := envIntOrDefault("SKYFLOW_RETRY_MAX_ATTEMPTS", 2)
 
 	entities := []string{"NAME", "ID", "SSN", "DOB", "EMAIL"}
 	configs := make(map[string]*SkyflowConfig)
@@ -74,16 +514,13 @@ func loadSkyflowConfigs() map[string]*SkyflowConfig {
 		if vaultID == "" {
 			continue
 		}
-		configs[entity] = &SkyflowConfig{
-			DataPlaneURL:   url,
-			AccountID:      accountID,
-			APIKey:         apiKey,
-			VaultID:        vaultID,
-			TableName:      "table1",
-			ColumnName:     strings.ToLower(entity),
-			BatchSize:      batchSize,
-			MaxConcurrency: maxConcurrency,
-		}
+		cfg := base
+		cfg.Entity = entity
+		cfg.VaultID = vaultID
+		cfg.TableName = "table1"
+		cfg.ColumnName = strings.ToLower(entity)
+		cfg.RetryMaxAttempts = envIntOrDefault("SKYFLOW_RETRY_MAX_ATTEMPTS_"+entity, globalRetries)
+		configs[entity] = &cfg
 	}
 
 	// Backward compat: fall back to single SKYFLOW_VAULT_ID if no per-entity vars found
@@ -93,21 +530,80 @@ func loadSkyflowConfigs() map[string]*SkyflowConfig {
 			log.Printf("WARN: SKYFLOW_DATA_PLANE_URL set but no SKYFLOW_VAULT_ID or per-entity vault IDs found")
 			return nil
 		}
-		configs["NAME"] = &SkyflowConfig{
-			DataPlaneURL:   url,
-			AccountID:      accountID,
-			APIKey:         apiKey,
-			VaultID:        vaultID,
-			TableName:      envOrDefault("SKYFLOW_TABLE_NAME", "table1"),
-			ColumnName:     envOrDefault("SKYFLOW_COLUMN_NAME", "name"),
-			BatchSize:      batchSize,
-			MaxConcurrency: maxConcurrency,
-		}
+		cfg := base
+		cfg.Entity = "NAME"
+		cfg.VaultID = vaultID
+		cfg.TableName = envOrDefault("SKYFLOW_TABLE_NAME", "table1")
+		cfg.ColumnName = envOrDefault("SKYFLOW_COLUMN_NAME", "name")
+		cfg.RetryMaxAttempts = envIntOrDefault("SKYFLOW_RETRY_MAX_ATTEMPTS_NAME", globalRetries)
+		configs["NAME"] = &cfg
 	}
 
 	return configs
 }
 
+// defaultHTTPTimeout is the per-request timeout when SKYFLOW_HTTP_TIMEOUT_MS
+// is unset.
+const defaultHTTPTimeout = 30 * time.Second
+
+// loadHTTPTimeout reads SKYFLOW_HTTP_TIMEOUT_MS. Unlike envIntOrDefault it
+// warns about a zero or negative value, since silently falling back would
+// hide a typo in a timeout experiment.
+func loadHTTPTimeout() time.Duration {
+	v := os.Getenv("SKYFLOW_HTTP_TIMEOUT_MS")
+	if v == "" {
+		return defaultHTTPTimeout
+	}
+	ms, err := strconv.Atoi(v)
+	if err != nil || ms <= 0 {
+		log.Printf("WARN: invalid SKYFLOW_HTTP_TIMEOUT_MS %q, using %v", v, defaultHTTPTimeout)
+		return defaultHTTPTimeout
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// redactionLevels are the detokenize redaction levels Skyflow accepts.
+var redactionLevels = map[string]bool{"PLAIN_TEXT": true, "MASKED": true, "REDACTED": true, "DEFAULT": true}
+
+// loadRedaction reads SKYFLOW_REDACTION, falling back to PLAIN_TEXT with a
+// warning on a value Skyflow would reject.
+func loadRedaction() string {
+	v := strings.ToUpper(envOrDefault("SKYFLOW_REDACTION", "PLAIN_TEXT"))
+	if !redactionLevels[v] {
+		log.Printf("WARN: invalid SKYFLOW_REDACTION %q, using PLAIN_TEXT", v)
+		return "PLAIN_TEXT"
+	}
+	return v
+}
+
+// loadBYOT reads SKYFLOW_BYOT (DISABLE, ENABLE or ENABLE_STRICT), falling
+// back to DISABLE with a warning on anything else. DISABLE is returned as "".
+func loadBYOT() string {
+	switch v := strings.ToUpper(envOrDefault("SKYFLOW_BYOT", "DISABLE")); v {
+	case "DISABLE":
+		return ""
+	case "ENABLE", "ENABLE_STRICT":
+		return v
+	default:
+		log.Printf("WARN: invalid SKYFLOW_BYOT %q, using DISABLE", v)
+		return ""
+	}
+}
+
+// loadCompression reads SKYFLOW_COMPRESSION ("gzip", or "none"/unset for
+// plain JSON), warning about anything else.
+func loadCompression() string {
+	switch v := strings.ToLower(os.Getenv("SKYFLOW_COMPRESSION")); v {
+	case "", "none":
+		return ""
+	case "gzip":
+		return v
+	default:
+		log.Printf("WARN: invalid SKYFLOW_COMPRESSION %q, sending uncompressed requests", v)
+		return ""
+	}
+}
+
 func envOrDefault(key, fallback string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
@@ -124,31 +620,122 @@ func envIntOrDefault(key string, fallback int) int {
 	return fallback
 }
 
+// envBool reports whether key is set to a true value ("1", "true", ...).
+func envBool(key string) bool {
+	b, _ := strconv.ParseBool(os.Getenv(key))
+	return b
+}
+
+func envBoolOrDefault(key string, def bool) bool {
+	b, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return b
+}
+
 // NewSkyflowClient creates a client with connection pooling.
 func NewSkyflowClient(cfg SkyflowConfig) *SkyflowClient {
+	if cfg.HTTPTimeout <= 0 {
+		cfg.HTTPTimeout = defaultHTTPTimeout
+	}
+	cfg.DataPlaneURL = strings.TrimRight(cfg.DataPlaneURL, "/")
+	var batches *batchController
+	if cfg.TargetP95 > 0 {
+		batches = newBatchController(cfg.TargetP95, cfg.BatchSize, cfg.MaxBatchSize)
+	}
 	return &SkyflowClient{
-		cfg: cfg,
+		batches:        batches,
+		cfg:            cfg,
+		consecutive503: &atomic.Int64{},
 		client: &http.Client{
-			Timeout: 30 * time.Second,
-			Transport: &http.Transport{
+			Timeout: cfg.HTTPTimeout,
+			Transport: &evictingTransport{base: &http.Transport{
+				DialContext:         newDialer(cfg).DialContext,
 				MaxIdleConnsPerHost: 50,
 				MaxIdleConns:        100,
 				IdleConnTimeout:     90 * time.Second,
-			},
+			}},
 		},
 	}
 }
 
+// evictingTransport drops the pool's idle connections after a transport
+// error (reset, EOF, ...). Go may otherwise keep handing out sibling
+// connections that a server or middlebox has already dropped, turning one bad
+// connection into a cascade of failures.
+type evictingTransport struct {
+	base *http.Transport
+}
+
+func (t *evictingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil && req.Context().Err() == nil {
+		t.base.CloseIdleConnections()
+		countersFrom(req.Context()).evictions.Add(1)
+	}
+	return resp, err
+}
+
+// withColumn returns a per-request copy of sc that tokenizes into column. The
+// copy shares sc's HTTP client and scheduler.
+func (sc *SkyflowClient) withColumn(column string) *SkyflowClient {
+	c := *sc
+	c.cfg.ColumnName = column
+	return &c
+}
+
+// withAPIKey returns a per-request copy of sc that authenticates with key.
+// The copy bypasses the detokenize cache, so values fetched with one
+// tenant's permissions are never served to another.
+func (sc *SkyflowClient) withAPIKey(key string) *SkyflowClient {
+	c := *sc
+	c.cfg.APIKey = key
+	c.cache = nil
+	c.bearer = nil
+	return &c
+}
+
+// withColumns returns a per-request copy of sc that maps row arguments, in
+// order, to columns.
+func (sc *SkyflowClient) withColumns(columns []string) *SkyflowClient {
+	c := *sc
+	c.cfg.Columns = columns
+	return &c
+}
+
+// withRedaction returns a per-request copy of sc that detokenizes at the
+// given redaction level.
+func (sc *SkyflowClient) withRedaction(redaction string) *SkyflowClient {
+	c := *sc
+	c.cfg.Redaction = redaction
+	return &c
+}
+
+// newDialer returns the dialer used for Skyflow connections.
+func newDialer(cfg SkyflowConfig) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: cfg.TCPKeepAlive,
+	}
+}
+
 // --- Tokenize ---
 
+// Request bodies serialize in struct declaration order (map keys sorted), and
+// some strict proxies validate that order: vaultID, tableName, records for
+// insert; vaultID, tokens for detokenize. TestRequestBodyCanonicalBytes pins
+// the bytes, so reorder fields only together with that test.
 type tokenizeRequest struct {
 	VaultID   string              `json:"vaultID"`
 	TableName string              `json:"tableName"`
 	Records   []tokenizeRecordReq `json:"records"`
+	BYOT      string              `json:"byot,omitempty"` // ENABLE or ENABLE_STRICT; omitted when disabled
 }
 
 type tokenizeRecordReq struct {
-	Data map[string]string `json:"data"`
+	Data   map[string]string `json:"data"`
+	Tokens map[string]string `json:"tokens,omitempty"` // caller-provided tokens by column (BYOT)
 }
 
 type tokenizeResponse struct {
@@ -156,126 +743,471 @@ type tokenizeResponse struct {
 }
 
 type tokenizeRecordResp struct {
-	Tokens map[string][]tokenEntry `json:"tokens"`
+	Tokens       map[string][]tokenEntry `json:"tokens"`
+	Fields       map[string]interface{}  `json:"fields,omitempty"` // record values, on /v2/records/get only
+	Error        string                  `json:"error,omitempty"`
+	HTTPCode     int                     `json:"httpCode,omitempty"`
+	RequestIndex *int                    `json:"requestIndex,omitempty"`
+}
+
+// lookupRequest fetches existing records by column value, with tokens, for
+// SKYFLOW_ON_CONFLICT=resolve. The response has the tokenizeResponse shape,
+// each record carrying its column value under fields; records are matched to
+// values by it, not by position.
+type lookupRequest struct {
+	VaultID      string   `json:"vaultID"`
+	TableName    string   `json:"tableName"`
+	ColumnName   string   `json:"columnName"`
+	ColumnValues []string `json:"columnValues"`
+	ReturnTokens bool     `json:"returnTokens"`
 }
 
 type tokenEntry struct {
 	Token string `json:"token"`
 }
 
-// Tokenize sends values to Skyflow for tokenization.
+// Tokenize sends values to Skyflow for tokenization. Rows are
+// [idx, arg1, ..., argN]; argument k is inserted into column k of Columns
+// (ColumnName when the row has a single argument). A row's arguments share
+// one insert record, so a multi-column row costs one record, not N. With
+// BYOT, rows are [idx, value] or [idx, value, token] instead.
 func (sc *SkyflowClient) Tokenize(ctx context.Context, rows [][]interface{}) ([][]interface{}, *SkyflowMetrics, error) {
-	result := make([][]interface{}, len(rows))
+	if sc.singleRow(rows) && sc.cfg.BYOT == "" {
+		if column, ok := sc.columnFor(1, 0); ok {
+			return sc.tokenizeSingle(ctx, rows[0], column)
+		}
+	}
 	metrics := &SkyflowMetrics{TotalRows: len(rows)}
+	input := rows
+	var byot []string
+	if sc.cfg.BYOT != "" {
+		rows, byot = byotRows(rows)
+	}
+	out := newRowAssembler(rows)
 
-	// Extract row indices and values
+	// Extract (row, argument) values
 	items := make([]indexedValue, 0, len(rows))
+	records := 0
 	for i, row := range rows {
-		if len(row) < 2 {
-			result[i] = []interface{}{i, "ERROR: missing value"}
-			continue
+		recordColumns := make(map[string]bool, len(row)-1)
+		for k := 1; k < len(row); k++ {
+			if row[k] == nil {
+				// SQL NULL tokenizes to NULL; the rowAssembler slot is already nil.
+				metrics.NullRows++
+				continue
+			}
+			column, ok := sc.columnFor(len(row)-1, k-1)
+			if !ok {
+				out.set(i, k-1, fmt.Sprintf("ERROR: no column configured for argument %d", k))
+				continue
+			}
+			value := argString(row[k])
+			if errVal, ok := sc.checkValueSize(value); !ok {
+				metrics.Oversized++
+				out.set(i, k-1, errVal)
+				continue
+			}
+			var token string
+			if byot != nil {
+				errVal, ok := sc.checkBYOT(input[i], byot[i])
+				if !ok {
+					out.set(i, k-1, errVal)
+					continue
+				}
+				token = byot[i]
+			}
+			// A column listed twice can't share a record with itself.
+			if len(recordColumns) == 0 || recordColumns[column] {
+				clear(recordColumns)
+				records++
+			}
+			recordColumns[column] = true
+			items = append(items, indexedValue{
+				origIdx:  i,
+				argIdx:   k - 1,
+				rowIndex: row[0],
+				column:   column,
+				value:    value,
+				token:    token,
+				record:   records,
+			})
 		}
-		items = append(items, indexedValue{
-			origIdx:  i,
-			rowIndex: row[0],
-			value:    fmt.Sprintf("%v", row[1]),
-		})
 	}
 
-	metrics.UniqueTokens = len(items) // no dedup for tokenize
-	metrics.DedupPct = 0
+	slots := len(items)
+	var copies []valueCopy
+	if sc.cfg.TokenizeDedup {
+		items, copies = dedupValues(items)
+	}
+	metrics.UniqueTokens = len(items)
+	if slots > 0 {
+		metrics.DedupPct = 100.0 * (1.0 - float64(len(items))/float64(slots))
+	}
 
 	// Split into sub-batches
-	batches := splitIndexedValues(items, sc.cfg.BatchSize)
+	if sc.cfg.SortBeforeBatch {
+		// Sort whole records by their first value so a record's items stay together.
+		first := make(map[int]string, records)
+		for _, item := range items {
+			if _, ok := first[item.record]; !ok {
+				first[item.record] = item.value
+			}
+		}
+		sort.SliceStable(items, func(i, j int) bool {
+			a, b := items[i], items[j]
+			if first[a.record] != first[b.record] {
+				return first[a.record] < first[b.record]
+			}
+			return a.record < b.record
+		})
+	}
+	metrics.BatchSize = sc.subBatchSize()
+	batches := splitRecords(items, metrics.BatchSize, sc.cfg.MaxRequestBytes)
 	metrics.SkyflowCalls = len(batches)
 
 	// Process concurrently, collecting per-call latencies
-	sem := make(chan struct{}, sc.cfg.MaxConcurrency)
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-	callLatencies := make([]int64, 0, len(batches))
-
-	skyflowStart := time.Now()
-
-	for _, batch := range batches {
-		wg.Add(1)
-		go func(batch []indexedValue) {
-			defer wg.Done()
-			sem <- struct{}{}
-			defer func() { <-sem }()
-
-			callStart := time.Now()
-			tokens, err := sc.tokenizeBatch(ctx, batch)
-			callMs := time.Since(callStart).Milliseconds()
-
-			mu.Lock()
-			defer mu.Unlock()
-			callLatencies = append(callLatencies, callMs)
+	batchRows := func(i int) int { return len(batches[i]) }
+	expired, skipped := sc.fanOut(ctx, "tokenize", metrics, len(batches), batchRows, func(ctx context.Context, i int) (func(), error) {
+		batch := batches[i]
+		tokens, err := sc.tokenizeBatch(ctx, batch)
+		return func() {
 			if err != nil {
-				metrics.Errors++
 				for _, item := range batch {
-					result[item.origIdx] = []interface{}{item.rowIndex, fmt.Sprintf("ERROR: %v", err)}
+					out.set(item.origIdx, item.argIdx, fmt.Sprintf("ERROR: %v", err))
 				}
 				return
 			}
 			for j, item := range batch {
-				result[item.origIdx] = []interface{}{item.rowIndex, tokens[j]}
+				out.set(item.origIdx, item.argIdx, tokens[j])
 			}
-		}(batch)
+		}, err
+	})
+	for _, i := range expired {
+		for _, item := range batches[i] {
+			out.set(item.origIdx, item.argIdx, errDeadlineValue)
+		}
+	}
+	for _, i := range skipped {
+		for _, item := range batches[i] {
+			out.set(item.origIdx, item.argIdx, errDeadlineExceededValue)
+		}
+	}
+	for _, c := range copies {
+		out.set(c.origIdx, c.argIdx, out.get(c.from.origIdx, c.from.argIdx))
 	}
-	wg.Wait()
 
-	metrics.SkyflowWallMs = time.Since(skyflowStart).Milliseconds()
-	computeLatencyStats(metrics, callLatencies)
+	return out.rows(), metrics, nil
+}
+
+// valueCopy is a tokenize slot whose value was deduplicated into from; it
+// gets from's result, token or error alike.
+type valueCopy struct {
+	origIdx, argIdx int
+	from            indexedValue
+}
+
+// dedupValues keeps the first item for each (column, value, token) and
+// returns the rest as copies. Kept items stay in their records, so a record
+// only loses columns and never gains a second value for one.
+func dedupValues(items []indexedValue) ([]indexedValue, []valueCopy) {
+	type key struct{ column, value, token string }
+	first := make(map[key]indexedValue, len(items))
+	unique := make([]indexedValue, 0, len(items))
+	var copies []valueCopy
+	for _, item := range items {
+		k := key{item.column, item.value, item.token}
+		if from, ok := first[k]; ok {
+			copies = append(copies, valueCopy{origIdx: item.origIdx, argIdx: item.argIdx, from: from})
+			continue
+		}
+		first[k] = item
+		unique = append(unique, item)
+	}
+	return unique, copies
+}
+
+// checkValueSize reports whether value fits MaxValueBytes, returning the
+// row's error value when it doesn't.
+func (sc *SkyflowClient) checkValueSize(value string) (string, bool) {
+	if sc.cfg.MaxValueBytes <= 0 || len(value) <= sc.cfg.MaxValueBytes {
+		return "", true
+	}
+	return fmt.Sprintf("ERROR: value is %d bytes, over the %d byte limit", len(value), sc.cfg.MaxValueBytes), false
+}
+
+// byotRows splits BYOT rows [idx, value, token] into [idx, value] rows and
+// the tokens they carry ("" for none). Longer rows keep only their value and
+// are rejected by checkBYOT.
+func byotRows(rows [][]interface{}) ([][]interface{}, []string) {
+	values := make([][]interface{}, len(rows))
+	tokens := make([]string, len(rows))
+	for i, row := range rows {
+		values[i] = row
+		if len(row) > 2 {
+			values[i] = row[:2]
+			if row[2] != nil {
+				tokens[i] = argString(row[2])
+			}
+		}
+	}
+	return values, tokens
+}
+
+// checkBYOT reports whether a BYOT row's token (from byotRows) suits the
+// SKYFLOW_BYOT mode, returning the row's error value when it doesn't.
+func (sc *SkyflowClient) checkBYOT(row []interface{}, token string) (string, bool) {
+	switch {
+	case len(row) > 3:
+		return fmt.Sprintf("ERROR: SKYFLOW_BYOT rows are [idx, value, token], got %d arguments", len(row)-1), false
+	case token == "" && sc.cfg.BYOT == "ENABLE_STRICT":
+		return "ERROR: SKYFLOW_BYOT=ENABLE_STRICT needs a token for every value", false
+	}
+	return "", true
+}
 
-	return result, metrics, nil
+// columnFor returns the vault column for argument k of an nArgs-argument row.
+func (sc *SkyflowClient) columnFor(nArgs, k int) (string, bool) {
+	if k < len(sc.cfg.Columns) {
+		return sc.cfg.Columns[k], true
+	}
+	if nArgs == 1 && len(sc.cfg.Columns) == 0 {
+		return sc.cfg.ColumnName, true
+	}
+	return "", false
 }
 
+// tokenizeBatch inserts one record per run of items sharing a record number
+// and returns the tokens in item order, with an "ERROR: ..." value for items
+// whose record Skyflow failed individually. By default it assumes Skyflow
+// answers records in request order, as the v2 insert API does today;
+// InsertOrder "request_index" matches them by echoed index instead.
 func (sc *SkyflowClient) tokenizeBatch(ctx context.Context, items []indexedValue) ([]string, error) {
-	records := make([]tokenizeRecordReq, len(items))
-	for i, item := range items {
-		records[i] = tokenizeRecordReq{
-			Data: map[string]string{sc.cfg.ColumnName: item.value},
+	groups := groupRecords(items)
+	records := make([]tokenizeRecordReq, len(groups))
+	for i, group := range groups {
+		data := make(map[string]string, len(group))
+		var tokens map[string]string
+		for _, item := range group {
+			data[item.column] = item.value
+			if item.token != "" {
+				if tokens == nil {
+					tokens = make(map[string]string, len(group))
+				}
+				tokens[item.column] = item.token
+			}
 		}
+		records[i] = tokenizeRecordReq{Data: data, Tokens: tokens}
 	}
 
 	body := tokenizeRequest{
 		VaultID:   sc.cfg.VaultID,
 		TableName: sc.cfg.TableName,
 		Records:   records,
+		BYOT:      sc.cfg.BYOT,
 	}
 
-	respBody, err := sc.doWithRetry(ctx, sc.cfg.DataPlaneURL+"/v2/records/insert", body)
+	respBody, err := sc.doWithRetry(ctx, sc.endpoint("/v2/records/insert"), body, false)
+	var se *statusError
+	if errors.As(err, &se) && se.code == http.StatusConflict && sc.cfg.OnConflict == "resolve" {
+		// The whole insert was rejected; every value may already exist.
+		return sc.resolveTokens(ctx, items)
+	}
 	if err != nil {
-		return nil, err
+		return nil, sc.callError(ctx, err)
 	}
 
 	var resp tokenizeResponse
-	if err := json.Unmarshal(respBody, &resp); err != nil {
+	if err := profileJSON("tokenize_unmarshal", func() error { return codec.Unmarshal(respBody, &resp) }); err != nil {
 		return nil, fmt.Errorf("tokenize: unmarshal response: %w", err)
 	}
 
-	if len(resp.Records) != len(items) {
-		return nil, fmt.Errorf("tokenize: expected %d records, got %d", len(items), len(resp.Records))
+	if len(resp.Records) != len(groups) {
+		return nil, fmt.Errorf("tokenize: expected %d records, got %d", len(groups), len(resp.Records))
+	}
+	if sc.cfg.InsertOrder == "request_index" {
+		if resp.Records, err = orderByRequestIndex(resp.Records); err != nil {
+			return nil, err
+		}
 	}
 
 	tokens := make([]string, len(items))
+	var conflicted []int
+	pos := 0
 	for i, rec := range resp.Records {
-		entries, ok := rec.Tokens[sc.cfg.ColumnName]
-		if !ok || len(entries) == 0 {
-			return nil, fmt.Errorf("tokenize: no token for column %q in record %d", sc.cfg.ColumnName, i)
+		group := groups[i]
+		if rec.HTTPCode == http.StatusConflict {
+			if sc.cfg.OnConflict != "resolve" {
+				return nil, fmt.Errorf("tokenize: record %d conflicts with an existing record: %s", i, rec.Error)
+			}
+			for j := range group {
+				conflicted = append(conflicted, pos+j)
+			}
+			pos += len(group)
+			continue
+		}
+		// A failed record fails only its own rows; the rest of the batch stands.
+		failed := recordFailure(rec.Error, rec.HTTPCode)
+		for _, item := range group {
+			entries := columnTokens(rec.Tokens, item.column)
+			switch {
+			case failed != "":
+				tokens[pos] = failed
+				countersFrom(ctx).failed.Add(1)
+			case len(entries) == 0:
+				tokens[pos] = fmt.Sprintf("ERROR: no token for column %q", item.column)
+				countersFrom(ctx).failed.Add(1)
+			default:
+				tokens[pos] = entries[0].Token
+			}
+			pos++
+		}
+	}
+
+	if len(conflicted) > 0 {
+		existing := make([]indexedValue, len(conflicted))
+		for j, i := range conflicted {
+			existing[j] = items[i]
+		}
+		resolved, err := sc.resolveTokens(ctx, existing)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range conflicted {
+			tokens[i] = resolved[j]
+		}
+	}
+
+	return tokens, nil
+}
+
+// orderByRequestIndex puts insert response records back in request order by
+// their echoed requestIndex. Every record must carry a distinct in-range
+// index; anything less fails the sub-batch rather than risk pairing a token
+// with the wrong value.
+func orderByRequestIndex(records []tokenizeRecordResp) ([]tokenizeRecordResp, error) {
+	ordered := make([]tokenizeRecordResp, len(records))
+	filled := make([]bool, len(records))
+	for i, rec := range records {
+		if rec.RequestIndex == nil {
+			return nil, fmt.Errorf("tokenize: record %d has no requestIndex", i)
+		}
+		idx := *rec.RequestIndex
+		if idx < 0 || idx >= len(records) || filled[idx] {
+			return nil, fmt.Errorf("tokenize: record %d has invalid or duplicate requestIndex %d", i, idx)
+		}
+		ordered[idx], filled[idx] = rec, true
+	}
+	return ordered, nil
+}
+
+// columnTokens returns the token entries for column, falling back to a
+// case-insensitive match for vaults that echo column names in a different
+// case than requested. The fallback is logged once per column pair so the
+// configured name can be fixed.
+func columnTokens(tokens map[string][]tokenEntry, column string) []tokenEntry {
+	if entries, ok := tokens[column]; ok {
+		return entries
+	}
+	for key, entries := range tokens {
+		if strings.EqualFold(key, column) {
+			if _, warned := caseFallbackWarned.LoadOrStore(column+"\x00"+key, true); !warned {
+				log.Printf("WARN: Skyflow returned tokens for column %q, not %q; matching case-insensitively, fix the configured column name",
+					key, column)
+			}
+			return entries
+		}
+	}
+	return nil
+}
+
+// columnField returns a lookup record's value for column, matching the name
+// case-insensitively like columnTokens.
+func columnField(fields map[string]interface{}, column string) (string, bool) {
+	v, ok := fields[column]
+	if !ok {
+		for key, fv := range fields {
+			if strings.EqualFold(key, column) {
+				v, ok = fv, true
+				break
+			}
+		}
+	}
+	if !ok || v == nil {
+		return "", false
+	}
+	if s, isString := v.(string); isString {
+		return s, true
+	}
+	return fmt.Sprint(v), true
+}
+
+// caseFallbackWarned records the column pairs columnTokens has warned about.
+var caseFallbackWarned sync.Map
+
+// resolveTokens looks up the tokens of records that already hold items'
+// values, one lookup per column, for inserts rejected as conflicts.
+func (sc *SkyflowClient) resolveTokens(ctx context.Context, items []indexedValue) ([]string, error) {
+	byColumn := make(map[string][]int)
+	var columns []string
+	for i, item := range items {
+		if _, ok := byColumn[item.column]; !ok {
+			columns = append(columns, item.column)
 		}
-		tokens[i] = entries[0].Token
+		byColumn[item.column] = append(byColumn[item.column], i)
 	}
 
+	tokens := make([]string, len(items))
+	var resolved int64
+	for _, column := range columns {
+		positions := byColumn[column]
+		body := lookupRequest{
+			VaultID:      sc.cfg.VaultID,
+			TableName:    sc.cfg.TableName,
+			ColumnName:   column,
+			ColumnValues: make([]string, len(positions)),
+			ReturnTokens: true,
+		}
+		for j, i := range positions {
+			body.ColumnValues[j] = items[i].value
+		}
+
+		respBody, err := sc.doWithRetry(ctx, sc.endpoint("/v2/records/get"), body, true)
+		if err != nil {
+			return nil, fmt.Errorf("tokenize: resolve conflict: %w", sc.callError(ctx, err))
+		}
+		var resp tokenizeResponse
+		if err := codec.Unmarshal(respBody, &resp); err != nil {
+			return nil, fmt.Errorf("tokenize: resolve conflict: unmarshal response: %w", err)
+		}
+		byValue := make(map[string]string, len(resp.Records))
+		for _, rec := range resp.Records {
+			value, ok := columnField(rec.Fields, column)
+			if entries := columnTokens(rec.Tokens, column); ok && len(entries) > 0 {
+				byValue[value] = entries[0].Token
+			}
+		}
+		// A value with no matching record fails only its own rows.
+		for _, i := range positions {
+			if token, ok := byValue[items[i].value]; ok {
+				tokens[i] = token
+				resolved++
+				continue
+			}
+			tokens[i] = fmt.Sprintf("ERROR: conflict: no existing record found for column %q", column)
+			countersFrom(ctx).failed.Add(1)
+		}
+	}
+	countersFrom(ctx).resolved.Add(resolved)
 	return tokens, nil
 }
 
 // --- Detokenize ---
 
 type detokenizeRequest struct {
-	VaultID string   `json:"vaultID"`
-	Tokens  []string `json:"tokens"`
+	VaultID         string   `json:"vaultID"`
+	Tokens          []string `json:"tokens"`
+	Redaction       string   `json:"redaction,omitempty"`
+	ContinueOnError bool     `json:"continueOnError,omitempty"`
 }
 
 type detokenizeResponse struct {
@@ -283,180 +1215,1009 @@ type detokenizeResponse struct {
 }
 
 type detokenizeEntry struct {
-	Token string `json:"token"`
-	Value string `json:"value"`
+	Token    string          `json:"token"`
+	Value    json.RawMessage `json:"value"` // any JSON type; see decodeValue
+	Error    string          `json:"error,omitempty"`
+	HTTPCode int             `json:"httpCode,omitempty"`
+}
+
+// deleted reports whether Skyflow marked the entry's record as deleted: a
+// per-token 410 Gone, or an error message saying so.
+func (e detokenizeEntry) deleted() bool {
+	return e.HTTPCode == http.StatusGone || strings.Contains(strings.ToLower(e.Error), "deleted")
 }
 
 // Detokenize sends tokens to Skyflow for detokenization with deduplication.
+// Rows are [idx, token1, ..., tokenN]; tokens are deduplicated across all
+// argument positions.
 func (sc *SkyflowClient) Detokenize(ctx context.Context, rows [][]interface{}) ([][]interface{}, *SkyflowMetrics, error) {
-	result := make([][]interface{}, len(rows))
+	if sc.singleRow(rows) {
+		return sc.detokenizeSingle(ctx, rows[0])
+	}
 	metrics := &SkyflowMetrics{TotalRows: len(rows)}
+	out := newRowAssembler(rows)
 
-	// Build dedup map: token → list of (origIdx, rowIndex)
+	// Build dedup map: token → list of (origIdx, argIdx)
 	type rowRef struct {
-		origIdx  int
-		rowIndex interface{}
+		origIdx int
+		argIdx  int
 	}
 	tokenMap := make(map[string][]rowRef)
 	var orderedTokens []string
+	slots := 0
 
 	for i, row := range rows {
 		if len(row) < 2 {
-			result[i] = []interface{}{i, "ERROR: missing value"}
-			continue
+			continue // no token; answered errMissingValue and not a dedup slot
 		}
-		token := fmt.Sprintf("%v", row[1])
-		refs := tokenMap[token]
-		if len(refs) == 0 {
-			orderedTokens = append(orderedTokens, token)
+		for k := 1; k < len(row); k++ {
+			if row[k] == nil {
+				metrics.NullRows++
+				continue
+			}
+			if row[k] == "" {
+				metrics.EmptyTokens++
+				out.set(i, k-1, sc.emptyTokenValue())
+				continue
+			}
+			slots++
+			token := argString(row[k])
+			refs := tokenMap[token]
+			if len(refs) == 0 {
+				orderedTokens = append(orderedTokens, token)
+			}
+			tokenMap[token] = append(refs, rowRef{origIdx: i, argIdx: k - 1})
 		}
-		tokenMap[token] = append(refs, rowRef{origIdx: i, rowIndex: row[0]})
 	}
 
 	metrics.UniqueTokens = len(orderedTokens)
-	if len(rows) > 0 {
-		metrics.DedupPct = 100.0 * (1.0 - float64(len(orderedTokens))/float64(len(rows)))
+	if slots > 0 {
+		metrics.DedupPct = 100.0 * (1.0 - float64(len(orderedTokens))/float64(slots))
+	}
+	if requestOptionsFrom(ctx).Debug {
+		counts := make(map[string]int, len(tokenMap))
+		for token, refs := range tokenMap {
+			counts[token] = len(refs)
+		}
+		metrics.TopDuplicates = topDuplicates(counts, debugTopN)
+	}
+
+	// Answer cached tokens; only the misses go to Skyflow
+	valueMap := newResolvedValues(len(orderedTokens))
+	if sc.cache != nil {
+		misses := orderedTokens[:0]
+		for _, tok := range orderedTokens {
+			if v, ok := sc.cache.get(sc.cacheKey(tok)); ok {
+				valueMap.set(tok, v)
+				metrics.CacheHits++
+				continue
+			}
+			misses = append(misses, tok)
+		}
+		orderedTokens = misses
 	}
 
 	// Split unique tokens into sub-batches
-	batches := splitStrings(orderedTokens, sc.cfg.BatchSize)
+	if sc.cfg.SortBeforeBatch {
+		sort.Strings(orderedTokens)
+	}
+	metrics.BatchSize = sc.subBatchSize()
+	batches := splitStrings(orderedTokens, metrics.BatchSize, sc.cfg.MaxRequestBytes)
 	metrics.SkyflowCalls = len(batches)
 
 	// Process concurrently, collecting per-call latencies
-	sem := make(chan struct{}, sc.cfg.MaxConcurrency)
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-	valueMap := make(map[string]string, len(orderedTokens))
-	callLatencies := make([]int64, 0, len(batches))
-
-	skyflowStart := time.Now()
-
-	for _, batch := range batches {
-		wg.Add(1)
-		go func(batch []string) {
-			defer wg.Done()
-			sem <- struct{}{}
-			defer func() { <-sem }()
-
-			callStart := time.Now()
-			values, err := sc.detokenizeBatch(ctx, batch)
-			callMs := time.Since(callStart).Milliseconds()
-
-			mu.Lock()
-			defer mu.Unlock()
-			callLatencies = append(callLatencies, callMs)
+	// A unique token serves every row slot that carried it.
+	batchRows := func(i int) int {
+		n := 0
+		for _, tok := range batches[i] {
+			n += len(tokenMap[tok])
+		}
+		return n
+	}
+	expired, skipped := sc.fanOut(ctx, "detokenize", metrics, len(batches), batchRows, func(ctx context.Context, i int) (func(), error) {
+		batch := batches[i]
+		values, deleted, err := sc.detokenizeBatch(ctx, batch)
+		return func() {
+			metrics.DeletedTokens += deleted
 			if err != nil {
-				metrics.Errors++
 				for _, tok := range batch {
-					valueMap[tok] = fmt.Sprintf("ERROR: %v", err)
+					valueMap.set(tok, fmt.Sprintf("ERROR: %v", err))
 				}
 				return
 			}
-			for i, tok := range batch {
-				valueMap[tok] = values[i]
+			for j, tok := range batch {
+				valueMap.set(tok, values[j])
+				sc.cacheValue(tok, values[j])
 			}
-		}(batch)
+		}, err
+	})
+	for _, i := range expired {
+		for _, tok := range batches[i] {
+			valueMap.set(tok, errDeadlineValue)
+		}
+	}
+	for _, i := range skipped {
+		for _, tok := range batches[i] {
+			valueMap.set(tok, errDeadlineExceededValue)
+		}
 	}
-	wg.Wait()
 
-	metrics.SkyflowWallMs = time.Since(skyflowStart).Milliseconds()
-	computeLatencyStats(metrics, callLatencies)
+	metrics.ValueConflicts = valueMap.conflicts
 
 	// Fan results back to all original row indexes
 	for token, refs := range tokenMap {
-		val := valueMap[token]
+		val := valueMap.values[token]
 		for _, ref := range refs {
-			result[ref.origIdx] = []interface{}{ref.rowIndex, val}
+			out.set(ref.origIdx, ref.argIdx, val)
 		}
 	}
 
-	return result, metrics, nil
+	return out.rows(), metrics, nil
 }
 
-func (sc *SkyflowClient) detokenizeBatch(ctx context.Context, tokens []string) ([]string, error) {
-	body := detokenizeRequest{
-		VaultID: sc.cfg.VaultID,
-		Tokens:  tokens,
-	}
+// resolvedValues maps each unique token to its detokenized value. Every token
+// belongs to exactly one sub-batch, so a second, different resolution means a
+// bug in a retry or coalescing path; set keeps the first value, logs, and
+// counts the conflict rather than letting the last write win silently.
+type resolvedValues struct {
+	values    map[string]interface{}
+	conflicts int
+}
 
-	respBody, err := sc.doWithRetry(ctx, sc.cfg.DataPlaneURL+"/v2/tokens/detokenize", body)
+func newResolvedValues(n int) *resolvedValues {
+	return &resolvedValues{values: make(map[string]interface{}, n)}
+}
+
+func (r *resolvedValues) set(token string, v interface{}) {
+	prev, ok := r.values[token]
+	if !ok {
+		r.values[token] = v
+		return
+	}
+	if !reflect.DeepEqual(prev, v) {
+		r.conflicts++
+		log.Printf("WARN: token %s resolved twice with different values, keeping the first",
+			truncate(token, 16))
+	}
+}
+
+// cacheKey is the detokenize cache key for token. The redaction level is part
+// of it, since the same token detokenizes differently at each level.
+func (sc *SkyflowClient) cacheKey(token string) string {
+	return sc.cfg.Redaction + "\x00" + token
+}
+
+// cacheKeyToken returns the token part of a cacheKey.
+func cacheKeyToken(key string) string {
+	_, token, _ := strings.Cut(key, "\x00")
+	return token
+}
+
+// cacheValue caches a detokenized value; per-token errors are not cached.
+func (sc *SkyflowClient) cacheValue(token string, v interface{}) {
+	if sc.cache != nil && !isErrorValue(v) {
+		sc.cache.put(sc.cacheKey(token), v)
+	}
+}
+
+// emptyTokenValue is the detokenize result for an empty-string token.
+func (sc *SkyflowClient) emptyTokenValue() interface{} {
+	if sc.cfg.EmptyTokens == "empty" {
+		return ""
+	}
+	return nil
+}
+
+// detokenizeBatch returns the values for tokens, with DeletedTokenSentinel in
+// place of deleted records and "ERROR: ..." for tokens Skyflow failed
+// individually, and how many records were deleted.
+func (sc *SkyflowClient) detokenizeBatch(ctx context.Context, tokens []string) ([]interface{}, int, error) {
+	body := detokenizeRequest{
+		VaultID:         sc.cfg.VaultID,
+		Tokens:          tokens,
+		Redaction:       sc.cfg.Redaction,
+		ContinueOnError: sc.cfg.ContinueOnError,
+	}
+
+	respBody, err := sc.doWithRetry(ctx, sc.endpoint("/v2/tokens/detokenize"), body, true)
 	if err != nil {
-		return nil, err
+		return nil, 0, sc.callError(ctx, err)
 	}
 
 	var resp detokenizeResponse
-	if err := json.Unmarshal(respBody, &resp); err != nil {
-		return nil, fmt.Errorf("detokenize: unmarshal response: %w", err)
+	if err := profileJSON("detokenize_unmarshal", func() error { return codec.Unmarshal(respBody, &resp) }); err != nil {
+		return nil, 0, fmt.Errorf("detokenize: unmarshal response: %w", err)
 	}
 
-	if len(resp.Response) != len(tokens) {
-		return nil, fmt.Errorf("detokenize: expected %d entries, got %d", len(tokens), len(resp.Response))
+	entries := resp.Response
+	if len(entries) != len(tokens) {
+		if entries = entriesByToken(tokens, entries); entries == nil {
+			return nil, 0, fmt.Errorf("detokenize: expected %d entries, got %d", len(tokens), len(resp.Response))
+		}
 	}
 
-	values := make([]string, len(tokens))
-	for i, entry := range resp.Response {
-		values[i] = entry.Value
+	values := make([]interface{}, len(tokens))
+	deleted := 0
+	for i, entry := range entries {
+		if entry.deleted() {
+			values[i] = sc.cfg.DeletedTokenSentinel
+			deleted++
+			continue
+		}
+		if failed := recordFailure(entry.Error, entry.HTTPCode); failed != "" {
+			values[i] = failed
+			countersFrom(ctx).failed.Add(1)
+			continue
+		}
+		v, err := sc.decodeValue(entry.Value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("detokenize: value %d: %w", i, err)
+		}
+		values[i] = v
 	}
 
-	return values, nil
+	return values, deleted, nil
 }
 
-// --- HTTP helpers ---
+// entriesByToken matches a detokenize response that is short (or long) by
+// the token each entry echoes, so one missing entry fails only its own row.
+// Tokens without an entry get an error entry. It returns nil when no entry
+// matches, leaving the whole sub-batch to fail as before.
+func entriesByToken(tokens []string, entries []detokenizeEntry) []detokenizeEntry {
+	byToken := make(map[string]detokenizeEntry, len(entries))
+	for _, e := range entries {
+		if _, dup := byToken[e.Token]; !dup {
+			byToken[e.Token] = e
+		}
+	}
+	matched := make([]detokenizeEntry, len(tokens))
+	found := 0
+	for i, tok := range tokens {
+		e, ok := byToken[tok]
+		if !ok {
+			matched[i] = detokenizeEntry{Token: tok, Error: "no entry for token in response"}
+			continue
+		}
+		matched[i] = e
+		found++
+	}
+	if found == 0 {
+		return nil
+	}
+	return matched
+}
 
-func (sc *SkyflowClient) doWithRetry(ctx context.Context, url string, body interface{}) ([]byte, error) {
-	respBody, statusCode, err := sc.doPost(ctx, url, body)
+// recordFailure returns the row value for a response record or entry that
+// Skyflow failed individually, or "" if it succeeded.
+func recordFailure(msg string, httpCode int) string {
+	switch {
+	case msg != "":
+		return "ERROR: " + msg
+	case httpCode >= 400:
+		return fmt.Sprintf("ERROR: skyflow returned %d for this value", httpCode)
+	}
+	return ""
+}
+
+// --- Fan-out ---
+
+// errDeadlineValue is written to rows whose sub-batch did not complete.
+const errDeadlineValue = "ERROR: deadline"
+
+// errDeadlineExceededValue is written to rows whose sub-batch was never
+// started because the invocation's deadline (less DeadlineMargin) had passed.
+const errDeadlineExceededValue = "ERROR: deadline exceeded"
+
+// batchAggregator collects sub-batch outcomes from concurrent fan-out
+// goroutines. Everything they share while results come in lives here, behind
+// one mutex, so new per-invocation state has an obvious home.
+type batchAggregator struct {
+	mu        sync.Mutex
+	completed []bool
+	skipped   []bool
+	latencies []int64
+	batchMs   []int64 // latency by sub-batch index, for completed sub-batches
+	errors    int
+	closed    bool
+}
+
+func newBatchAggregator(n int) *batchAggregator {
+	return &batchAggregator{
+		completed: make([]bool, n),
+		skipped:   make([]bool, n),
+		latencies: make([]int64, 0, n),
+		batchMs:   make([]int64, n),
+	}
+}
+
+// record stores the outcome of sub-batch i and runs apply under the lock. Once
+// the aggregator is closed, results are dropped and record returns false.
+func (a *batchAggregator) record(i int, latencyMs int64, err error, apply func()) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return false
+	}
+	a.completed[i] = true
+	a.latencies = append(a.latencies, latencyMs)
+	a.batchMs[i] = latencyMs
 	if err != nil {
+		a.errors++
+	}
+	apply()
+	return true
+}
+
+// skip marks sub-batch i as never started. It is a no-op once closed.
+func (a *batchAggregator) skip(i int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.closed {
+		a.skipped[i] = true
+	}
+}
+
+// close stops accepting results and returns the recorded latencies, the
+// error count, the indexes of sub-batches that never completed, and those of
+// sub-batches that were skipped.
+func (a *batchAggregator) close() (latencies []int64, errCount int, pending, skipped []int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	for i, ok := range a.completed {
+		switch {
+		case a.skipped[i]:
+			skipped = append(skipped, i)
+		case !ok:
+			pending = append(pending, i)
+		}
+	}
+	return a.latencies, a.errors, pending, skipped
+}
+
+// fanOut runs work for each of n sub-batches with at most MaxConcurrency in
+// flight (or the entity's share of the scheduler budget, if one is set),
+// starting them in index order as slots free up. work
+// makes the Skyflow call without holding any lock and returns an apply func
+// that writes its results; apply runs under the aggregator's lock, so it may
+// touch state shared with other sub-batches. Per-call latencies and errors
+// are recorded into metrics.
+//
+// fanOut returns the indexes of sub-batches that did not complete: those
+// still running at PartialDeadline (with PartialResults) are expired, and
+// those that never started because ctx was done, or its deadline was within
+// the operation's deadline margin, are skipped and counted as errors. Late
+// results from either are discarded.
+//
+// In debug mode, rows (when non-nil) gives the number of rows each sub-batch
+// serves, and fanOut tallies them against RowSLA into RowsWithinSLA and
+// RowsOverSLA; rows of sub-batches that never completed count as over.
+func (sc *SkyflowClient) fanOut(ctx context.Context, operation string, metrics *SkyflowMetrics, n int, rows func(i int) int, work func(ctx context.Context, i int) (func(), error)) (expired, skipped []int) {
+	ctx, cancel := sc.withDeadlineMargin(ctx, operation)
+	defer cancel()
+	counters := &callCounters{}
+	ctx = withCallCounters(ctx, counters)
+
+	limit := sc.cfg.MaxConcurrency
+	if sc.scheduler != nil {
+		sc.scheduler.enqueue(sc.cfg.Entity, n)
+		limit = sc.scheduler.allocate(sc.cfg.Entity)
+	}
+	if sc.saturation != nil {
+		limit, metrics.CPUSaturated = sc.saturation.limit(limit)
+	}
+	if sc.errorRamp != nil {
+		limit, metrics.ErrorRatePct = sc.errorRamp.limit(limit)
+	}
+	metrics.Concurrency = limit
+	slots := limit // usable concurrency, for ConcurrencyEfficiency
+	var aimd *aimdLimiter
+	if sc.adaptive != nil {
+		aimd = sc.adaptive.begin(limit)
+		limit, _ = aimd.current()
+	}
+
+	sem := newFairSemaphore(limit)
+	var wg sync.WaitGroup
+	agg := newBatchAggregator(n)
+
+	skyflowStart := time.Now()
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		ticket := sem.ticket() // taken here so sub-batches start in index order
+		go func(i int) {
+			defer wg.Done()
+			if sc.scheduler != nil {
+				defer sc.scheduler.dequeue(sc.cfg.Entity)
+			}
+			if sem.wait(ctx, ticket) != nil {
+				agg.skip(i)
+				return
+			}
+			defer sem.release()
+			if ctx.Err() != nil {
+				agg.skip(i)
+				return
+			}
+
+			callStart := time.Now()
+			callCtx, callCancel := sc.withCallTimeout(ctx)
+			apply, err := work(callCtx, i)
+			callCancel()
+			callMs := sc.callMs(callStart, err)
+			if sc.scheduler != nil {
+				sc.scheduler.observe(sc.cfg.Entity, callMs)
+			}
+			if aimd != nil {
+				sem.resize(aimd.observe(callMs, err != nil))
+			}
+			agg.record(i, callMs, err, apply)
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	if sc.cfg.PartialResults {
+		timer := time.NewTimer(sc.cfg.PartialDeadline)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+		}
+	} else {
+		<-done
+	}
+
+	callLatencies, errCount, expired, skipped := agg.close()
+	if sc.batches != nil {
+		sc.batches.observe(callLatencies)
+	}
+	if sc.errorRamp != nil {
+		sc.errorRamp.observe(len(callLatencies), errCount)
+	}
+	if aimd != nil {
+		sc.adaptive.finish(aimd)
+		metrics.FinalConcurrency, slots = aimd.current()
+	}
+
+	metrics.SkyflowWallMs = time.Since(skyflowStart).Milliseconds()
+	computeLatencyStats(metrics, callLatencies)
+	metrics.CallLatencies = callLatencies
+	metrics.ConcurrencyEfficiency = concurrencyEfficiency(callLatencies, metrics.SkyflowWallMs, slots)
+	metrics.BreakerState = sc.breaker.currentState()
+	metrics.Errors += errCount + len(skipped)
+	metrics.ExpiredBatches = len(expired)
+	counters.copyTo(metrics)
+	if rows != nil && requestOptionsFrom(ctx).Debug {
+		for i, done := range agg.completed {
+			sc.tallySLA(metrics, done, agg.batchMs[i], rows(i))
+		}
+	}
+	return expired, skipped
+}
+
+// errCallTimeout is the cause of a call context that ran past CallTimeout.
+var errCallTimeout = errors.New("skyflow call timed out")
+
+// withCallTimeout returns ctx bounded by CallTimeout, when one is set.
+func (sc *SkyflowClient) withCallTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if sc.cfg.CallTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, sc.cfg.CallTimeout, errCallTimeout)
+}
+
+// callError returns err, or, if the call failed because its CallTimeout
+// ran out, an error that says so instead of the transport's message.
+func (sc *SkyflowClient) callError(ctx context.Context, err error) error {
+	if err != nil && context.Cause(ctx) == errCallTimeout {
+		return fmt.Errorf("%w after %v", errCallTimeout, sc.cfg.CallTimeout)
+	}
+	return err
+}
+
+// callMs is the latency recorded for a call that started at start: the
+// elapsed time, or CallTimeout itself for a call that timed out.
+func (sc *SkyflowClient) callMs(start time.Time, err error) int64 {
+	if errors.Is(err, errCallTimeout) {
+		return sc.cfg.CallTimeout.Milliseconds()
+	}
+	return time.Since(start).Milliseconds()
+}
+
+// deadlineMargin returns how long before the invocation's deadline Skyflow
+// calls for operation are stopped.
+func (sc *SkyflowClient) deadlineMargin(operation string) time.Duration {
+	margin := sc.cfg.DetokenizeDeadlineMargin
+	if operation == "tokenize" {
+		margin = sc.cfg.TokenizeDeadlineMargin
+	}
+	if margin > 0 {
+		return margin
+	}
+	return sc.cfg.DeadlineMargin
+}
+
+// withDeadlineMargin returns a cancellable ctx that also ends the operation's
+// deadline margin before ctx's own deadline, if it has one. Every attempt and
+// retry backoff under it stops there.
+func (sc *SkyflowClient) withDeadlineMargin(ctx context.Context, operation string) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		if margin := sc.deadlineMargin(operation); margin > 0 {
+			return context.WithDeadline(ctx, deadline.Add(-margin))
+		}
+	}
+	return context.WithCancel(ctx)
+}
+
+// tallySLA adds a sub-batch's rows to RowsWithinSLA or RowsOverSLA.
+func (sc *SkyflowClient) tallySLA(metrics *SkyflowMetrics, completed bool, latencyMs int64, rows int) {
+	if completed && time.Duration(latencyMs)*time.Millisecond <= sc.cfg.RowSLA {
+		metrics.RowsWithinSLA += rows
+	} else {
+		metrics.RowsOverSLA += rows
+	}
+}
+
+// decodeValue turns a detokenized JSON value into a response cell. Strings
+// come back as Go strings and JSON null as nil; an absent value is "" as before.
+// Other types (numbers, booleans, objects) are passed through verbatim as
+// json.RawMessage, so they reach Snowflake with their JSON type and exact
+// digits, unless ValueTypes is "string", which returns their JSON text.
+func (sc *SkyflowClient) decodeValue(raw json.RawMessage) (interface{}, error) {
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case len(raw) == 0:
+		return "", nil
+	case bytes.Equal(raw, []byte("null")):
+		return nil, nil
+	case raw[0] == '"':
+		var s string
+		if err := codec.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case sc.cfg.ValueTypes == "string":
+		return string(raw), nil
+	}
+	return raw, nil
+}
+
+// subBatchSize is the adaptive size when SKYFLOW_TARGET_P95_MS is set, else
+// the configured BatchSize.
+func (sc *SkyflowClient) subBatchSize() int {
+	if sc.batches != nil {
+		return sc.batches.current()
+	}
+	return sc.cfg.BatchSize
+}
+
+// --- Single-row fast path ---
+
+// singleRow reports whether rows can take the single-row fast path.
+func (sc *SkyflowClient) singleRow(rows [][]interface{}) bool {
+	return sc.cfg.SingleRowFastPath && len(rows) == 1 && len(rows[0]) == 2 && rows[0][1] != nil && rows[0][1] != "" &&
+		sc.scheduler == nil && !sc.cfg.PartialResults
+}
+
+// callOnce runs one Skyflow call inline and fills metrics the way fanOut
+// does for a single sub-batch.
+func (sc *SkyflowClient) callOnce(ctx context.Context, operation string, metrics *SkyflowMetrics, call func(ctx context.Context) error) {
+	ctx, cancel := sc.withDeadlineMargin(ctx, operation)
+	defer cancel()
+	counters := &callCounters{}
+	ctx = withCallCounters(ctx, counters)
+	metrics.Concurrency = sc.cfg.MaxConcurrency
+	metrics.SkyflowCalls = 1
+
+	start := time.Now()
+	callCtx, callCancel := sc.withCallTimeout(ctx)
+	err := call(callCtx)
+	callCancel()
+	callMs := sc.callMs(start, err)
+
+	metrics.SkyflowWallMs = callMs
+	computeLatencyStats(metrics, []int64{callMs})
+	metrics.CallLatencies = []int64{callMs}
+	metrics.ConcurrencyEfficiency = concurrencyEfficiency([]int64{callMs}, callMs, metrics.Concurrency)
+	metrics.BreakerState = sc.breaker.currentState()
+	if err != nil {
+		metrics.Errors++
+	}
+	if sc.errorRamp != nil {
+		sc.errorRamp.observe(1, metrics.Errors)
+		metrics.ErrorRatePct = sc.errorRamp.ratePct()
+	}
+	counters.copyTo(metrics)
+	if requestOptionsFrom(ctx).Debug {
+		sc.tallySLA(metrics, true, callMs, 1)
+	}
+}
+
+func (sc *SkyflowClient) tokenizeSingle(ctx context.Context, row []interface{}, column string) ([][]interface{}, *SkyflowMetrics, error) {
+	metrics := &SkyflowMetrics{TotalRows: 1, UniqueTokens: 1, BatchSize: sc.subBatchSize()}
+	item := indexedValue{rowIndex: row[0], column: column, value: argString(row[1])}
+	if errVal, ok := sc.checkValueSize(item.value); !ok {
+		metrics.UniqueTokens = 0
+		metrics.Oversized = 1
+		return [][]interface{}{{row[0], errVal}}, metrics, nil
+	}
+	var val interface{}
+	sc.callOnce(ctx, "tokenize", metrics, func(ctx context.Context) error {
+		tokens, err := sc.tokenizeBatch(ctx, []indexedValue{item})
+		if err != nil {
+			val = fmt.Sprintf("ERROR: %v", err)
+			return err
+		}
+		val = tokens[0]
+		return nil
+	})
+	return [][]interface{}{{row[0], val}}, metrics, nil
+}
+
+func (sc *SkyflowClient) detokenizeSingle(ctx context.Context, row []interface{}) ([][]interface{}, *SkyflowMetrics, error) {
+	metrics := &SkyflowMetrics{TotalRows: 1, UniqueTokens: 1, BatchSize: sc.subBatchSize()}
+	token := argString(row[1])
+	if v, ok := sc.cache.get(sc.cacheKey(token)); ok {
+		metrics.CacheHits = 1
+		return [][]interface{}{{row[0], v}}, metrics, nil
+	}
+	var val interface{}
+	sc.callOnce(ctx, "detokenize", metrics, func(ctx context.Context) error {
+		values, deleted, err := sc.detokenizeBatch(ctx, []string{token})
+		metrics.DeletedTokens = deleted
+		if err != nil {
+			val = fmt.Sprintf("ERROR: %v", err)
+			return err
+		}
+		val = values[0]
+		sc.cacheValue(token, val)
+		return nil
+	})
+	return [][]interface{}{{row[0], val}}, metrics, nil
+}
+
+// --- HTTP helpers ---
+
+// doWithRetry POSTs body to url through the circuit breaker, if any: while it
+// is open the call fails immediately with errCircuitOpen.
+func (sc *SkyflowClient) doWithRetry(ctx context.Context, url string, body interface{}, idempotent bool) ([]byte, error) {
+	if sc.breaker == nil {
+		return sc.postWithRetry(ctx, url, body, idempotent)
+	}
+	if err := sc.breaker.allow(); err != nil {
 		return nil, err
 	}
+	respBody, err := sc.postWithRetry(ctx, url, body, idempotent)
+	sc.breaker.record(outcomeOf(ctx, err))
+	return respBody, err
+}
 
-	if statusCode >= 500 || statusCode == 429 {
-		log.Printf("WARN: Skyflow returned %d, retrying after 500ms...", statusCode)
-		time.Sleep(500 * time.Millisecond)
+// postWithRetry POSTs body to url, retrying transport errors and 5xx/429
+// responses up to RetryMaxAttempts total attempts, pausing between them as
+// the Backoff strategy says. Unless the request is idempotent, only transport
+// errors raised before it was sent are retried: an insert whose connection
+// dropped mid-flight may already have created records.
+func (sc *SkyflowClient) postWithRetry(ctx context.Context, url string, body interface{}, idempotent bool) ([]byte, error) {
+	maxAttempts := max(sc.cfg.RetryMaxAttempts, 1)
+	policy := newBackoffPolicy(sc.cfg.Backoff, sc.cfg.RetryBackoff, sc.cfg.RetryBackoffMax, nil)
+
+	var respBody []byte
+	var statusCode int
+	var err error
+	var pause time.Duration
+	for attempt := 1; ; attempt++ {
 		respBody, statusCode, err = sc.doPost(ctx, url, body)
 		if err != nil {
+			var te *transportError
+			if !errors.As(err, &te) || (!idempotent && !unsent(err)) || attempt >= maxAttempts || ctx.Err() != nil {
+				return nil, err
+			}
+			pause = policy.delay(attempt, pause)
+			log.Printf("WARN: %v, retrying after %v (attempt %d/%d)...", err, pause, attempt+1, maxAttempts)
+			countersFrom(ctx).retries.Add(1)
+			if err := sleepCtx(ctx, pause); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		n503 := sc.observeStatus(statusCode)
+		if _, ok := sc.maintenanceBackoff(n503); ok {
+			countersFrom(ctx).maintenance.Store(true)
+		}
+		empty := sc.cfg.RetryEmptyResponse && isEmptyResponse(statusCode, respBody)
+		if (!empty && statusCode < 500 && statusCode != 429) || attempt >= maxAttempts {
+			break
+		}
+		detail := ""
+		if empty {
+			detail = " with an empty body"
+		}
+		pause = policy.delay(attempt, pause)
+		backoff := pause
+		if wait, ok := sc.maintenanceBackoff(n503); ok {
+			backoff = wait
+			detail = " (maintenance window suspected)"
+		}
+		log.Printf("WARN: Skyflow returned %d%s, retrying after %v (attempt %d/%d)...",
+			statusCode, detail, backoff, attempt+1, maxAttempts)
+		countersFrom(ctx).retries.Add(1)
+		if err := sleepCtx(ctx, backoff); err != nil {
 			return nil, err
 		}
 	}
 
 	if statusCode < 200 || statusCode >= 300 {
-		return nil, fmt.Errorf("skyflow API returned %d: %s", statusCode, truncate(string(respBody), 200))
+		return nil, &statusError{code: statusCode, body: describeBody(respBody)}
+	}
+	if isNonJSON(respBody) {
+		return nil, fmt.Errorf("skyflow API returned %d with %s", statusCode, describeBody(respBody))
+	}
+	if sc.cfg.RetryEmptyResponse && isEmptyResponse(statusCode, respBody) {
+		return nil, fmt.Errorf("skyflow API returned %d with an empty body after %d attempts", statusCode, maxAttempts)
 	}
 
 	return respBody, nil
 }
 
+// observeStatus updates the consecutive-503 streak and returns its length.
+func (sc *SkyflowClient) observeStatus(statusCode int) int64 {
+	if sc.consecutive503 == nil {
+		return 0
+	}
+	if statusCode != http.StatusServiceUnavailable {
+		sc.consecutive503.Store(0)
+		return 0
+	}
+	return sc.consecutive503.Add(1)
+}
+
+// maintenanceBackoff returns the wait before retrying after the n-th
+// consecutive 503, and whether the maintenance window is engaged.
+func (sc *SkyflowClient) maintenanceBackoff(n int64) (time.Duration, bool) {
+	threshold := int64(sc.cfg.MaintenanceThreshold)
+	if threshold <= 0 || n < threshold {
+		return 0, false
+	}
+	wait := sc.cfg.MaintenanceBackoff
+	for i := threshold; i < n && wait < sc.cfg.MaintenanceBackoffMax; i++ {
+		wait *= 2
+	}
+	return min(wait, sc.cfg.MaintenanceBackoffMax), true
+}
+
+// isEmptyResponse reports whether a 2xx response lost its body. 204 No
+// Content is legitimately empty; a body cut off mid-read never gets here
+// because doPost reports it as a transportError.
+func isEmptyResponse(statusCode int, body []byte) bool {
+	return statusCode >= 200 && statusCode < 300 && statusCode != http.StatusNoContent &&
+		len(bytes.TrimSpace(body)) == 0
+}
+
+// isNonJSON reports whether body is markup rather than JSON: the error page
+// of a proxy, WAF or gateway in front of Skyflow. A JSON body never starts
+// with '<'.
+func isNonJSON(body []byte) bool {
+	body = bytes.TrimSpace(body)
+	return len(body) > 0 && body[0] == '<'
+}
+
+// describeBody returns a truncated body for error messages, naming markup
+// for what it likely is so a gateway misconfiguration is obvious from the
+// row error instead of surfacing as a JSON syntax error.
+func describeBody(body []byte) string {
+	if !isNonJSON(body) {
+		return truncate(string(body), 200)
+	}
+	snippet := strings.Join(strings.Fields(string(body)), " ")
+	return "received non-JSON response (likely a proxy/WAF page): " + truncate(snippet, 200)
+}
+
+// statusError is a non-2xx response that was not (or no longer) retried.
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("skyflow API returned %d: %s", e.code, e.body)
+}
+
+// transportError is a failure to get a complete HTTP response, including a
+// request body only partly written before the connection failed. doPost
+// marshals the body and builds a fresh request every call, never reusing a
+// consumed body, so idempotent requests are safe to retry.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string { return "skyflow request: " + e.err.Error() }
+func (e *transportError) Unwrap() error { return e.err }
+
+// unsent reports whether err was raised before any of the request was
+// written: a failed dial, such as a refused connection.
+func unsent(err error) bool {
+	var opErr *net.OpError
+	return (errors.As(err, &opErr) && opErr.Op == "dial") || errors.Is(err, syscall.ECONNREFUSED)
+}
+
 func (sc *SkyflowClient) doPost(ctx context.Context, url string, body interface{}) ([]byte, int, error) {
-	jsonBody, err := json.Marshal(body)
+	var jsonBody []byte
+	err := profileJSON("request_marshal", func() (err error) {
+		jsonBody, err = codec.Marshal(body)
+		return err
+	})
 	if err != nil {
 		return nil, 0, fmt.Errorf("marshal request: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonBody))
+	// Large bodies go out gzipped; the HMAC signature covers the bytes sent.
+	wireBody := jsonBody
+	gzipped := sc.cfg.Compression == "gzip" && len(jsonBody) >= sc.cfg.CompressMinBytes
+	if gzipped {
+		if wireBody, err = gzipBytes(jsonBody); err != nil {
+			return nil, 0, fmt.Errorf("compress request: %w", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(wireBody))
 	if err != nil {
 		return nil, 0, fmt.Errorf("create request: %w", err)
 	}
+	key := sc.cfg.APIKey
+	if sc.bearer != nil {
+		if key, err = sc.bearer.get(ctx); err != nil {
+			return nil, 0, fmt.Errorf("service account token: %w", err)
+		}
+	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+sc.cfg.APIKey)
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if sc.cfg.Compression == "gzip" {
+		// Asking explicitly turns off the transport's own transparent
+		// decompression, so gzipped responses are inflated below.
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
 	if sc.cfg.AccountID != "" {
 		req.Header.Set("X-Skyflow-Account-Id", sc.cfg.AccountID)
 	}
+	if bc := requestOptionsFrom(ctx).BenchConfig; bc != "" {
+		req.Header.Set(benchConfigHeader, bc)
+	}
+	if sc.cfg.HMACSecret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(sc.cfg.HMACTimestampHeader, ts)
+		req.Header.Set(sc.cfg.HMACSignatureHeader, signRequest(sc.cfg.HMACSecret, ts, wireBody))
+	}
+
+	if sc.hosts != nil {
+		release, err := sc.hosts.acquire(ctx, req.URL.Host)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer release()
+	}
+
+	var trace *callTrace
+	if requestOptionsFrom(ctx).Trace {
+		trace = newCallTrace()
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+	}
 
 	resp, err := sc.client.Do(req)
 	if err != nil {
-		return nil, 0, fmt.Errorf("skyflow request: %w", err)
+		return nil, 0, &transportError{err: err}
 	}
 	defer resp.Body.Close()
+	if trace != nil {
+		defer trace.finish(req, resp.StatusCode, countersFrom(ctx))
+	}
+	if resp.StatusCode == http.StatusUnauthorized && sc.bearer != nil {
+		sc.bearer.invalidate(key)
+	}
 
-	respBody, err := io.ReadAll(resp.Body)
+	var respReader io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, resp.StatusCode, &transportError{err: fmt.Errorf("read gzip response: %w", err)}
+		}
+		respReader = zr
+	}
+	respBody, err := io.ReadAll(respReader)
 	if err != nil {
-		return nil, resp.StatusCode, fmt.Errorf("read response: %w", err)
+		// A short read (e.g. fewer bytes than Content-Length, or a truncated
+		// gzip stream) means the response was cut off in transit; retry it
+		// like a dropped connection.
+		return nil, resp.StatusCode, &transportError{err: fmt.Errorf("read response: %w", err)}
 	}
 
 	return respBody, resp.StatusCode, nil
 }
 
+// gzipBytes returns b gzip-compressed.
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// signRequest returns the hex HMAC-SHA256 of "<timestamp>.<body>" under secret.
+func signRequest(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 // --- Utility ---
 
+// endpoint returns the data plane URL for path.
+func (sc *SkyflowClient) endpoint(path string) string {
+	return joinURL(sc.cfg.DataPlaneURL, path)
+}
+
+// joinURL joins base and path with exactly one slash between them.
+func joinURL(base, path string) string {
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+// argString renders a row argument, as decoded from Snowflake's JSON, as the
+// string sent to Skyflow. Strings pass through byte for byte, whatever quotes,
+// backslashes or control characters they hold; JSON escaping is left to the
+// encoder. Numbers are written in plain decimal, not %v's exponent form
+// (123456789 would otherwise become "1.23456789e+08"), and OBJECT or ARRAY
+// arguments as their compact JSON text rather than Go's map[...] syntax.
+func argString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		if b, err := codec.Marshal(v); err == nil {
+			return string(b)
+		}
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// jsonProfiling (PROFILE_JSON=1) logs allocation deltas around JSON encoding
+// and decoding of Skyflow payloads. Diagnostic only: ReadMemStats stops the
+// world, and with concurrent sub-batches the deltas include other goroutines'
+// allocations, so treat the numbers as approximate.
+var jsonProfiling = envBool("PROFILE_JSON")
+
+// profileJSON runs fn, logging the bytes and objects it allocated when
+// jsonProfiling is on.
+func profileJSON(op string, fn func() error) error {
+	if !jsonProfiling {
+		return fn()
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	log.Printf("PROFILE json op=%s alloc_bytes=%d allocs=%d duration_us=%d",
+		op, after.TotalAlloc-before.TotalAlloc, after.Mallocs-before.Mallocs, elapsed.Microseconds())
+	return err
+}
+
 func computeLatencyStats(m *SkyflowMetrics, latencies []int64) {
 	if len(latencies) == 0 {
 		return
@@ -474,38 +2235,199 @@ func computeLatencyStats(m *SkyflowMetrics, latencies []int64) {
 		}
 	}
 	m.CallAvgMs = sum / int64(len(latencies))
+
+	sorted := append([]int64(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	m.CallP50Ms = percentile(sorted, 50)
+	m.CallP95Ms = percentile(sorted, 95)
+	m.CallP99Ms = percentile(sorted, 99)
+}
+
+// concurrencyEfficiency is the fraction of the fan-out's concurrency slots
+// kept busy over its wall time: summed call latency / (wall × slots). Slots
+// are capped at the number of calls, since three calls can't use ten slots;
+// near 1.0 every usable slot was busy throughout, while low values mean the
+// semaphore or a slow straggler left slots idle. It is 0 when the wall time
+// rounds to 0 ms.
+func concurrencyEfficiency(latencies []int64, wallMs int64, concurrency int) float64 {
+	slots := min(concurrency, len(latencies))
+	if wallMs <= 0 || slots <= 0 {
+		return 0
+	}
+	var sum int64
+	for _, l := range latencies {
+		sum += l
+	}
+	return float64(sum) / float64(wallMs*int64(slots))
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted latencies:
+// the smallest sample with at least p% of samples at or below it, with no
+// interpolation. It is always an observed latency, and for small counts the
+// high percentiles are simply the maximum (p95 and p99 of 1–19 calls both
+// equal the slowest call).
+func percentile(sorted []int64, p int) int64 {
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	return sorted[max(rank, 1)-1]
 }
 
 type indexedValue struct {
 	origIdx  int
+	argIdx   int // argument position within the row (0 = first after idx)
 	rowIndex interface{}
+	column   string
 	value    string
+	token    string // caller-provided token (BYOT); "" lets Skyflow mint one
+	record   int    // items with the same record number share one insert record
+}
+
+// errMissingValue answers rows that carry no argument, in both modes.
+const errMissingValue = "ERROR: missing value"
+
+// rowAssembler collects per-argument results and renders them as Snowflake
+// rows: [idx, value] for single-argument rows, [idx, [v1, ..., vN]] for
+// multi-argument rows, and [idx, errMissingValue] for rows with no
+// arguments (the row's position if it has no index either).
+type rowAssembler struct {
+	input  [][]interface{}
+	values [][]interface{}
+}
+
+func newRowAssembler(rows [][]interface{}) *rowAssembler {
+	values := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		if len(row) >= 2 {
+			values[i] = make([]interface{}, len(row)-1)
+		}
+	}
+	return &rowAssembler{input: rows, values: values}
 }
 
-func splitIndexedValues(items []indexedValue, size int) [][]indexedValue {
+func (a *rowAssembler) set(origIdx, argIdx int, v interface{}) {
+	a.values[origIdx][argIdx] = v
+}
+
+func (a *rowAssembler) get(origIdx, argIdx int) interface{} {
+	return a.values[origIdx][argIdx]
+}
+
+func (a *rowAssembler) rows() [][]interface{} {
+	result := make([][]interface{}, len(a.input))
+	for i, row := range a.input {
+		switch {
+		case len(row) < 2:
+			result[i] = []interface{}{rowIndex(row, i), errMissingValue}
+		case len(row) == 2:
+			result[i] = []interface{}{row[0], a.values[i][0]}
+		default:
+			result[i] = []interface{}{row[0], a.values[i]}
+		}
+	}
+	return result
+}
+
+// groupRecords splits items into runs that share a record number.
+func groupRecords(items []indexedValue) [][]indexedValue {
+	var groups [][]indexedValue
+	for i := 0; i < len(items); {
+		end := i + 1
+		for end < len(items) && items[end].record == items[i].record {
+			end++
+		}
+		groups = append(groups, items[i:end])
+		i = end
+	}
+	return groups
+}
+
+// splitRecords splits items into batches of at most size records, never
+// splitting a record across batches. With maxBytes > 0 a batch also ends
+// before its estimated request size would pass maxBytes.
+func splitRecords(items []indexedValue, size, maxBytes int) [][]indexedValue {
 	var batches [][]indexedValue
-	for i := 0; i < len(items); i += size {
-		end := i + size
-		if end > len(items) {
-			end = len(items)
+	records, n, bytes := 0, 0, 0
+	for _, g := range groupRecords(items) {
+		b := recordBytes(g)
+		if records == size || records > 0 && maxBytes > 0 && bytes+b > maxBytes {
+			batches = append(batches, items[:n:n])
+			items = items[n:]
+			records, n, bytes = 0, 0, 0
 		}
-		batches = append(batches, items[i:end])
+		records++
+		n += len(g)
+		bytes += b
+	}
+	if n > 0 {
+		batches = append(batches, items[:n:n])
 	}
 	return batches
 }
 
-func splitStrings(items []string, size int) [][]string {
+// splitStrings splits tokens into batches of at most size, ending a batch
+// early, with maxBytes > 0, before its estimated request size passes maxBytes.
+func splitStrings(items []string, size, maxBytes int) [][]string {
 	var batches [][]string
-	for i := 0; i < len(items); i += size {
-		end := i + size
-		if end > len(items) {
-			end = len(items)
+	start, bytes := 0, 0
+	for i, item := range items {
+		b := len(item) + 3 // quotes and comma
+		if i-start == size || i > start && maxBytes > 0 && bytes+b > maxBytes {
+			batches = append(batches, items[start:i])
+			start, bytes = i, 0
 		}
-		batches = append(batches, items[i:end])
+		bytes += b
+	}
+	if start < len(items) {
+		batches = append(batches, items[start:])
 	}
 	return batches
 }
 
+// recordBytes estimates the JSON size of an insert record: {"data":{...}}
+// with a "column":"value" pair per item.
+func recordBytes(record []indexedValue) int {
+	n := len(`{"data":{}},`)
+	for _, item := range record {
+		n += len(item.column) + len(item.value) + len(`"":"",`)
+		if item.token != "" {
+			n += len(item.column) + len(item.token) + len(`"tokens":{"":""},`)
+		}
+	}
+	return n
+}
+
+// topDuplicates returns up to n tokens that occur more than once, most
+// frequent first (ties broken by token for stable output).
+func topDuplicates(counts map[string]int, n int) []tokenCount {
+	var dups []tokenCount
+	for token, c := range counts {
+		if c > 1 {
+			dups = append(dups, tokenCount{Token: token, Count: c})
+		}
+	}
+	sort.Slice(dups, func(i, j int) bool {
+		if dups[i].Count != dups[j].Count {
+			return dups[i].Count > dups[j].Count
+		}
+		return dups[i].Token < dups[j].Token
+	})
+	if len(dups) > n {
+		dups = dups[:n]
+	}
+	return dups
+}
+
+// sleepCtx sleeps for d, returning early with ctx's error if it is done first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func truncate(s string, maxLen int) string {
 	if len(s) <= maxLen {
 		return s
@@ -1,12 +1,83 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+// fakeVault stands in for the Skyflow v2 API: insert returns "tok_<value>"
+// and detokenize strips the prefix back off.
+func fakeVault(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v2/records/insert":
+		var req tokenizeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var resp tokenizeResponse
+		for _, rec := range req.Records {
+			tokens := make(map[string][]tokenEntry, len(rec.Data))
+			for col, val := range rec.Data {
+				tokens[col] = []tokenEntry{{Token: "tok_" + val}}
+			}
+			resp.Records = append(resp.Records, tokenizeRecordResp{Tokens: tokens})
+		}
+		json.NewEncoder(w).Encode(resp)
+	case "/v2/tokens/detokenize":
+		var req detokenizeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var resp detokenizeResponse
+		for _, tok := range req.Tokens {
+			resp.Response = append(resp.Response, detokenizeEntry{Token: tok, Value: jsonString(strings.TrimPrefix(tok, "tok_"))})
+		}
+		json.NewEncoder(w).Encode(resp)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestClient returns a client pointed at srv with small, test-friendly settings.
+func newTestClient(srv *httptest.Server) *SkyflowClient {
+	return NewSkyflowClient(SkyflowConfig{
+		DataPlaneURL:   srv.URL,
+		APIKey:         "test-key",
+		VaultID:        "vault",
+		TableName:      "table1",
+		ColumnName:     "name",
+		BatchSize:      2,
+		MaxConcurrency: 4,
+	})
+}
+
+// jsonString encodes s as a JSON string value.
+func jsonString(s string) json.RawMessage {
+	b, _ := json.Marshal(s)
+	return b
+}
+
 // Run with real Skyflow credentials:
 //
 //	SKYFLOW_DATA_PLANE_URL=https://lgrkinpzqtda.skyvault.skyflowapis.com \
@@ -74,3 +145,2095 @@ func TestSkyflowRoundTrip(t *testing.T) {
 
 	t.Log("Round-trip verified!")
 }
+
+func TestDetokenizeTopDuplicates(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(fakeVault))
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	// Skewed batch: tok_a x4, tok_b x2, tok_c x1
+	rows := [][]interface{}{
+		{0, "tok_a"}, {1, "tok_b"}, {2, "tok_a"}, {3, "tok_c"},
+		{4, "tok_a"}, {5, "tok_b"}, {6, "tok_a"},
+	}
+
+	_, metrics, err := client.Detokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	if metrics.TopDuplicates != nil {
+		t.Errorf("TopDuplicates populated without debug: %v", metrics.TopDuplicates)
+	}
+
+	ctx := withRequestOptions(context.Background(), requestOptions{Debug: true})
+	_, metrics, err = client.Detokenize(ctx, rows)
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	want := []tokenCount{{Token: "tok_a", Count: 4}, {Token: "tok_b", Count: 2}}
+	if !reflect.DeepEqual(metrics.TopDuplicates, want) {
+		t.Errorf("TopDuplicates = %v, want %v", metrics.TopDuplicates, want)
+	}
+	if got := formatTokenCounts(metrics.TopDuplicates); got != "tok_a:4,tok_b:2" {
+		t.Errorf("formatTokenCounts = %q", got)
+	}
+}
+
+func TestMultiArgumentRows(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(fakeVault))
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	rows := [][]interface{}{
+		{0, "tok_a"},
+		{1, "tok_a", "tok_b"},
+		{2, "tok_b", "tok_c", "tok_a"},
+	}
+	got, metrics, err := client.Detokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	want := [][]interface{}{
+		{0, "a"},
+		{1, []interface{}{"a", "b"}},
+		{2, []interface{}{"b", "c", "a"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Detokenize = %v, want %v", got, want)
+	}
+	// 6 argument values, 3 unique tokens
+	if metrics.UniqueTokens != 3 || metrics.DedupPct != 50 {
+		t.Errorf("UniqueTokens = %d, DedupPct = %.1f, want 3, 50.0", metrics.UniqueTokens, metrics.DedupPct)
+	}
+
+	tok := client.withColumns([]string{"first_name", "last_name"})
+	got, _, err = tok.Tokenize(context.Background(), [][]interface{}{
+		{0, "Alice", "Smith"},
+		{1, "Bob", "Jones", "extra"},
+	})
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	want = [][]interface{}{
+		{0, []interface{}{"tok_Alice", "tok_Smith"}},
+		{1, []interface{}{"tok_Bob", "tok_Jones", "ERROR: no column configured for argument 3"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Tokenize = %v, want %v", got, want)
+	}
+}
+
+func TestComputeLatencyPercentiles(t *testing.T) {
+	var m SkyflowMetrics
+	computeLatencyStats(&m, []int64{50, 10, 40, 20, 30, 100, 60, 70, 80, 90})
+	if m.CallP50Ms != 50 || m.CallP95Ms != 100 || m.CallMinMs != 10 || m.CallAvgMs != 55 {
+		t.Errorf("p50=%d p95=%d min=%d avg=%d, want 50/100/10/55", m.CallP50Ms, m.CallP95Ms, m.CallMinMs, m.CallAvgMs)
+	}
+	computeLatencyStats(&m, []int64{7})
+	if m.CallP50Ms != 7 || m.CallP95Ms != 7 || m.CallP99Ms != 7 {
+		t.Errorf("single sample: p50=%d p95=%d p99=%d", m.CallP50Ms, m.CallP95Ms, m.CallP99Ms)
+	}
+	computeLatencyStats(&m, []int64{30, 10, 20})
+	if m.CallP50Ms != 20 || m.CallP95Ms != 30 || m.CallP99Ms != 30 {
+		t.Errorf("three samples: p50=%d p95=%d p99=%d, want 20/30/30", m.CallP50Ms, m.CallP95Ms, m.CallP99Ms)
+	}
+	latencies := make([]int64, 200)
+	for i := range latencies {
+		latencies[i] = int64(i + 1)
+	}
+	computeLatencyStats(&m, latencies)
+	if m.CallP95Ms != 190 || m.CallP99Ms != 198 {
+		t.Errorf("200 samples: p95=%d p99=%d, want 190/198", m.CallP95Ms, m.CallP99Ms)
+	}
+}
+
+func TestConcurrencyEfficiency(t *testing.T) {
+	cases := []struct {
+		latencies   []int64
+		wallMs      int64
+		concurrency int
+		want        float64
+	}{
+		{[]int64{100, 100, 100, 100}, 200, 2, 1.0}, // two full waves
+		{[]int64{100, 20}, 100, 4, 0.6},            // one straggler; only 2 usable slots
+		{[]int64{50, 50, 50}, 150, 3, 1.0 / 3},     // calls ran one at a time
+		{[]int64{0}, 0, 1, 0},
+	}
+	for _, c := range cases {
+		if got := concurrencyEfficiency(c.latencies, c.wallMs, c.concurrency); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("concurrencyEfficiency(%v, %d, %d) = %.3f, want %.3f", c.latencies, c.wallMs, c.concurrency, got, c.want)
+		}
+	}
+
+	// Sequential groups are weighted by wall time: 100ms at 1.0 and 300ms at 0.6.
+	dst := &SkyflowMetrics{SkyflowWallMs: 100, ConcurrencyEfficiency: 1.0}
+	mergeMetrics(dst, &SkyflowMetrics{SkyflowWallMs: 300, ConcurrencyEfficiency: 0.6})
+	if math.Abs(dst.ConcurrencyEfficiency-0.7) > 1e-9 {
+		t.Errorf("merged efficiency = %.3f, want 0.700", dst.ConcurrencyEfficiency)
+	}
+}
+
+func TestSingleRowFastPathMatchesGeneral(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := mustReadAll(t, r)
+		if bytes.Contains(body, []byte("bad")) {
+			http.Error(w, "bad token", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	general := newTestClient(srv)
+	fast := newTestClient(srv)
+	fast.cfg.SingleRowFastPath = true
+	if !fast.singleRow([][]interface{}{{0, "x"}}) || general.singleRow([][]interface{}{{0, "x"}}) {
+		t.Fatal("fast path selection wrong")
+	}
+
+	// Timing fields differ run to run; compare everything else.
+	normalize := func(m *SkyflowMetrics) SkyflowMetrics {
+		c := *m
+		c.SkyflowWallMs, c.CallMinMs, c.CallMaxMs, c.CallAvgMs, c.CallP50Ms, c.CallP95Ms, c.CallP99Ms = 0, 0, 0, 0, 0, 0, 0
+		c.ConcurrencyEfficiency = 0
+		c.CallLatencies = nil
+		return c
+	}
+	for _, value := range []string{"tok_a", "bad"} {
+		for _, op := range []string{"tokenize", "detokenize"} {
+			rows := [][]interface{}{{7, value}}
+			wantRows, wantM, _ := runOperation(context.Background(), general, op, rows)
+			gotRows, gotM, _ := runOperation(context.Background(), fast, op, rows)
+			if !reflect.DeepEqual(gotRows, wantRows) {
+				t.Errorf("%s %q: fast rows = %v, general = %v", op, value, gotRows, wantRows)
+			}
+			if len(gotM.CallLatencies) != len(wantM.CallLatencies) {
+				t.Errorf("%s %q: fast CallLatencies = %v, general = %v", op, value, gotM.CallLatencies, wantM.CallLatencies)
+			}
+			if !reflect.DeepEqual(normalize(gotM), normalize(wantM)) {
+				t.Errorf("%s %q: fast metrics = %+v, general = %+v", op, value, *gotM, *wantM)
+			}
+		}
+	}
+}
+
+func TestRowSLATally(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := mustReadAll(t, r)
+		if bytes.Contains(body, []byte("tok_slow")) {
+			time.Sleep(80 * time.Millisecond)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+	client := newTestClient(srv)
+	client.cfg.RowSLA = 40 * time.Millisecond
+
+	// Sub-batches: [tok_a tok_slow] serves 4 rows (tok_slow x3), [tok_b tok_c] 2.
+	rows := [][]interface{}{
+		{0, "tok_a"}, {1, "tok_slow"}, {2, "tok_b"}, {3, "tok_slow"}, {4, "tok_c"}, {5, "tok_slow"},
+	}
+	_, metrics, err := client.Detokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.RowsWithinSLA != 0 || metrics.RowsOverSLA != 0 {
+		t.Errorf("SLA tallied without debug: %d/%d", metrics.RowsWithinSLA, metrics.RowsOverSLA)
+	}
+
+	ctx := withRequestOptions(context.Background(), requestOptions{Debug: true})
+	_, metrics, err = client.Detokenize(ctx, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.RowsWithinSLA != 2 || metrics.RowsOverSLA != 4 {
+		t.Errorf("rows within/over SLA = %d/%d, want 2/4", metrics.RowsWithinSLA, metrics.RowsOverSLA)
+	}
+}
+
+func TestAllMalformedBatch(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	rows := [][]interface{}{{7}, {}, {9}}
+	want := [][]interface{}{{7, "ERROR: missing value"}, {1, "ERROR: missing value"}, {9, "ERROR: missing value"}}
+	for _, op := range []string{"tokenize", "detokenize"} {
+		got, m, err := runOperation(context.Background(), newTestClient(srv), op, rows)
+		if err != nil {
+			t.Fatalf("%s: %v", op, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, want %v", op, got, want)
+		}
+		if m.SkyflowCalls != 0 || m.UniqueTokens != 0 || m.DedupPct != 0 || math.IsNaN(m.ConcurrencyEfficiency) {
+			t.Errorf("%s metrics: calls=%d unique=%d dedup=%v efficiency=%v, want 0s and no NaN",
+				op, m.SkyflowCalls, m.UniqueTokens, m.DedupPct, m.ConcurrencyEfficiency)
+		}
+	}
+	if calls.Load() != 0 {
+		t.Errorf("all-malformed batches made %d Skyflow calls", calls.Load())
+	}
+}
+
+func TestNullArgumentsPassThrough(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body := mustReadAll(t, r)
+		if bytes.Contains(body, []byte("<nil>")) {
+			t.Errorf("NULL sent to Skyflow: %s", body)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+	client := newTestClient(srv).withColumns([]string{"first_name", "last_name"})
+	client.cfg.SingleRowFastPath = true
+
+	got, metrics, err := client.Tokenize(context.Background(), [][]interface{}{{0, "Alice", nil}, {1, nil, nil}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{{0, []interface{}{"tok_Alice", nil}}, {1, []interface{}{nil, nil}}}
+	if !reflect.DeepEqual(got, want) || metrics.NullRows != 3 || metrics.UniqueTokens != 1 {
+		t.Errorf("Tokenize = %v (null_rows=%d unique=%d), want %v (3, 1)", got, metrics.NullRows, metrics.UniqueTokens, want)
+	}
+
+	got, metrics, err = client.Detokenize(context.Background(), [][]interface{}{{0, "tok_a"}, {1, nil}, {2, "tok_a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = [][]interface{}{{0, "a"}, {1, nil}, {2, "a"}}
+	if !reflect.DeepEqual(got, want) || metrics.NullRows != 1 || metrics.DedupPct != 50 {
+		t.Errorf("Detokenize = %v (null_rows=%d dedup=%.1f), want %v (1, 50.0)", got, metrics.NullRows, metrics.DedupPct, want)
+	}
+
+	// A lone NULL row never reaches Skyflow, fast path or not.
+	before := calls.Load()
+	for _, op := range []string{"tokenize", "detokenize"} {
+		got, metrics, _ = runOperation(context.Background(), newTestClient(srv), op, [][]interface{}{{5, nil}})
+		if !reflect.DeepEqual(got, [][]interface{}{{5, nil}}) || metrics.NullRows != 1 || metrics.SkyflowCalls != 0 {
+			t.Errorf("%s single NULL = %v, %+v", op, got, *metrics)
+		}
+	}
+	if calls.Load() != before {
+		t.Errorf("single NULL rows made %d Skyflow calls", calls.Load()-before)
+	}
+}
+
+func TestResolvedValuesDetectsConflicts(t *testing.T) {
+	r := newResolvedValues(2)
+	r.set("tok_a", "alice")
+	r.set("tok_a", "alice") // same value again: not a conflict
+	r.set("tok_b", json.RawMessage(`42`))
+	r.set("tok_b", json.RawMessage(`42`))
+	if r.conflicts != 0 {
+		t.Fatalf("conflicts = %d after consistent resolutions, want 0", r.conflicts)
+	}
+	r.set("tok_a", "mallory")
+	if r.conflicts != 1 || r.values["tok_a"] != "alice" {
+		t.Errorf("conflicts = %d, tok_a = %v; want 1, first value kept", r.conflicts, r.values["tok_a"])
+	}
+}
+
+func TestTopDuplicatesBounded(t *testing.T) {
+	counts := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		counts[fmt.Sprintf("tok_%02d", i)] = i + 2
+	}
+	top := topDuplicates(counts, 3)
+	if len(top) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(top))
+	}
+	if top[0].Token != "tok_49" || top[0].Count != 51 {
+		t.Errorf("top[0] = %+v, want tok_49:51", top[0])
+	}
+}
+
+func TestDetokenizePartialResultsOnDeadline(t *testing.T) {
+	// Tokens prefixed "tok_slow" stall well past the deadline.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req detokenizeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if strings.HasPrefix(req.Tokens[0], "tok_slow") {
+			select {
+			case <-time.After(2 * time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		var resp detokenizeResponse
+		for _, tok := range req.Tokens {
+			resp.Response = append(resp.Response, detokenizeEntry{Token: tok, Value: jsonString(strings.TrimPrefix(tok, "tok_"))})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.BatchSize = 1
+	client.cfg.PartialResults = true
+	client.cfg.PartialDeadline = 100 * time.Millisecond
+
+	rows := [][]interface{}{{0, "tok_a"}, {1, "tok_slow1"}, {2, "tok_b"}, {3, "tok_slow2"}, {4, "tok_a"}}
+
+	start := time.Now()
+	result, metrics, err := client.Detokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Detokenize took %v, expected to return near the 100ms deadline", elapsed)
+	}
+
+	want := []interface{}{"a", errDeadlineValue, "b", errDeadlineValue, "a"}
+	for i, row := range result {
+		if row[0] != rows[i][0] || row[1] != want[i] {
+			t.Errorf("row %d = %v, want [%v %v]", i, row, rows[i][0], want[i])
+		}
+	}
+	if metrics.ExpiredBatches != 2 {
+		t.Errorf("ExpiredBatches = %d, want 2", metrics.ExpiredBatches)
+	}
+}
+
+func TestTCPKeepAliveConfig(t *testing.T) {
+	t.Setenv("SKYFLOW_DATA_PLANE_URL", "https://vault.example.com")
+	t.Setenv("SKYFLOW_VAULT_ID", "vault")
+	t.Setenv("SKYFLOW_API_KEY", "key")
+
+	cfg := loadSkyflowConfigs()["NAME"]
+	if cfg.TCPKeepAlive != 30*time.Second {
+		t.Errorf("default TCPKeepAlive = %v, want 30s", cfg.TCPKeepAlive)
+	}
+
+	t.Setenv("SKYFLOW_TCP_KEEPALIVE_MS", "5000")
+	cfg = loadSkyflowConfigs()["NAME"]
+	if got := newDialer(*cfg).KeepAlive; got != 5*time.Second {
+		t.Errorf("dialer KeepAlive = %v, want 5s", got)
+	}
+}
+
+func TestDataPlaneURLTrailingSlash(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	want := []string{"/v2/records/insert", "/v2/tokens/detokenize"}
+	for _, base := range []string{srv.URL, srv.URL + "/", srv.URL + "//"} {
+		t.Setenv("SKYFLOW_DATA_PLANE_URL", base)
+		t.Setenv("SKYFLOW_VAULT_ID", "vault")
+		t.Setenv("SKYFLOW_API_KEY", "key")
+		cfg := loadSkyflowConfigs()["NAME"]
+		if cfg.DataPlaneURL != srv.URL {
+			t.Errorf("%q loaded as %q, want %q", base, cfg.DataPlaneURL, srv.URL)
+		}
+
+		direct := newTestClient(srv).cfg // built without loadSkyflowConfigs
+		direct.DataPlaneURL = base
+		client := NewSkyflowClient(direct)
+		paths = nil
+		client.Tokenize(context.Background(), [][]interface{}{{0, "a"}})
+		client.Detokenize(context.Background(), [][]interface{}{{0, "tok_a"}})
+		if !reflect.DeepEqual(paths, want) {
+			t.Errorf("%q: requested %v, want %v", base, paths, want)
+		}
+	}
+
+	for _, tc := range []struct{ base, path, want string }{
+		{"https://h", "/v2/x", "https://h/v2/x"},
+		{"https://h/", "/v2/x", "https://h/v2/x"},
+		{"https://h/", "v2/x", "https://h/v2/x"},
+		{"https://h/gw", "/v2/x", "https://h/gw/v2/x"},
+		{"https://h", "/", "https://h/"},
+	} {
+		if got := joinURL(tc.base, tc.path); got != tc.want {
+			t.Errorf("joinURL(%q, %q) = %q, want %q", tc.base, tc.path, got, tc.want)
+		}
+	}
+}
+
+// Baseline allocation benchmarks for a representative 1,000-token sub-batch:
+//
+//	go test -run '^$' -bench JSON -benchmem ./...
+
+// benchTokens returns n distinct UUID-shaped tokens.
+func benchTokens(n int) []string {
+	tokens := make([]string, n)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("tok_%08d-aaaa-bbbb-cccc-%012d", i, i)
+	}
+	return tokens
+}
+
+func BenchmarkJSONMarshalDetokenizeRequest(b *testing.B) {
+	req := detokenizeRequest{VaultID: "vault", Tokens: benchTokens(1000)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONUnmarshalDetokenizeResponse(b *testing.B) {
+	var resp detokenizeResponse
+	for _, tok := range benchTokens(1000) {
+		resp.Response = append(resp.Response, detokenizeEntry{Token: tok, Value: jsonString("Alice Example")})
+	}
+	body, _ := json.Marshal(resp)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		var out detokenizeResponse
+		if err := json.Unmarshal(body, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONMarshalTokenizeRequest(b *testing.B) {
+	req := tokenizeRequest{VaultID: "vault", TableName: "table1"}
+	for range benchTokens(1000) {
+		req.Records = append(req.Records, tokenizeRecordReq{Data: map[string]string{"name": "Alice Example"}})
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPerEntityRetryPolicy(t *testing.T) {
+	var mu sync.Mutex
+	attempts := make(map[string]int) // vault ID → requests seen
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req detokenizeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		attempts[req.VaultID]++
+		mu.Unlock()
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	t.Setenv("SKYFLOW_DATA_PLANE_URL", srv.URL)
+	t.Setenv("SKYFLOW_API_KEY", "key")
+	t.Setenv("SKYFLOW_VAULT_ID_NAME", "vault-name")
+	t.Setenv("SKYFLOW_VAULT_ID_SSN", "vault-ssn")
+	t.Setenv("SKYFLOW_VAULT_ID_EMAIL", "vault-email")
+	t.Setenv("SKYFLOW_RETRY_BACKOFF_MS", "1")
+	t.Setenv("SKYFLOW_RETRY_MAX_ATTEMPTS", "3")
+	t.Setenv("SKYFLOW_RETRY_MAX_ATTEMPTS_NAME", "1")
+	t.Setenv("SKYFLOW_RETRY_MAX_ATTEMPTS_SSN", "5")
+	t.Setenv("SKYFLOW_MAINTENANCE_BACKOFF_MS", "1") // SSN's 5 straight 503s cross the threshold
+	t.Setenv("SKYFLOW_MAINTENANCE_BACKOFF_MAX_MS", "1")
+
+	want := map[string]struct {
+		vault    string
+		attempts int
+	}{
+		"NAME":  {"vault-name", 1},
+		"SSN":   {"vault-ssn", 5},
+		"EMAIL": {"vault-email", 3}, // global fallback
+	}
+
+	configs := loadSkyflowConfigs()
+	for entity, w := range want {
+		client := NewSkyflowClient(*configs[entity])
+		_, metrics, err := client.Detokenize(context.Background(), [][]interface{}{{0, "tok_a"}})
+		if err != nil {
+			t.Fatalf("%s: Detokenize failed: %v", entity, err)
+		}
+		if got := attempts[w.vault]; got != w.attempts {
+			t.Errorf("%s: %d attempts, want %d", entity, got, w.attempts)
+		}
+		if metrics.Retries != w.attempts-1 {
+			t.Errorf("%s: metrics.Retries = %d, want %d", entity, metrics.Retries, w.attempts-1)
+		}
+	}
+}
+
+func TestSustained503EngagesMaintenanceBackoff(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.RetryMaxAttempts = 4
+	client.cfg.RetryBackoff = time.Millisecond
+	client.cfg.MaintenanceThreshold = 2
+	client.cfg.MaintenanceBackoff = 40 * time.Millisecond
+	client.cfg.MaintenanceBackoffMax = 60 * time.Millisecond
+
+	// Waits after 503 #1..#3: plain 1ms, then 40ms, then 80ms capped to 60ms.
+	for n, want := range map[int64]time.Duration{2: 40 * time.Millisecond, 3: 60 * time.Millisecond, 9: 60 * time.Millisecond} {
+		if got, ok := client.maintenanceBackoff(n); !ok || got != want {
+			t.Errorf("maintenanceBackoff(%d) = %v, %v; want %v", n, got, ok, want)
+		}
+	}
+	if _, ok := client.maintenanceBackoff(1); ok {
+		t.Error("maintenance engaged below the threshold")
+	}
+
+	start := time.Now()
+	_, metrics, _ := client.Detokenize(context.Background(), [][]interface{}{{0, "tok_a"}})
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("4 attempts took %v, want the extended backoff (>= 101ms)", elapsed)
+	}
+	if calls.Load() != 4 || !metrics.MaintenanceSuspected {
+		t.Errorf("calls = %d, MaintenanceSuspected = %v; want 4, true", calls.Load(), metrics.MaintenanceSuspected)
+	}
+
+	// The streak persists across requests, and a healthy response ends it.
+	if n := client.observeStatus(http.StatusOK); n != 0 || client.consecutive503.Load() != 0 {
+		t.Errorf("streak after 200 = %d, want 0", client.consecutive503.Load())
+	}
+}
+
+func TestDetokenizeDeletedTokenSentinel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req detokenizeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		var resp detokenizeResponse
+		for _, tok := range req.Tokens {
+			entry := detokenizeEntry{Token: tok, Value: jsonString(strings.TrimPrefix(tok, "tok_"))}
+			if tok == "tok_gone" {
+				entry = detokenizeEntry{Token: tok, Error: "Record deleted", HTTPCode: http.StatusGone}
+			}
+			resp.Response = append(resp.Response, entry)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.DeletedTokenSentinel = "__DELETED__"
+	rows := [][]interface{}{{0, "tok_a"}, {1, "tok_gone"}, {2, "tok_gone"}}
+	got, metrics, err := client.Detokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	want := [][]interface{}{{0, "a"}, {1, "__DELETED__"}, {2, "__DELETED__"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Detokenize = %v, want %v", got, want)
+	}
+	if metrics.DeletedTokens != 1 || metrics.Errors != 0 {
+		t.Errorf("DeletedTokens = %d, Errors = %d; want 1, 0", metrics.DeletedTokens, metrics.Errors)
+	}
+	if isErrorValue(got[1][1]) {
+		t.Error("deleted sentinel classified as an error")
+	}
+}
+
+func TestRetryOnEmptyResponse(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Write([]byte("  \n")) // 200 with the body dropped
+			return
+		}
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.RetryMaxAttempts = 3
+	client.cfg.RetryEmptyResponse = true
+	got, metrics, err := client.Detokenize(context.Background(), [][]interface{}{{0, "tok_a"}})
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	if got[0][1] != "a" {
+		t.Errorf("value = %v, want a", got[0][1])
+	}
+	if calls.Load() != 2 || metrics.Retries != 1 {
+		t.Errorf("calls = %d, retries = %d, want 2, 1", calls.Load(), metrics.Retries)
+	}
+
+	if isEmptyResponse(http.StatusNoContent, nil) {
+		t.Error("204 No Content treated as a dropped body")
+	}
+	if isEmptyResponse(http.StatusOK, []byte(`{"response":[]}`)) {
+		t.Error("empty-but-valid JSON treated as a dropped body")
+	}
+}
+
+func TestNonJSONResponseNamesProxyPage(t *testing.T) {
+	var status atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(int(status.Load()))
+		w.Write([]byte("<!DOCTYPE html>\n<html>\n  <head><title>403 Forbidden</title></head>\n  <body>Request blocked by WAF</body>\n</html>"))
+	}))
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	for _, code := range []int32{http.StatusOK, http.StatusForbidden} {
+		status.Store(code)
+		got, _, _ := client.Detokenize(context.Background(), [][]interface{}{{0, "tok_a"}})
+		msg, _ := got[0][1].(string)
+		if !strings.Contains(msg, "non-JSON response (likely a proxy/WAF page): <!DOCTYPE html> <html> <head><title>403 Forbidden") {
+			t.Errorf("HTTP %d: row = %q, want the proxy page named with a one-line snippet", code, msg)
+		}
+	}
+
+	if describeBody([]byte(`{"error":"bad"}`)) != `{"error":"bad"}` {
+		t.Error("JSON error body described as non-JSON")
+	}
+}
+
+func TestConcurrencyForMemory(t *testing.T) {
+	for memMB, want := range map[int]int{0: 10, 128: 2, 512: 3, 1024: 6, 1769: 10, 3008: 17, 10240: 58} {
+		if got := concurrencyForMemory(memMB); got != want {
+			t.Errorf("concurrencyForMemory(%d) = %d, want %d", memMB, got, want)
+		}
+	}
+
+	t.Setenv("SKYFLOW_DATA_PLANE_URL", "https://vault.example")
+	t.Setenv("SKYFLOW_VAULT_ID", "v")
+	t.Setenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE", "512")
+	if got := loadSkyflowConfigs()["NAME"].MaxConcurrency; got != 3 {
+		t.Errorf("derived MaxConcurrency = %d, want 3", got)
+	}
+	t.Setenv("SKYFLOW_MAX_CONCURRENCY", "25")
+	if got := loadSkyflowConfigs()["NAME"].MaxConcurrency; got != 25 {
+		t.Errorf("explicit MaxConcurrency = %d, want 25", got)
+	}
+}
+
+func TestSkyflowConfigValidate(t *testing.T) {
+	t.Setenv("SKYFLOW_DATA_PLANE_URL", "https://vault.example/")
+	t.Setenv("SKYFLOW_VAULT_ID_NAME", "v1")
+	t.Setenv("SKYFLOW_VAULT_ID_SSN", "v2")
+	t.Setenv("SKYFLOW_API_KEY", "key")
+	configs := loadSkyflowConfigs()
+	if err := validateSkyflowConfigs(configs); err != nil {
+		t.Fatalf("valid configs: %v", err)
+	}
+	if err := validateSkyflowConfigs(nil); err != nil {
+		t.Errorf("mock mode: %v, want nil", err)
+	}
+
+	t.Setenv("SKYFLOW_API_KEY", "")
+	t.Setenv("SKYFLOW_CREDENTIALS_FILE", "/var/task/sa.json")
+	if err := loadSkyflowConfigs()["NAME"].Validate(); err != nil {
+		t.Errorf("credentials file without API key: %v, want nil", err)
+	}
+	// Startup is then fatal if the file fails to load.
+	if keyless(configs) || !keyless(loadSkyflowConfigs()) {
+		t.Error("keyless should report only configs without an API key")
+	}
+
+	bad := *configs["NAME"]
+	bad.DataPlaneURL = "vault.example"
+	bad.VaultID = ""
+	bad.APIKey = ""
+	bad.BatchSize = 0
+	bad.MaxConcurrency = -1
+	configs["NAME"] = &bad
+	err := validateSkyflowConfigs(configs)
+	if err == nil {
+		t.Fatal("invalid config passed validation")
+	}
+	// Every problem is listed, not just the first.
+	for _, want := range []string{
+		`invalid Skyflow configuration: NAME: SKYFLOW_DATA_PLANE_URL "vault.example" is not an http(s) URL`,
+		"vault ID is empty", "SKYFLOW_API_KEY is empty", "batch size 0", "max concurrency -1",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "SSN") {
+		t.Errorf("error %q blames the valid SSN config", err)
+	}
+}
+
+func TestSignRequestKnownVector(t *testing.T) {
+	body := []byte(`{"vaultID":"vault","tokens":["tok_a"]}`)
+	got := signRequest("shared-secret", "1700000000", body)
+	want := "ca6c8f842150f02fe967bdf202ab81510dcf8985bbb20196159585e05926179f"
+	if got != want {
+		t.Errorf("signRequest = %s, want %s", got, want)
+	}
+}
+
+func TestDoPostSetsHMACHeaders(t *testing.T) {
+	var gotSig, gotTs string
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSig, gotTs = r.Header.Get("X-Gw-Sig"), r.Header.Get("X-Gw-Time")
+		gotBody, _ = io.ReadAll(r.Body)
+		w.Write([]byte(`{"response":[{"token":"tok_a","value":"a"}]}`))
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.HMACSecret = "shared-secret"
+	client.cfg.HMACSignatureHeader = "X-Gw-Sig"
+	client.cfg.HMACTimestampHeader = "X-Gw-Time"
+
+	if _, _, err := client.detokenizeBatch(context.Background(), []string{"tok_a"}); err != nil {
+		t.Fatalf("detokenizeBatch failed: %v", err)
+	}
+	if gotTs == "" {
+		t.Fatal("timestamp header not set")
+	}
+	if want := signRequest("shared-secret", gotTs, gotBody); gotSig != want {
+		t.Errorf("signature = %q, want %q", gotSig, want)
+	}
+}
+
+// gzipVault wraps fakeVault the way a compressing gateway would: it inflates
+// gzip request bodies and gzips responses for clients that accept it.
+type gzipVault struct {
+	gzippedRequests atomic.Int32
+	plainRequests   atomic.Int32
+}
+
+func (g *gzipVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		g.gzippedRequests.Add(1)
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = zr
+	} else {
+		g.plainRequests.Add(1)
+	}
+	if r.Header.Get("Accept-Encoding") != "gzip" {
+		fakeVault(w, r)
+		return
+	}
+	rec := httptest.NewRecorder()
+	fakeVault(rec, r)
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(rec.Code)
+	zw := gzip.NewWriter(w)
+	zw.Write(rec.Body.Bytes())
+	zw.Close()
+}
+
+func TestDoPostGzipRoundTrip(t *testing.T) {
+	vault := &gzipVault{}
+	srv := httptest.NewServer(vault)
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.Compression = "gzip"
+	client.cfg.CompressMinBytes = 100
+	client.cfg.BatchSize = 25
+
+	// One call of 25 long values is over the threshold; the single short row
+	// below it is not.
+	rows := make([][]interface{}, 25)
+	for i := range rows {
+		rows[i] = []interface{}{i, fmt.Sprintf("a-longer-value-%02d", i)}
+	}
+	tokens, _, err := client.Tokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	for i := range tokens {
+		rows[i][1] = tokens[i][1]
+	}
+	got, _, err := client.Detokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	for i, row := range got {
+		if want := fmt.Sprintf("a-longer-value-%02d", i); row[1] != want {
+			t.Errorf("row %d round-tripped to %v, want %s", i, row[1], want)
+		}
+	}
+	if got, _, _ := client.Detokenize(context.Background(), [][]interface{}{{0, "tok_a"}}); got[0][1] != "a" {
+		t.Errorf("small request = %v, want a", got)
+	}
+	if vault.gzippedRequests.Load() != 2 || vault.plainRequests.Load() != 1 {
+		t.Errorf("gzipped=%d plain=%d requests, want 2 and 1", vault.gzippedRequests.Load(), vault.plainRequests.Load())
+	}
+
+	// A truncated gzip response is retried like a dropped connection.
+	var calls atomic.Int32
+	cut := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte{0x1f, 0x8b, 0x08, 0x00})
+			return
+		}
+		vault.ServeHTTP(w, r)
+	}))
+	defer cut.Close()
+	client = newTestClient(cut)
+	client.cfg.Compression = "gzip"
+	client.cfg.RetryMaxAttempts = 2
+	client.cfg.RetryBackoff = time.Millisecond
+	if got, _, _ := client.Detokenize(context.Background(), [][]interface{}{{0, "tok_b"}}); got[0][1] != "b" || calls.Load() != 2 {
+		t.Errorf("after truncated gzip: got %v in %d calls, want b in 2", got, calls.Load())
+	}
+}
+
+func mustReadAll(t *testing.T, r *http.Request) []byte {
+	t.Helper()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Errorf("read request body: %v", err)
+	}
+	return body
+}
+
+// TestConcurrentFanOutRace hammers Tokenize and Detokenize from many
+// goroutines at once. It is meant for `go test -race`, which flags any shared
+// state that escapes batchAggregator's lock.
+func TestConcurrentFanOutRace(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(fakeVault))
+	defer srv.Close()
+	client := newTestClient(srv)
+	client.cfg.BatchSize = 7
+	client.cfg.MaxConcurrency = 8
+
+	rows := make([][]interface{}, 500)
+	for i := range rows {
+		rows[i] = []interface{}{i, fmt.Sprintf("v%d", i%37)}
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			var result [][]interface{}
+			var err error
+			if g%2 == 0 {
+				result, _, err = client.Tokenize(context.Background(), rows)
+			} else {
+				result, _, err = client.Detokenize(context.Background(), rows)
+			}
+			if err != nil {
+				t.Errorf("goroutine %d: %v", g, err)
+				return
+			}
+			for i, row := range result {
+				want := strings.TrimPrefix(rows[i][1].(string), "tok_")
+				if g%2 == 0 {
+					want = "tok_" + rows[i][1].(string)
+				}
+				if row[0] != i || row[1] != want {
+					t.Errorf("goroutine %d row %d = %v, want [%d %s]", g, i, row, i, want)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestBatchAggregatorDropsAfterClose(t *testing.T) {
+	agg := newBatchAggregator(3)
+	applied := 0
+	agg.record(0, 10, nil, func() { applied++ })
+	agg.record(2, 30, fmt.Errorf("boom"), func() { applied++ })
+
+	latencies, errors, pending, _ := agg.close()
+	if ok := agg.record(1, 20, nil, func() { applied++ }); ok {
+		t.Error("record after close returned true")
+	}
+	if applied != 2 || errors != 1 || len(latencies) != 2 {
+		t.Errorf("applied=%d errors=%d latencies=%v", applied, errors, latencies)
+	}
+	if !reflect.DeepEqual(pending, []int{1}) {
+		t.Errorf("pending = %v, want [1]", pending)
+	}
+}
+
+func TestRecoversAfterDroppedConnection(t *testing.T) {
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// Drop the connection without a response, like a reset pooled conn.
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.RetryMaxAttempts = 2
+	client.cfg.RetryBackoff = time.Millisecond
+
+	result, metrics, err := client.Detokenize(context.Background(), [][]interface{}{{0, "tok_a"}})
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	if result[0][1] != "a" {
+		t.Errorf("value = %v, want a", result[0][1])
+	}
+	if metrics.Evictions != 1 || metrics.Retries != 1 || metrics.Errors != 0 {
+		t.Errorf("evictions=%d retries=%d errors=%d, want 1/1/0", metrics.Evictions, metrics.Retries, metrics.Errors)
+	}
+}
+
+func TestInsertNotRetriedAfterDroppedConnection(t *testing.T) {
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		// The insert arrived; drop the connection before answering.
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.RetryMaxAttempts = 3
+	client.cfg.RetryBackoff = time.Millisecond
+
+	result, metrics, _ := client.Tokenize(context.Background(), [][]interface{}{{0, "a"}})
+	if calls.Load() != 1 || metrics.Retries != 0 {
+		t.Errorf("calls=%d retries=%d, want a single unretried insert", calls.Load(), metrics.Retries)
+	}
+	if s, _ := result[0][1].(string); !strings.HasPrefix(s, "ERROR") {
+		t.Errorf("value = %v, want an ERROR", result[0][1])
+	}
+}
+
+func TestUnsent(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = http.Post("http://"+addr, "application/json", strings.NewReader("{}"))
+	if err == nil || !unsent(err) {
+		t.Errorf("unsent(%v) = false, want true for a refused connection", err)
+	}
+	if unsent(io.ErrUnexpectedEOF) {
+		t.Error("unsent(ErrUnexpectedEOF) = true, want false")
+	}
+}
+
+func TestHTTPTimeoutConfig(t *testing.T) {
+	t.Setenv("SKYFLOW_DATA_PLANE_URL", "https://vault.example.com")
+	t.Setenv("SKYFLOW_VAULT_ID", "vault")
+	t.Setenv("SKYFLOW_API_KEY", "key")
+
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	if got := NewSkyflowClient(*loadSkyflowConfigs()["NAME"]).client.Timeout; got != 30*time.Second {
+		t.Errorf("default timeout = %v, want 30s", got)
+	}
+
+	t.Setenv("SKYFLOW_HTTP_TIMEOUT_MS", "5000")
+	if got := NewSkyflowClient(*loadSkyflowConfigs()["NAME"]).client.Timeout; got != 5*time.Second {
+		t.Errorf("timeout = %v, want 5s", got)
+	}
+
+	for _, bad := range []string{"0", "-100", "5s"} {
+		logs.Reset()
+		t.Setenv("SKYFLOW_HTTP_TIMEOUT_MS", bad)
+		if got := loadSkyflowConfigs()["NAME"].HTTPTimeout; got != 30*time.Second {
+			t.Errorf("%q: timeout = %v, want the 30s default", bad, got)
+		}
+		if !strings.Contains(logs.String(), "WARN: invalid SKYFLOW_HTTP_TIMEOUT_MS") {
+			t.Errorf("%q: missing warning in logs: %q", bad, logs.String())
+		}
+	}
+}
+
+func TestBatchSizeClampedToAPILimit(t *testing.T) {
+	t.Setenv("SKYFLOW_DATA_PLANE_URL", "https://vault.example.com")
+	t.Setenv("SKYFLOW_VAULT_ID", "vault")
+	t.Setenv("SKYFLOW_API_KEY", "key")
+	t.Setenv("SKYFLOW_BATCH_SIZE", "500")
+	t.Setenv("SKYFLOW_MAX_API_BATCH", "100")
+
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	if got := loadSkyflowConfigs()["NAME"].BatchSize; got != 100 {
+		t.Errorf("BatchSize = %d, want 100", got)
+	}
+	if !strings.Contains(logs.String(), "WARN: SKYFLOW_BATCH_SIZE=500 exceeds the Skyflow per-call limit of 100") {
+		t.Errorf("missing clamp warning in logs: %q", logs.String())
+	}
+
+	logs.Reset()
+	t.Setenv("SKYFLOW_BATCH_SIZE", "50")
+	if got := loadSkyflowConfigs()["NAME"].BatchSize; got != 50 {
+		t.Errorf("BatchSize = %d, want 50 (under the limit)", got)
+	}
+	if strings.Contains(logs.String(), "clamping") {
+		t.Errorf("unexpected clamp warning: %q", logs.String())
+	}
+}
+
+func TestRequestBodyCanonicalBytes(t *testing.T) {
+	cases := []struct {
+		name string
+		body interface{}
+		want string
+	}{
+		{
+			name: "tokenize",
+			body: tokenizeRequest{
+				VaultID:   "v1",
+				TableName: "table1",
+				Records: []tokenizeRecordReq{
+					{Data: map[string]string{"name": "Alice", "email": "a@example.com"}},
+					{Data: map[string]string{"name": "Bob"}},
+				},
+			},
+			want: `{"vaultID":"v1","tableName":"table1","records":[{"data":{"email":"a@example.com","name":"Alice"}},{"data":{"name":"Bob"}}]}`,
+		},
+		{
+			name: "detokenize",
+			body: detokenizeRequest{VaultID: "v1", Tokens: []string{"t2", "t1"}},
+			want: `{"vaultID":"v1","tokens":["t2","t1"]}`,
+		},
+		{
+			name: "detokenize redaction",
+			body: detokenizeRequest{VaultID: "v1", Tokens: []string{"t1"}, Redaction: "MASKED"},
+			want: `{"vaultID":"v1","tokens":["t1"],"redaction":"MASKED"}`,
+		},
+		{
+			name: "detokenize continue on error",
+			body: detokenizeRequest{VaultID: "v1", Tokens: []string{"t1"}, ContinueOnError: true},
+			want: `{"vaultID":"v1","tokens":["t1"],"continueOnError":true}`,
+		},
+	}
+	for _, c := range cases {
+		got, err := codec.Marshal(c.body)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if string(got) != c.want {
+			t.Errorf("%s body:\n got %s\nwant %s", c.name, got, c.want)
+		}
+	}
+}
+
+func BenchmarkDetokenizeSingleRow(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(fakeVault))
+	defer srv.Close()
+	rows := [][]interface{}{{0, "tok_a"}}
+	for _, fastPath := range []bool{false, true} {
+		client := newTestClient(srv)
+		client.cfg.SingleRowFastPath = fastPath
+		b.Run(fmt.Sprintf("fast=%v", fastPath), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := client.Detokenize(context.Background(), rows); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenizeConflictResolvesExistingToken(t *testing.T) {
+	var lookups atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/records/insert":
+			var req tokenizeRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			var resp tokenizeResponse
+			for _, rec := range req.Records {
+				if rec.Data["name"] == "alice" {
+					resp.Records = append(resp.Records, tokenizeRecordResp{HTTPCode: http.StatusConflict, Error: "duplicate value"})
+					continue
+				}
+				resp.Records = append(resp.Records, tokenizeRecordResp{Tokens: map[string][]tokenEntry{"name": {{Token: "tok_" + rec.Data["name"]}}}})
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/v2/records/get":
+			lookups.Add(1)
+			var req lookupRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			var resp tokenizeResponse
+			for _, v := range req.ColumnValues {
+				resp.Records = append(resp.Records, tokenizeRecordResp{
+					Tokens: map[string][]tokenEntry{req.ColumnName: {{Token: "existing_" + v}}},
+					Fields: map[string]interface{}{req.ColumnName: v},
+				})
+			}
+			json.NewEncoder(w).Encode(resp)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	rows := [][]interface{}{{0, "alice"}, {1, "bob"}, {2, "carol"}}
+
+	client := newTestClient(srv)
+	client.cfg.OnConflict = "error"
+	got, _, _ := client.Tokenize(context.Background(), rows)
+	if s, _ := got[0][1].(string); !strings.HasPrefix(s, "ERROR:") || !strings.Contains(s, "conflict") {
+		t.Errorf("error mode: row 0 = %v, want a conflict error", got[0][1])
+	}
+
+	client.cfg.OnConflict = "resolve"
+	got, metrics, err := client.Tokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	want := [][]interface{}{{0, "existing_alice"}, {1, "tok_bob"}, {2, "tok_carol"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resolve mode: got %v, want %v", got, want)
+	}
+	if lookups.Load() != 1 || metrics.ResolvedConflicts != 1 {
+		t.Errorf("lookups = %d, resolved = %d, want 1, 1", lookups.Load(), metrics.ResolvedConflicts)
+	}
+}
+
+func TestResolveTokensMatchesByValue(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req lookupRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		// Records come back out of order, and one value has none.
+		var resp tokenizeResponse
+		for i := len(req.ColumnValues) - 1; i >= 0; i-- {
+			v := req.ColumnValues[i]
+			if v == "bob" {
+				continue
+			}
+			resp.Records = append(resp.Records, tokenizeRecordResp{
+				Tokens: map[string][]tokenEntry{req.ColumnName: {{Token: "existing_" + v}}},
+				Fields: map[string]interface{}{req.ColumnName: v},
+			})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	items := []indexedValue{{column: "name", value: "alice"}, {column: "name", value: "bob"}, {column: "name", value: "carol"}}
+	got, err := client.resolveTokens(context.Background(), items)
+	if err != nil {
+		t.Fatalf("resolveTokens failed: %v", err)
+	}
+	if got[0] != "existing_alice" || got[2] != "existing_carol" {
+		t.Errorf("tokens = %v, want each value matched to its own record", got)
+	}
+	if !strings.HasPrefix(got[1], "ERROR:") {
+		t.Errorf("bob = %q, want an ERROR for a value with no record", got[1])
+	}
+}
+
+func TestSortBeforeBatch(t *testing.T) {
+	var mu sync.Mutex
+	var sent [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := mustReadAll(t, r)
+		var req detokenizeRequest
+		json.Unmarshal(body, &req)
+		mu.Lock()
+		sent = append(sent, req.Tokens)
+		mu.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.SortBeforeBatch = true
+	rows := [][]interface{}{{0, "tok_d"}, {1, "tok_b"}, {2, "tok_a"}, {3, "tok_d"}, {4, "tok_c"}}
+	got, _, err := client.Detokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	want := [][]interface{}{{0, "d"}, {1, "b"}, {2, "a"}, {3, "d"}, {4, "c"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	batches := make(map[string]bool)
+	for _, tokens := range sent {
+		batches[strings.Join(tokens, ",")] = true
+	}
+	if !batches["tok_a,tok_b"] || !batches["tok_c,tok_d"] {
+		t.Errorf("sub-batches = %v, want [tok_a tok_b] and [tok_c tok_d]", sent)
+	}
+
+	tokRows := [][]interface{}{{0, "zoe"}, {1, "amy"}, {2, "max"}}
+	got, _, err = client.Tokenize(context.Background(), tokRows)
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	want = [][]interface{}{{0, "tok_zoe"}, {1, "tok_amy"}, {2, "tok_max"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tokenize: got %v, want %v", got, want)
+	}
+}
+
+func TestSplitByRequestBytes(t *testing.T) {
+	long := strings.Repeat("t", 40)
+	tokens := []string{"a", "b", long, "c", "d", "e"}
+	sizes := func(batches [][]string) []int {
+		var n []int
+		for _, b := range batches {
+			n = append(n, len(b))
+		}
+		return n
+	}
+	// 43 bytes for the long token alone: it still goes out, on its own.
+	if got := sizes(splitStrings(tokens, 4, 20)); !reflect.DeepEqual(got, []int{2, 1, 3}) {
+		t.Errorf("byte-capped token batches = %v, want [2 1 3]", got)
+	}
+	if got := sizes(splitStrings(tokens, 4, 0)); !reflect.DeepEqual(got, []int{4, 2}) {
+		t.Errorf("count-only token batches = %v, want [4 2]", got)
+	}
+
+	// A two-column record stays whole even when it alone passes the cap.
+	items := []indexedValue{
+		{column: "name", value: "a", record: 0},
+		{column: "name", value: long, record: 1},
+		{column: "email", value: long, record: 1},
+		{column: "name", value: "b", record: 2},
+		{column: "name", value: "c", record: 3},
+	}
+	var got []int
+	for _, b := range splitRecords(items, 10, 60) {
+		got = append(got, len(b))
+	}
+	if !reflect.DeepEqual(got, []int{1, 2, 2}) {
+		t.Errorf("byte-capped record batches = %v items, want [1 2 2]", got)
+	}
+	if got := splitRecords(items, 3, 0); len(got) != 2 || len(got[0]) != 4 {
+		t.Errorf("count-only record batches = %v, want 3 records then 1", got)
+	}
+}
+
+func TestTokenizeRespectsMaxRequestBytes(t *testing.T) {
+	var mu sync.Mutex
+	var sizes []int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sizes = append(sizes, r.ContentLength)
+		mu.Unlock()
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.BatchSize = 100
+	client.cfg.MaxRequestBytes = 2000
+	rows := make([][]interface{}, 20)
+	for i := range rows {
+		rows[i] = []interface{}{i, fmt.Sprintf("%03d%s", i, strings.Repeat("v", 400))}
+	}
+	got, _, err := client.Tokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	if len(sizes) < 5 {
+		t.Errorf("%d requests for 8 KB of values, want at least 5 under a 2000 byte cap", len(sizes))
+	}
+	for _, n := range sizes {
+		if n > 2200 {
+			t.Errorf("request of %d bytes, want about 2000 at most", n)
+		}
+	}
+	for i, row := range got {
+		if row[1] != "tok_"+rows[i][1].(string) {
+			t.Fatalf("row %d = %v, want the token of its own value", i, row)
+		}
+	}
+}
+
+// BenchmarkSortBeforeBatchPayload reports the gzipped size of 25-token
+// detokenize requests built from shuffled versus sorted tokens:
+//
+//	go test -run '^$' -bench SortBeforeBatch ./...
+func BenchmarkSortBeforeBatchPayload(b *testing.B) {
+	tokens := benchTokens(1000)
+	rand.New(rand.NewSource(1)).Shuffle(len(tokens), func(i, j int) { tokens[i], tokens[j] = tokens[j], tokens[i] })
+	sorted := append([]string(nil), tokens...)
+	sort.Strings(sorted)
+	for name, order := range map[string][]string{"shuffled": tokens, "sorted": sorted} {
+		b.Run(name, func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				size = 0
+				for _, batch := range splitStrings(order, 25, 0) {
+					body, _ := json.Marshal(detokenizeRequest{VaultID: "vault", Tokens: batch})
+					var buf bytes.Buffer
+					zw := gzip.NewWriter(&buf)
+					zw.Write(body)
+					zw.Close()
+					size += buf.Len()
+				}
+			}
+			b.ReportMetric(float64(size), "gzip_bytes")
+		})
+	}
+}
+
+// shortWriteConn fails a write once more than budget bytes have gone out,
+// like a connection dropped halfway through sending a request.
+type shortWriteConn struct {
+	net.Conn
+	budget int
+}
+
+func (c *shortWriteConn) Write(p []byte) (int, error) {
+	if len(p) <= c.budget {
+		c.budget -= len(p)
+		return c.Conn.Write(p)
+	}
+	n, _ := c.Conn.Write(p[:c.budget])
+	c.Conn.Close()
+	return n, errors.New("write: broken pipe")
+}
+
+func TestRetriesPartialRequestWrite(t *testing.T) {
+	var bodies []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := mustReadAll(t, r)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.RetryMaxAttempts = 2
+	client.cfg.RetryBackoff = time.Millisecond
+	transport := client.client.Transport.(*evictingTransport).base
+	var dials atomic.Int32
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil || dials.Add(1) > 1 {
+			return conn, err
+		}
+		// First connection: the headers get out, the body does not.
+		return &shortWriteConn{Conn: conn, budget: 64}, nil
+	}
+
+	result, metrics, err := client.Detokenize(context.Background(), [][]interface{}{{0, "tok_a"}})
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	if result[0][1] != "a" {
+		t.Errorf("value = %v, want a", result[0][1])
+	}
+	if metrics.Retries != 1 || metrics.Errors != 0 {
+		t.Errorf("retries=%d errors=%d, want 1/0", metrics.Retries, metrics.Errors)
+	}
+	want := `{"vaultID":"vault","tokens":["tok_a"]}`
+	if len(bodies) != 1 || bodies[0] != want {
+		t.Errorf("server saw bodies %q, want one complete %s", bodies, want)
+	}
+}
+
+func TestTokenizeMixedCaseColumnKey(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req tokenizeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		var resp tokenizeResponse
+		for _, rec := range req.Records {
+			for col, val := range rec.Data {
+				resp.Records = append(resp.Records, tokenizeRecordResp{
+					Tokens: map[string][]tokenEntry{strings.ToUpper(col): {{Token: "tok_" + val}}},
+				})
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	// The warning is once per process; forget earlier runs (-count > 1).
+	caseFallbackWarned.Range(func(key, _ any) bool {
+		caseFallbackWarned.Delete(key)
+		return true
+	})
+
+	client := newTestClient(srv)
+	got, metrics, err := client.Tokenize(context.Background(), [][]interface{}{{0, "Alice"}, {1, "Bob"}, {2, "Carol"}})
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	want := [][]interface{}{{0, "tok_Alice"}, {1, "tok_Bob"}, {2, "tok_Carol"}}
+	if !reflect.DeepEqual(got, want) || metrics.Errors != 0 {
+		t.Errorf("got %v (errors=%d), want %v", got, metrics.Errors, want)
+	}
+	if n := strings.Count(logs.String(), `column "NAME", not "name"`); n != 1 {
+		t.Errorf("got %d case-fallback warnings, want 1:\n%s", n, logs.String())
+	}
+}
+
+func TestDetokenizeEmptyTokens(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body := mustReadAll(t, r)
+		if bytes.Contains(body, []byte(`""`)) {
+			http.Error(w, "empty token", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.SingleRowFastPath = true
+	rows := [][]interface{}{{0, "tok_a"}, {1, ""}, {2, nil}, {3, "tok_b"}, {4, ""}}
+	got, metrics, err := client.Detokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{{0, "a"}, {1, nil}, {2, nil}, {3, "b"}, {4, nil}}
+	if !reflect.DeepEqual(got, want) || metrics.EmptyTokens != 2 || metrics.NullRows != 1 || metrics.Errors != 0 {
+		t.Errorf("got %v (empty=%d null=%d errors=%d), want %v (2, 1, 0)",
+			got, metrics.EmptyTokens, metrics.NullRows, metrics.Errors, want)
+	}
+
+	client.cfg.EmptyTokens = "empty"
+	before := calls.Load()
+	got, metrics, _ = client.Detokenize(context.Background(), [][]interface{}{{7, ""}})
+	if !reflect.DeepEqual(got, [][]interface{}{{7, ""}}) || metrics.EmptyTokens != 1 || calls.Load() != before {
+		t.Errorf("single empty token = %v (empty=%d, calls=%d), want [[7 \"\"]] without a call",
+			got, metrics.EmptyTokens, calls.Load()-before)
+	}
+}
+
+// TestDetokenizeOutputOrderLargeBatch checks that with heavy duplication,
+// malformed rows, multi-argument rows and shuffled Snowflake indexes, every
+// output row sits at its input position, carries its input index, and holds
+// exactly its own values.
+func TestDetokenizeOutputOrderLargeBatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(fakeVault))
+	defer srv.Close()
+	client := newTestClient(srv)
+	client.cfg.BatchSize = 50
+	client.cfg.MaxConcurrency = 8
+
+	const n = 10000
+	rng := rand.New(rand.NewSource(1))
+	indexes := rng.Perm(n) // Snowflake indexes need not match positions
+	rows := make([][]interface{}, n)
+	want := make([][]interface{}, n)
+	for i := range rows {
+		idx := indexes[i] + 100
+		tok := fmt.Sprintf("v%d", rng.Intn(200)) // ~50 copies of each token
+		switch i % 10 {
+		case 3:
+			rows[i] = []interface{}{idx} // malformed: index only
+			want[i] = []interface{}{idx, "ERROR: missing value"}
+		case 6:
+			rows[i] = []interface{}{} // malformed: empty
+			want[i] = []interface{}{i, "ERROR: missing value"}
+		case 7:
+			other := fmt.Sprintf("v%d", rng.Intn(200))
+			rows[i] = []interface{}{idx, "tok_" + tok, nil, "tok_" + other}
+			want[i] = []interface{}{idx, []interface{}{tok, nil, other}}
+		default:
+			rows[i] = []interface{}{idx, "tok_" + tok}
+			want[i] = []interface{}{idx, tok}
+		}
+	}
+
+	for _, sorted := range []bool{false, true} {
+		client.cfg.SortBeforeBatch = sorted
+		got, metrics, err := client.Detokenize(context.Background(), rows)
+		if err != nil {
+			t.Fatalf("sorted=%v: Detokenize failed: %v", sorted, err)
+		}
+		if len(got) != n {
+			t.Fatalf("sorted=%v: %d rows out, want %d", sorted, len(got), n)
+		}
+		for i := range got {
+			if !reflect.DeepEqual(got[i], want[i]) {
+				t.Fatalf("sorted=%v: row %d = %v, want %v", sorted, i, got[i], want[i])
+			}
+		}
+		if metrics.UniqueTokens > 200 || metrics.Errors != 0 {
+			t.Errorf("sorted=%v: unique=%d errors=%d, want at most 200 and 0", sorted, metrics.UniqueTokens, metrics.Errors)
+		}
+	}
+}
+
+func TestTokenizeReorderedInsertResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req tokenizeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		var resp tokenizeResponse
+		// Answer in reverse order, each record naming the request record it answers.
+		for i := len(req.Records) - 1; i >= 0; i-- {
+			idx := i
+			resp.Records = append(resp.Records, tokenizeRecordResp{
+				Tokens:       map[string][]tokenEntry{"name": {{Token: "tok_" + req.Records[i].Data["name"]}}},
+				RequestIndex: &idx,
+			})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.BatchSize = 3
+	rows := [][]interface{}{{0, "Alice"}, {1, "Bob"}, {2, "Carol"}}
+
+	// Positional matching pairs tokens with the wrong rows.
+	client.cfg.InsertOrder = "position"
+	got, _, _ := client.Tokenize(context.Background(), rows)
+	if got[0][1] != "tok_Carol" {
+		t.Errorf("position: row 0 = %v, want the misattributed tok_Carol", got[0][1])
+	}
+
+	client.cfg.InsertOrder = "request_index"
+	got, _, err := client.Tokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	want := [][]interface{}{{0, "tok_Alice"}, {1, "tok_Bob"}, {2, "tok_Carol"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("request_index: got %v, want %v", got, want)
+	}
+
+	// Missing or duplicate indexes fail the sub-batch instead of guessing.
+	one, two := 1, 1
+	if _, err := orderByRequestIndex([]tokenizeRecordResp{{RequestIndex: &one}, {RequestIndex: &two}}); err == nil {
+		t.Error("duplicate requestIndex accepted")
+	}
+	if _, err := orderByRequestIndex([]tokenizeRecordResp{{}}); err == nil {
+		t.Error("missing requestIndex accepted")
+	}
+}
+
+func TestFanOutSkipsSubBatchesNearDeadline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(150 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.BatchSize = 1
+	client.cfg.MaxConcurrency = 1
+	client.cfg.DeadlineMargin = 500 * time.Millisecond
+
+	// 700ms to the deadline less a 500ms margin leaves room for one call.
+	ctx, cancel := context.WithTimeout(context.Background(), 700*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	rows := [][]interface{}{{0, "tok_a"}, {1, "tok_b"}, {2, "tok_c"}, {3, "tok_d"}}
+	result, metrics, err := client.Detokenize(ctx, rows)
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Detokenize took %v, want it to stop near the 200ms margin", elapsed)
+	}
+
+	if result[0][1] != "a" {
+		t.Errorf("row 0 = %v, want a", result[0][1])
+	}
+	if s, _ := result[1][1].(string); !strings.HasPrefix(s, "ERROR:") {
+		t.Errorf("row 1 (in flight at the margin) = %v, want an error", result[1][1])
+	}
+	for _, i := range []int{2, 3} {
+		if result[i][1] != errDeadlineExceededValue {
+			t.Errorf("row %d = %v, want %q", i, result[i][1], errDeadlineExceededValue)
+		}
+	}
+	if metrics.Errors != 3 || metrics.ExpiredBatches != 0 {
+		t.Errorf("errors=%d expired=%d, want 3/0", metrics.Errors, metrics.ExpiredBatches)
+	}
+}
+
+func TestDeadlineMarginPerOperation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.DeadlineMargin = 50 * time.Millisecond
+	client.cfg.TokenizeDeadlineMargin = 400 * time.Millisecond
+	if got := client.deadlineMargin("tokenize"); got != 400*time.Millisecond {
+		t.Errorf("tokenize margin = %v, want 400ms", got)
+	}
+	if got := client.deadlineMargin("detokenize"); got != 50*time.Millisecond {
+		t.Errorf("detokenize margin = %v, want the global 50ms", got)
+	}
+	client.cfg.DetokenizeDeadlineMargin = 150 * time.Millisecond
+	if got := client.deadlineMargin("detokenize"); got != 150*time.Millisecond {
+		t.Errorf("detokenize margin = %v, want 150ms", got)
+	}
+
+	// With 450ms left, reads (150ms margin) have time for a 100ms call and
+	// writes (400ms margin) don't, on both the fan-out and single-row paths.
+	client.cfg.SingleRowFastPath = true
+	for _, rows := range [][][]interface{}{{{0, "a"}, {1, "b"}}, {{0, "a"}}} {
+		ctx, cancel := context.WithTimeout(context.Background(), 450*time.Millisecond)
+		tokens, _, _ := client.Tokenize(ctx, rows)
+		detokRows := [][]interface{}{{0, "tok_a"}, {1, "tok_b"}}[:len(rows)]
+		values, _, _ := client.Detokenize(ctx, detokRows)
+		cancel()
+		for i := range rows {
+			if !isErrorValue(tokens[i][1]) {
+				t.Errorf("%d rows: tokenize row %d = %v, want it stopped by the 400ms margin", len(rows), i, tokens[i][1])
+			}
+			if isErrorValue(values[i][1]) {
+				t.Errorf("%d rows: detokenize row %d = %v, want it within the 150ms margin", len(rows), i, values[i][1])
+			}
+		}
+	}
+}
+
+func TestTokenizeOversizedValue(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(fakeVault))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.MaxValueBytes = 8
+	rows := [][]interface{}{{0, "Alice"}, {1, "a value far over the limit"}, {2, "Bob"}}
+	got, metrics, err := client.Tokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	if got[0][1] != "tok_Alice" || got[2][1] != "tok_Bob" {
+		t.Errorf("in-limit rows = %v, want tokens", got)
+	}
+	if s, _ := got[1][1].(string); !strings.HasPrefix(s, "ERROR: value is 26 bytes") {
+		t.Errorf("oversized row = %v, want a per-row error", got[1][1])
+	}
+	if metrics.Oversized != 1 || metrics.Errors != 0 {
+		t.Errorf("oversized=%d errors=%d, want 1 and 0", metrics.Oversized, metrics.Errors)
+	}
+
+	single, metrics, _ := client.Tokenize(context.Background(), rows[1:2])
+	if s, _ := single[0][1].(string); !strings.HasPrefix(s, "ERROR:") || metrics.Oversized != 1 {
+		t.Errorf("single oversized row = %v (oversized=%d), want an error", single, metrics.Oversized)
+	}
+}
+
+func TestTokenizeMultiColumnSharesRecord(t *testing.T) {
+	var mu sync.Mutex
+	var sent []tokenizeRecordReq
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := mustReadAll(t, r)
+		var req tokenizeRequest
+		json.Unmarshal(body, &req)
+		mu.Lock()
+		sent = append(sent, req.Records...)
+		mu.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv).withColumns([]string{"first_name", "last_name"})
+	client.cfg.SortBeforeBatch = true
+	got, metrics, err := client.Tokenize(context.Background(), [][]interface{}{
+		{0, "Carol", "Young"},
+		{1, "Alice", "Smith"},
+		{2, "Bob", nil},
+		{3, "Dave", "Brown"},
+	})
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	want := [][]interface{}{
+		{0, []interface{}{"tok_Carol", "tok_Young"}},
+		{1, []interface{}{"tok_Alice", "tok_Smith"}},
+		{2, []interface{}{"tok_Bob", nil}},
+		{3, []interface{}{"tok_Dave", "tok_Brown"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Tokenize = %v, want %v", got, want)
+	}
+	// Four rows at BatchSize 2 are two inserts of one record per row.
+	if metrics.SkyflowCalls != 2 || len(sent) != 4 {
+		t.Errorf("calls=%d records=%d, want 2 and 4", metrics.SkyflowCalls, len(sent))
+	}
+	for _, rec := range sent {
+		if rec.Data["first_name"] == "Bob" && len(rec.Data) != 1 || rec.Data["first_name"] != "Bob" && len(rec.Data) != 2 {
+			t.Errorf("record %v, want both of its row's non-NULL columns", rec.Data)
+		}
+	}
+
+	// A column listed twice splits the row into two records.
+	dup := newTestClient(srv).withColumns([]string{"name", "name"})
+	got, _, err = dup.Tokenize(context.Background(), [][]interface{}{{0, "a", "b"}, {1, "c", "d"}})
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	want = [][]interface{}{{0, []interface{}{"tok_a", "tok_b"}}, {1, []interface{}{"tok_c", "tok_d"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("duplicate columns: Tokenize = %v, want %v", got, want)
+	}
+}
+
+func TestTokenizeDedup(t *testing.T) {
+	var mu sync.Mutex
+	inserted := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req tokenizeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		var resp tokenizeResponse
+		mu.Lock()
+		for _, rec := range req.Records {
+			tokens := make(map[string][]tokenEntry, len(rec.Data))
+			for col, val := range rec.Data {
+				inserted[col+"="+val]++
+				tokens[col] = []tokenEntry{{Token: col + "_" + val}}
+			}
+			resp.Records = append(resp.Records, tokenizeRecordResp{Tokens: tokens})
+		}
+		mu.Unlock()
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv).withColumns([]string{"city", "country"})
+	client.cfg.TokenizeDedup = true
+	got, metrics, err := client.Tokenize(context.Background(), [][]interface{}{
+		{0, "Paris", "France"},
+		{1, "Lyon", "France"},
+		{2, "Paris", nil},
+		{3, "Monaco", "Monaco"},
+		{4, "Lyon", "France"},
+	})
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	want := [][]interface{}{
+		{0, []interface{}{"city_Paris", "country_France"}},
+		{1, []interface{}{"city_Lyon", "country_France"}},
+		{2, []interface{}{"city_Paris", nil}},
+		{3, []interface{}{"city_Monaco", "country_Monaco"}},
+		{4, []interface{}{"city_Lyon", "country_France"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Tokenize = %v, want %v", got, want)
+	}
+	// The same value in two columns is two values to insert.
+	for key, n := range inserted {
+		if n != 1 {
+			t.Errorf("%s inserted %d times, want once", key, n)
+		}
+	}
+	// Nine non-NULL slots, five of them inserted.
+	if len(inserted) != 5 || metrics.UniqueTokens != 5 || metrics.DedupPct != 100*(1-5.0/9) {
+		t.Errorf("inserted %v, UniqueTokens=%d DedupPct=%.1f, want 5 values, 5 and 44.4", inserted, metrics.UniqueTokens, metrics.DedupPct)
+	}
+}
+
+func TestTokenizeBYOT(t *testing.T) {
+	var mu sync.Mutex
+	var sent []tokenizeRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req tokenizeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		sent = append(sent, req)
+		mu.Unlock()
+		// Like Skyflow, answer with the caller's token when there is one.
+		var resp tokenizeResponse
+		for _, rec := range req.Records {
+			tokens := make(map[string][]tokenEntry, len(rec.Data))
+			for col, val := range rec.Data {
+				token := "tok_" + val
+				if byo, ok := rec.Tokens[col]; ok {
+					token = byo
+				}
+				tokens[col] = []tokenEntry{{Token: token}}
+			}
+			resp.Records = append(resp.Records, tokenizeRecordResp{Tokens: tokens})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv)
+	client.cfg.BYOT = "ENABLE"
+	rows := [][]interface{}{{0, "a", "my_a"}, {1, "b"}, {2, "c", nil}, {3, nil, "my_null"}, {4, "d", "x", "y"}}
+	got, _, err := client.Tokenize(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	want := [][]interface{}{{0, "my_a"}, {1, "tok_b"}, {2, "tok_c"}, {3, nil}, {4, "ERROR: SKYFLOW_BYOT rows are [idx, value, token], got 3 arguments"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ENABLE: Tokenize = %v, want %v", got, want)
+	}
+	for _, req := range sent {
+		if req.BYOT != "ENABLE" {
+			t.Errorf("request byot = %q, want ENABLE", req.BYOT)
+		}
+		for _, rec := range req.Records {
+			if want := map[string]string{"name": "my_a"}; rec.Data["name"] == "a" && !reflect.DeepEqual(rec.Tokens, want) || rec.Data["name"] != "a" && rec.Tokens != nil {
+				t.Errorf("record %+v, want tokens only for a", rec)
+			}
+		}
+	}
+
+	// ENABLE_STRICT rejects token-less rows without sending them; a single
+	// row skips the fast path so it is checked too.
+	sent = nil
+	client.cfg.BYOT = "ENABLE_STRICT"
+	got, _, _ = client.Tokenize(context.Background(), [][]interface{}{{0, "a"}})
+	if want := "ERROR: SKYFLOW_BYOT=ENABLE_STRICT needs a token for every value"; got[0][1] != want || len(sent) != 0 {
+		t.Errorf("ENABLE_STRICT without a token = %v after %d requests, want %q and none", got, len(sent), want)
+	}
+
+	// Disabled, a third element is a second argument as before.
+	client.cfg.BYOT = ""
+	got, _, _ = client.withColumns([]string{"name", "alias"}).Tokenize(context.Background(), [][]interface{}{{0, "a", "b"}})
+	if want := []interface{}{"tok_a", "tok_b"}; !reflect.DeepEqual(got[0][1], want) {
+		t.Errorf("BYOT off: row = %v, want %v", got[0], want)
+	}
+}
+
+func TestLoadBYOT(t *testing.T) {
+	for v, want := range map[string]string{"": "", "disable": "", "enable": "ENABLE", "Enable_Strict": "ENABLE_STRICT", "on": ""} {
+		t.Setenv("SKYFLOW_BYOT", v)
+		if got := loadBYOT(); got != want {
+			t.Errorf("loadBYOT(%q) = %q, want %q", v, got, want)
+		}
+	}
+}
+
+// TestTokenizeOutputOrder locks in the reassembly contract: whatever is
+// skipped, repeated, sorted or answered out of order, output row i answers
+// input row i and carries its Snowflake index.
+func TestTokenizeOutputOrder(t *testing.T) {
+	// Earlier calls answer later, so sub-batches complete in reverse.
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(max(20-2*calls.Add(1), 0)) * time.Millisecond)
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+
+	rows := [][]interface{}{
+		{17, "zed"},
+		{3, "alice"},
+		{},           // malformed: no index
+		{9, "alice"}, // duplicate of row 1
+		{42},         // malformed: index only
+		{5, nil},     // SQL NULL
+		{8, "a value far over the limit"},
+		{1, 12.5}, // non-string argument
+		{30, "bob"},
+		{2, "zed"}, // duplicate of row 0
+		{11, "carol"},
+		{4, "alice"}, // third copy
+	}
+	want := [][]interface{}{
+		{17, "tok_zed"},
+		{3, "tok_alice"},
+		{2, "ERROR: missing value"},
+		{9, "tok_alice"},
+		{42, "ERROR: missing value"},
+		{5, nil},
+		{8, "ERROR: value is 26 bytes, over the 16 byte limit"},
+		{1, "tok_12.5"},
+		{30, "tok_bob"},
+		{2, "tok_zed"},
+		{11, "tok_carol"},
+		{4, "tok_alice"},
+	}
+	for _, sorted := range []bool{false, true} {
+		client := newTestClient(srv)
+		client.cfg.MaxValueBytes = 16
+		client.cfg.SortBeforeBatch = sorted
+		got, metrics, err := client.Tokenize(context.Background(), rows)
+		if err != nil {
+			t.Fatalf("sorted=%v: Tokenize failed: %v", sorted, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("sorted=%v: Tokenize =\n%v\nwant\n%v", sorted, got, want)
+		}
+		// Duplicates are tokenized separately: 8 values at BatchSize 2.
+		if metrics.UniqueTokens != 8 || metrics.SkyflowCalls != 4 {
+			t.Errorf("sorted=%v: unique=%d calls=%d, want 8 and 4", sorted, metrics.UniqueTokens, metrics.SkyflowCalls)
+		}
+	}
+}
+
+func TestDetokenizeContinueOnError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req detokenizeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		var resp detokenizeResponse
+		for _, tok := range req.Tokens {
+			if tok == "tok_bad" {
+				if !req.ContinueOnError {
+					http.Error(w, `{"error":"token not found"}`, http.StatusNotFound)
+					return
+				}
+				continue // answered by leaving it out
+			}
+			resp.Response = append(resp.Response, detokenizeEntry{Token: tok, Value: jsonString(strings.TrimPrefix(tok, "tok_"))})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+	client := newTestClient(srv)
+	client.cfg.BatchSize = 4
+	rows := [][]interface{}{{0, "tok_a"}, {1, "tok_bad"}, {2, "tok_b"}}
+
+	client.cfg.ContinueOnError = true
+	got, _, err := client.Detokenize(context.Background(), rows)
+	want := [][]interface{}{{0, "a"}, {1, "ERROR: no entry for token in response"}, {2, "b"}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("continueOnError: Detokenize = %v (%v), want %v", got, err, want)
+	}
+
+	// Without it one bad token fails the whole call.
+	client.cfg.ContinueOnError = false
+	got, _, _ = client.Detokenize(context.Background(), rows)
+	if !isErrorValue(got[0][1]) || !isErrorValue(got[2][1]) {
+		t.Errorf("without continueOnError: Detokenize = %v, want every row failed", got)
+	}
+}
+
+func TestCallTimeoutFailsOnlyTheSlowCall(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "tok_slow") {
+			select {
+			case <-time.After(2 * time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fakeVault(w, r)
+	}))
+	defer srv.Close()
+	client := newTestClient(srv)
+	client.cfg.BatchSize = 1
+	client.cfg.MaxConcurrency = 1
+	client.cfg.RetryMaxAttempts = 2
+	client.cfg.CallTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	got, m, err := client.Detokenize(context.Background(), [][]interface{}{{0, "tok_slow"}, {1, "tok_a"}, {2, "tok_b"}})
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v, want the slow call cut off at 100ms", elapsed)
+	}
+	if msg, _ := got[0][1].(string); !strings.Contains(msg, "timed out after 100ms") || got[1][1] != "a" || got[2][1] != "b" {
+		t.Errorf("Detokenize = %v, want only row 0 timed out", got)
+	}
+	if m.Errors != 1 || m.CallMaxMs != 100 {
+		t.Errorf("errors=%d call_max_ms=%d, want 1 and the 100ms timeout", m.Errors, m.CallMaxMs)
+	}
+
+	// The single-row path uses the same deadline.
+	got, m, _ = client.Detokenize(context.Background(), [][]interface{}{{0, "tok_slow"}})
+	if msg, _ := got[0][1].(string); !strings.Contains(msg, "timed out") || m.CallMaxMs != 100 {
+		t.Errorf("single row: %v call_max_ms=%d, want a timeout at 100ms", got, m.CallMaxMs)
+	}
+}
+
+func TestPerRecordErrorsFailOnlyTheirRows(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/tokens/detokenize":
+			var req detokenizeRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			var resp detokenizeResponse
+			for _, tok := range req.Tokens {
+				switch tok {
+				case "tok_bad":
+					resp.Response = append(resp.Response, detokenizeEntry{Token: tok, Error: "invalid token", HTTPCode: 404})
+				case "tok_dropped":
+					// Left out of the response entirely.
+				default:
+					resp.Response = append(resp.Response, detokenizeEntry{Token: tok, Value: jsonString(strings.TrimPrefix(tok, "tok_"))})
+				}
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/v2/records/insert":
+			var req tokenizeRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			var resp tokenizeResponse
+			for _, rec := range req.Records {
+				if rec.Data["name"] == "bad" {
+					resp.Records = append(resp.Records, tokenizeRecordResp{Error: "value fails column regex", HTTPCode: 400})
+					continue
+				}
+				resp.Records = append(resp.Records, tokenizeRecordResp{Tokens: map[string][]tokenEntry{"name": {{Token: "tok_" + rec.Data["name"]}}}})
+			}
+			json.NewEncoder(w).Encode(resp)
+		}
+	}))
+	defer srv.Close()
+	client := newTestClient(srv)
+	client.cfg.BatchSize = 4
+
+	got, m, err := client.Detokenize(context.Background(), [][]interface{}{{0, "tok_a"}, {1, "tok_bad"}, {2, "tok_dropped"}, {3, "tok_b"}})
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	want := [][]interface{}{{0, "a"}, {1, "ERROR: invalid token"}, {2, "ERROR: no entry for token in response"}, {3, "b"}}
+	if !reflect.DeepEqual(got, want) || m.RecordErrors != 2 || m.Errors != 0 {
+		t.Errorf("Detokenize = %v (record_errors=%d errors=%d), want %v (2, 0)", got, m.RecordErrors, m.Errors, want)
+	}
+
+	got, m, err = client.Tokenize(context.Background(), [][]interface{}{{0, "Alice"}, {1, "bad"}, {2, "Bob"}})
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	want = [][]interface{}{{0, "tok_Alice"}, {1, "ERROR: value fails column regex"}, {2, "tok_Bob"}}
+	if !reflect.DeepEqual(got, want) || m.RecordErrors != 1 || m.Errors != 0 {
+		t.Errorf("Tokenize = %v (record_errors=%d errors=%d), want %v (1, 0)", got, m.RecordErrors, m.Errors, want)
+	}
+
+	// Entries that echo no tokens can't be matched; the sub-batch fails as a whole.
+	if entriesByToken([]string{"tok_a"}, []detokenizeEntry{{Value: jsonString("a")}, {Value: jsonString("b")}}) != nil {
+		t.Error("entriesByToken matched entries without tokens")
+	}
+}
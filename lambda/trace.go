@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// traceSampleRate (TRACE_SAMPLE_RATE, 0 to 1) is the fraction of invocations
+// whose Skyflow calls are traced in detail. The hooks and the extra log line
+// per call add latency of their own, so the rest of the invocations skip
+// them entirely and keep benchmark timings clean.
+var traceSampleRate float64
+
+// loadTraceSampleRate reads TRACE_SAMPLE_RATE, clamped to [0, 1]; unset or
+// invalid values disable tracing.
+func loadTraceSampleRate() float64 {
+	v := os.Getenv("TRACE_SAMPLE_RATE")
+	if v == "" {
+		return 0
+	}
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("WARN: invalid TRACE_SAMPLE_RATE %q, tracing disabled", v)
+		return 0
+	}
+	rate = min(max(rate, 0), 1)
+	if rate > 0 {
+		log.Printf("INFO: Tracing %.1f%% of invocations", rate*100)
+	}
+	return rate
+}
+
+// sampleTrace decides whether an invocation is traced, drawing from rnd
+// (uniform in [0, 1)).
+func sampleTrace(rate float64, rnd func() float64) bool {
+	return rate > 0 && rnd() < rate
+}
+
+// callTrace records connection-level timings of one Skyflow request through
+// httptrace hooks. Hooks may fire from the transport's dial goroutines, so
+// the fields sit behind a mutex.
+type callTrace struct {
+	mu                                 sync.Mutex
+	start                              time.Time
+	dnsStart, connectStart, tlsStart   time.Time
+	dns, connect, handshake, firstByte time.Duration
+	reused                             bool
+}
+
+func newCallTrace() *callTrace {
+	return &callTrace{start: time.Now()}
+}
+
+func (t *callTrace) clientTrace() *httptrace.ClientTrace {
+	lock := func(fn func()) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		fn()
+	}
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			lock(func() { t.reused = info.Reused })
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			lock(func() { t.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			lock(func() { t.dns = time.Since(t.dnsStart) })
+		},
+		ConnectStart: func(string, string) {
+			lock(func() { t.connectStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			lock(func() { t.connect = time.Since(t.connectStart) })
+		},
+		TLSHandshakeStart: func() {
+			lock(func() { t.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			lock(func() { t.handshake = time.Since(t.tlsStart) })
+		},
+		GotFirstResponseByte: func() {
+			lock(func() { t.firstByte = time.Since(t.start) })
+		},
+	}
+}
+
+// finish writes one TRACE line for the finished request and adds its time
+// to first byte and total time to c for the invocation's averages.
+func (t *callTrace) finish(req *http.Request, statusCode int, c *callCounters) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	total := time.Since(t.start)
+	log.Printf("TRACE host=%s path=%s status=%d reused=%v dns_us=%d connect_us=%d tls_us=%d ttfb_us=%d total_us=%d",
+		req.URL.Host, req.URL.Path, statusCode, t.reused, t.dns.Microseconds(), t.connect.Microseconds(),
+		t.handshake.Microseconds(), t.firstByte.Microseconds(), total.Microseconds())
+	if t.firstByte > 0 {
+		c.traced.Add(1)
+		c.ttfbUs.Add(t.firstByte.Microseconds())
+		c.totalUs.Add(total.Microseconds())
+	}
+}
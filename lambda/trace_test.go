@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSampleTraceFraction(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, rate := range []float64{0, 0.1, 0.5, 1} {
+		const n = 10000
+		traced := 0
+		for i := 0; i < n; i++ {
+			if sampleTrace(rate, rnd.Float64) {
+				traced++
+			}
+		}
+		if got := float64(traced) / n; got < rate-0.02 || got > rate+0.02 {
+			t.Errorf("rate %.2f: traced fraction %.3f", rate, got)
+		}
+	}
+}
+
+func TestTracedRequestLogsTimings(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(fakeVault))
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	rows := [][]interface{}{{0, "tok_a"}, {1, "tok_b"}, {2, "tok_c"}}
+	client.Detokenize(context.Background(), rows)
+	if strings.Contains(buf.String(), "TRACE ") {
+		t.Errorf("untraced invocation logged a TRACE line:\n%s", buf.String())
+	}
+
+	ctx := withRequestOptions(context.Background(), requestOptions{Trace: true})
+	client.Detokenize(ctx, rows)
+	if n := strings.Count(buf.String(), "TRACE "); n != 2 {
+		t.Errorf("got %d TRACE lines, want one per sub-batch (2):\n%s", n, buf.String())
+	}
+	if !strings.Contains(buf.String(), "path=/v2/tokens/detokenize status=200") {
+		t.Errorf("TRACE line missing path/status:\n%s", buf.String())
+	}
+}
+
+func TestTracedRequestSeparatesFirstByteFromTransfer(t *testing.T) {
+	// Each response waits 60ms before its headers, then sends half the body
+	// and waits 120ms more before the rest.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		fakeVault(rec, r)
+		body := rec.Body.Bytes()
+		time.Sleep(60 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		time.Sleep(120 * time.Millisecond)
+		w.Write(body[len(body)/2:])
+	}))
+	defer srv.Close()
+	client := newTestClient(srv)
+	rows := [][]interface{}{{0, "tok_a"}, {1, "tok_b"}, {2, "tok_c"}}
+
+	_, m, err := client.Detokenize(context.Background(), rows)
+	if err != nil || m.CallTTFBAvgMs != 0 || m.CallTransferAvgMs != 0 {
+		t.Errorf("untraced: ttfb=%d transfer=%d (%v), want both 0", m.CallTTFBAvgMs, m.CallTransferAvgMs, err)
+	}
+
+	ctx := withRequestOptions(context.Background(), requestOptions{Trace: true})
+	_, m, err = client.Detokenize(ctx, rows)
+	if err != nil {
+		t.Fatalf("Detokenize failed: %v", err)
+	}
+	if m.CallTTFBAvgMs < 55 || m.CallTTFBAvgMs > 110 {
+		t.Errorf("ttfb avg = %dms, want about 60", m.CallTTFBAvgMs)
+	}
+	if m.CallTransferAvgMs < 110 || m.CallTransferAvgMs > 200 {
+		t.Errorf("transfer avg = %dms, want about 120", m.CallTransferAvgMs)
+	}
+}